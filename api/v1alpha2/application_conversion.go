@@ -0,0 +1,204 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// parseImportValue reads an import-values entry of a v1alpha2 Dependency. Entries were previously stored in the
+// fmt.Sprintf("%v") form, so child/parent maps look like "map[child:data parent:imported]", and any other string is
+// the name of an export. Entries that can't be written in that form unambiguously are stored as JSON, see
+// formatImportValue.
+func parseImportValue(s string) v1alpha3.ImportValue {
+	if strings.HasPrefix(s, "{") {
+		var iv v1alpha3.ImportValue
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&iv); err == nil && !dec.More() {
+			return iv
+		}
+	}
+	if !strings.HasPrefix(s, "map[") || !strings.HasSuffix(s, "]") {
+		return v1alpha3.ImportValue{Export: s}
+	}
+	// Map keys are printed in sorted order, so child always comes before parent.
+	body := s[len("map[") : len(s)-1]
+	var iv v1alpha3.ImportValue
+	if strings.HasPrefix(body, "child:") {
+		body = body[len("child:"):]
+		i := strings.Index(body, " parent:")
+		if i < 0 {
+			iv.Child = body
+			return iv
+		}
+		iv.Child, body = body[:i], body[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(body, "parent:"):
+		iv.Parent = body[len("parent:"):]
+	case body != "":
+		return v1alpha3.ImportValue{Export: s}
+	}
+	return iv
+}
+
+// formatImportValue returns the v1alpha2 string form of iv. It is the fmt.Sprintf("%v") form of the Helm import-values
+// entry, unless a value would be read back differently, e.g. a child path containing " parent:", in which case iv is
+// written as a JSON object.
+func formatImportValue(iv v1alpha3.ImportValue) string {
+	s := iv.Export
+	if s == "" {
+		var kv []string
+		if iv.Child != "" {
+			kv = append(kv, "child:"+iv.Child)
+		}
+		if iv.Parent != "" {
+			kv = append(kv, "parent:"+iv.Parent)
+		}
+		s = fmt.Sprintf("map[%s]", strings.Join(kv, " "))
+	}
+	if parseImportValue(s) == iv {
+		return s
+	}
+	b, err := json.Marshal(iv)
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// ConvertTo converts this Application to the Hub version (v1alpha3).
+func (src *Application) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha3.Application)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.AppName = src.AppName
+	dst.Versions = nil
+	for _, v := range src.Versions {
+		cv := v1alpha3.ChartVersion{
+			Home:           v.Home,
+			Sources:        v.Sources,
+			Version:        v.Version,
+			Description:    v.Description,
+			Keywords:       v.Keywords,
+			Icon:           v.Icon,
+			APIVersion:     v.APIVersion,
+			AppVersion:     v.AppVersion,
+			Deprecated:     v.Deprecated,
+			Annotations:    v.Annotations,
+			KubeVersion:    v.KubeVersion,
+			KubeCompatible: v.KubeCompatible,
+			Type:           v.Type,
+			URLs:           v.URLs,
+			UpstreamURLs:   v.UpstreamURLs,
+			Provenance:     v.Provenance,
+			Images:         v.Images,
+			Created:        v.Created,
+			Removed:        v.Removed,
+			Digest:         v.Digest,
+			Schema:         v.Schema,
+			Documents:      v.Documents,
+		}
+		for _, m := range v.Maintainers {
+			cv.Maintainers = append(cv.Maintainers, (*v1alpha3.Maintainer)(m))
+		}
+		cv.Scan = (*v1alpha3.ScanSummary)(v.Scan)
+		for _, d := range v.Dependencies {
+			cd := &v1alpha3.Dependency{
+				Name:        d.Name,
+				Version:     d.Version,
+				Repository:  d.Repository,
+				Condition:   d.Condition,
+				Tags:        d.Tags,
+				Enabled:     d.Enabled,
+				Alias:       d.Alias,
+				Application: d.Application,
+				Unresolved:  d.Unresolved,
+			}
+			for _, iv := range d.ImportValues {
+				cd.ImportValues = append(cd.ImportValues, parseImportValue(iv))
+			}
+			cv.Dependencies = append(cv.Dependencies, cd)
+		}
+		dst.Versions = append(dst.Versions, cv)
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha3) to this version. Import values are flattened back into the
+// string form used by v1alpha2.
+func (dst *Application) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha3.Application)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.AppName = src.AppName
+	dst.Versions = nil
+	for _, v := range src.Versions {
+		cv := ChartVersion{
+			Home:           v.Home,
+			Sources:        v.Sources,
+			Version:        v.Version,
+			Description:    v.Description,
+			Keywords:       v.Keywords,
+			Icon:           v.Icon,
+			APIVersion:     v.APIVersion,
+			AppVersion:     v.AppVersion,
+			Deprecated:     v.Deprecated,
+			Annotations:    v.Annotations,
+			KubeVersion:    v.KubeVersion,
+			KubeCompatible: v.KubeCompatible,
+			Type:           v.Type,
+			URLs:           v.URLs,
+			UpstreamURLs:   v.UpstreamURLs,
+			Provenance:     v.Provenance,
+			Images:         v.Images,
+			Created:        v.Created,
+			Removed:        v.Removed,
+			Digest:         v.Digest,
+			Schema:         v.Schema,
+			Documents:      v.Documents,
+		}
+		for _, m := range v.Maintainers {
+			cv.Maintainers = append(cv.Maintainers, (*Maintainer)(m))
+		}
+		cv.Scan = (*ScanSummary)(v.Scan)
+		for _, d := range v.Dependencies {
+			cd := &Dependency{
+				Name:        d.Name,
+				Version:     d.Version,
+				Repository:  d.Repository,
+				Condition:   d.Condition,
+				Tags:        d.Tags,
+				Enabled:     d.Enabled,
+				Alias:       d.Alias,
+				Application: d.Application,
+				Unresolved:  d.Unresolved,
+			}
+			for _, iv := range d.ImportValues {
+				cd.ImportValues = append(cd.ImportValues, formatImportValue(iv))
+			}
+			cv.Dependencies = append(cv.Dependencies, cd)
+		}
+		dst.Versions = append(dst.Versions, cv)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("Application conversion", func() {
+
+	withImportValues := func(ivs ...string) *Application {
+		return &Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable.wordpress"},
+			AppName:    "wordpress",
+			Versions: []ChartVersion{{
+				Version: "9.0.0",
+				URLs:    []string{"https://charts.example.com/wordpress-9.0.0.tgz"},
+				Dependencies: []*Dependency{{
+					Name:         "mariadb",
+					Version:      "7.x.x",
+					ImportValues: ivs,
+				}},
+			}},
+		}
+	}
+
+	importValuesOf := func(app *v1alpha3.Application) []v1alpha3.ImportValue {
+		return app.Versions[0].Dependencies[0].ImportValues
+	}
+
+	It("Should round-trip the export and child/parent forms", func() {
+		src := withImportValues(
+			"data",
+			"map[child:data parent:imported]",
+			"map[child:data]",
+			"map[parent:imported]",
+			"map[child: parent:imported]",
+			"map[other:value]",
+		)
+		var hub v1alpha3.Application
+		Expect(src.ConvertTo(&hub)).To(Succeed())
+		Expect(hub.Name).Should(Equal("stable.wordpress"))
+		Expect(hub.Versions[0].URLs).Should(Equal(src.Versions[0].URLs))
+		Expect(importValuesOf(&hub)).Should(Equal([]v1alpha3.ImportValue{
+			{Export: "data"},
+			{Child: "data", Parent: "imported"},
+			{Child: "data"},
+			{Parent: "imported"},
+			{Parent: "imported"},
+			{Export: "map[other:value]"},
+		}))
+
+		var dst Application
+		Expect(dst.ConvertFrom(&hub)).To(Succeed())
+		Expect(dst.Versions[0].Dependencies[0].ImportValues).Should(Equal([]string{
+			"data",
+			"map[child:data parent:imported]",
+			"map[child:data]",
+			"map[parent:imported]",
+			"map[parent:imported]",
+			"map[other:value]",
+		}))
+	})
+
+	It("Should round-trip values that can't be written in the map form", func() {
+		ivs := []v1alpha3.ImportValue{
+			{Child: "a parent:b", Parent: "c"},
+			{Child: "a", Parent: "b parent:c"},
+			{Child: "data]"},
+			{Export: "map[child:data]"},
+			{Export: `{"child":"data"}`},
+		}
+		hub := &v1alpha3.Application{
+			AppName: "wordpress",
+			Versions: []v1alpha3.ChartVersion{{
+				Version:      "9.0.0",
+				Dependencies: []*v1alpha3.Dependency{{Name: "mariadb", ImportValues: ivs}},
+			}},
+		}
+		var spoke Application
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		var out v1alpha3.Application
+		Expect(spoke.ConvertTo(&out)).To(Succeed())
+		Expect(importValuesOf(&out)).Should(Equal(ivs))
+	})
+})
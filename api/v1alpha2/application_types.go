@@ -61,6 +61,28 @@ type Dependency struct {
 
 	// Alias usable alias to be used for the chart
 	Alias string `json:"alias,omitempty"`
+
+	// Application is the name of the catalog Application that satisfies this dependency.
+	// +optional
+	Application string `json:"application,omitempty"`
+
+	// Unresolved is set when no Application in the catalog matches the dependency's repository and version range.
+	// +optional
+	Unresolved bool `json:"unresolved,omitempty"`
+}
+
+// ScanSummary counts the vulnerabilities found in a chart version's images.
+type ScanSummary struct {
+	// Images that were scanned.
+	Images int `json:"images"`
+	// Critical and High count the vulnerabilities of each severity across the scanned images.
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	// Error is set when the chart couldn't be rendered or an image couldn't be scanned. The counts cover the images
+	// that were scanned.
+	// +optional
+	Error     string      `json:"error,omitempty"`
+	ScannedAt metav1.Time `json:"scannedAt"`
 }
 
 // +kubebuilder:object:generate=true
@@ -114,6 +136,11 @@ type ChartVersion struct {
 	// +optional
 	KubeVersion string `json:"kubeVersion,omitempty"`
 
+	// KubeCompatible reports whether KubeVersion is satisfied by the cluster the marketplace is running in. It is
+	// unset when the cluster version could not be determined.
+	// +optional
+	KubeCompatible *bool `json:"kubeCompatible,omitempty"`
+
 	// Dependencies are a list of dependencies for a chart.
 	// +optional
 	Dependencies []*Dependency `json:"dependencies,omitempty"`
@@ -125,6 +152,24 @@ type ChartVersion struct {
 	// +kubebuilder:validation:MinItems=1
 	URLs []string `json:"urls"`
 
+	// UpstreamURLs are the repository's original URLs of a cached chart, whose URLs point at the marketplace.
+	// +optional
+	UpstreamURLs []string `json:"upstreamURLs,omitempty"`
+
+	// Provenance is set when a cached chart has a provenance file, served alongside the archive with a .prov suffix.
+	// +optional
+	Provenance bool `json:"provenance,omitempty"`
+
+	// Images are the container images the chart deploys, from its artifacthub.io/images annotation or otherwise
+	// found by rendering it with its default values, for Sources with extractImages.
+	// +optional
+	Images []string `json:"images,omitempty"`
+
+	// Scan summarizes the vulnerabilities of the images deployed by the chart's default values, for Sources with
+	// scanImages.
+	// +optional
+	Scan *ScanSummary `json:"scan,omitempty"`
+
 	// +optional
 	Created metav1.Time `json:"created,omitempty"`
 
@@ -149,7 +194,6 @@ type ChartVersion struct {
 // +kubebuilder:printcolumn:name="Chart Name",type="string",JSONPath=".appName",description="Name of chart"
 // +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".versions[0].version",description="Latest Version"
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
-// +kubebuilder:storageversion
 
 // Application is the Schema for the applications API
 type Application struct {
@@ -0,0 +1,72 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CatalogViewStatus summarizes the catalog visible from a namespace, according to the visibility rules of Sources
+// and categories.
+type CatalogViewStatus struct {
+	// Number of visible Applications.
+	// +optional
+	AppCount int `json:"appCount"`
+	// Names of the visible Applications.
+	// +optional
+	Applications []string `json:"applications,omitempty"`
+	// Names of the NamespaceApplications synced into the namespace by its NamespaceSources.
+	// +optional
+	NamespaceApplications []string `json:"namespaceApplications,omitempty"`
+	// Sources with at least one visible Application.
+	// +optional
+	Sources []string `json:"sources,omitempty"`
+	// Categories of the visible Applications.
+	// +optional
+	Categories []string `json:"categories,omitempty"`
+	// LastUpdate is the last time the status was computed.
+	// +optional
+	LastUpdate metav1.Time `json:"lastUpdate,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="App Count",type=integer,JSONPath=`.status.appCount`
+// +kubebuilder:printcolumn:name="Last Update",type=date,JSONPath=`.status.lastUpdate`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CatalogView summarizes what can be installed from the marketplace in its namespace. Its status is maintained by
+// the manager. Access to CatalogViews also decides which namespaces a user browses the catalog from.
+type CatalogView struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status CatalogViewStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CatalogViewList contains a list of CatalogView
+type CatalogViewList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CatalogView `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CatalogView{}, &CatalogViewList{})
+}
@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MarketplacePolicySpec restricts the charts that can be installed with helm. A release must satisfy every policy
+// whose NamespaceSelector matches its namespace. Rules that are left empty allow everything. Policies only check the
+// chart metadata a release carries. A release is matched to the catalog versions with the same chart name and
+// version, and the content of its chart isn't compared, so a modified chart that keeps the name and version of a
+// catalog chart is judged as that chart.
+type MarketplacePolicySpec struct {
+	// NamespaceSelector selects the namespaces the policy applies to. The policy applies to all namespaces when it is
+	// unset.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// AllowedSources restricts installs to charts of Applications synced from these Sources.
+	// +optional
+	AllowedSources []string `json:"allowedSources,omitempty"`
+
+	// AllowedCategories restricts installs to charts of Applications in at least one of these categories.
+	// +optional
+	AllowedCategories []string `json:"allowedCategories,omitempty"`
+
+	// AllowedCharts restricts installs to these charts, given by chart name (e.g. "mysql") or Application name (e.g.
+	// "stable.mysql").
+	// +optional
+	AllowedCharts []string `json:"allowedCharts,omitempty"`
+
+	// VersionConstraints are semver constraints on the installed chart version, keyed by chart name, e.g.
+	// {"mysql": ">= 1.6.0"}.
+	// +optional
+	VersionConstraints map[string]string `json:"versionConstraints,omitempty"`
+
+	// RequireCatalog rejects charts that aren't a version of an Application in the catalog. It is implied by
+	// AllowedSources and AllowedCategories.
+	// +optional
+	RequireCatalog bool `json:"requireCatalog,omitempty"`
+
+	// DenyDeprecated rejects chart versions that are marked deprecated in the catalog.
+	// +optional
+	DenyDeprecated bool `json:"denyDeprecated,omitempty"`
+
+	// DenyRemoved rejects chart versions that have been removed from their repository.
+	// +optional
+	DenyRemoved bool `json:"denyRemoved,omitempty"`
+
+	// RequireProvenance rejects chart versions without a provenance file. Provenance is only known for charts cached
+	// by Sources with cacheCharts.
+	// +optional
+	RequireProvenance bool `json:"requireProvenance,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MarketplacePolicy is the Schema for the marketplacepolicies API. Policies are enforced by a validating webhook on
+// helm release Secrets.
+type MarketplacePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MarketplacePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MarketplacePolicyList contains a list of MarketplacePolicy
+type MarketplacePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MarketplacePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MarketplacePolicy{}, &MarketplacePolicyList{})
+}
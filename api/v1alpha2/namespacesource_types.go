@@ -0,0 +1,56 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=nssource;nssources
+// +kubebuilder:printcolumn:name="State",type="string",JSONPath=".status.state",description="Source sync state"
+// +kubebuilder:printcolumn:name="App Count",type=integer,JSONPath=`.status.appCount`
+// +kubebuilder:printcolumn:name="Last Update",type=date,JSONPath=`.status.lastUpdate`
+// +kubebuilder:printcolumn:name="Update Frequency",type=string,JSONPath=`.spec.updateFrequency`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NamespaceSource is a Source whose charts are synced to NamespaceApplications in its own namespace, so that a tenant
+// can manage a catalog only visible to them. Settings that read the manager's filesystem (directory, certFile, keyFile
+// and caFile) aren't supported, and indexFrom must refer to the NamespaceSource's namespace. Settings that download
+// charts with the manager's resources (cacheCharts, generateIndex, extractImages and scanImages) aren't supported
+// either.
+type NamespaceSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SourceSpec   `json:"spec,omitempty"`
+	Status SourceStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespaceSourceList contains a list of NamespaceSource
+type NamespaceSourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespaceSource `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespaceSource{}, &NamespaceSourceList{})
+}
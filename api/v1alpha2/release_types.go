@@ -34,6 +34,8 @@ type ReleaseSpec struct {
 	Config *runtime.RawExtension `json:"config,omitempty"`
 	// Manifest is the string representation of the rendered template.
 	Manifest string `json:"manifest,omitempty"`
+	// CompressedManifest is the gzipped Manifest, set instead of it when the controller compresses manifests.
+	CompressedManifest []byte `json:"compressedManifest,omitempty"`
 	// Hooks are all of the hooks declared for this release.
 	Hooks []*Hook `json:"hooks,omitempty"`
 	// Version is an int which represents the version of the release.
@@ -42,7 +44,48 @@ type ReleaseSpec struct {
 	Namespace string `json:"namespace"`
 }
 
+// ReleaseMirrorLevel is how much of a helm release is mirrored into the spec of its Release.
+type ReleaseMirrorLevel string
+
+const (
+	// ReleaseMirrorMetadata mirrors the release information and chart metadata, leaving out the values, the rendered
+	// manifest and hooks, and the chart templates.
+	ReleaseMirrorMetadata ReleaseMirrorLevel = "metadata"
+	// ReleaseMirrorValues also mirrors the values the release was installed with.
+	ReleaseMirrorValues ReleaseMirrorLevel = "values"
+	// ReleaseMirrorFull mirrors the whole release, with the data of rendered Secrets redacted.
+	ReleaseMirrorFull ReleaseMirrorLevel = "full"
+)
+
+// ReleaseStatus defines the observed state of Release
+type ReleaseStatus struct {
+	// UninstalledAt is when the release was uninstalled with its history kept. The Release is kept as a tombstone
+	// until the retention period of the controller has passed since then.
+	UninstalledAt *metav1.Time `json:"uninstalledAt,omitempty"`
+	// MirrorLevel is how much of the release the spec holds.
+	// +kubebuilder:validation:Enum=metadata;values;full
+	MirrorLevel ReleaseMirrorLevel `json:"mirrorLevel,omitempty"`
+	// ManifestURL is where the rendered manifest of the release is served from when the spec doesn't hold it.
+	ManifestURL string `json:"manifestURL,omitempty"`
+	// Application is the catalog Application the release was installed from, when it could be identified.
+	Application *ApplicationReference `json:"application,omitempty"`
+}
+
+// ApplicationReference identifies the version of a catalog Application a release was installed from.
+type ApplicationReference struct {
+	// Name is the name of the Application.
+	Name string `json:"name"`
+	// Source is the name of the Source the Application is synced from.
+	Source string `json:"source,omitempty"`
+	// Version is the chart version that was installed.
+	Version string `json:"version"`
+	// Digest is the digest of the chart archive that was installed. It is only set when whatever installed the release
+	// recorded the digest on the stored release and it matched the digest the Source's index records.
+	Digest string `json:"digest,omitempty"`
+}
+
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="App",type="string",JSONPath=".spec.chart.metadata.name",description="App Name"
 // +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".spec.chart.metadata.version",description="App Version"
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".spec.info.status",description="Deployment Status"
@@ -53,7 +96,8 @@ type Release struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec ReleaseSpec `json:"spec,omitempty"`
+	Spec   ReleaseSpec   `json:"spec,omitempty"`
+	Status ReleaseStatus `json:"status,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -20,9 +20,31 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// SourceSpec defines the desired state of Source
+// SourceSpec defines the desired state of Source. The repository index is read from one of URL, Directory or
+// IndexFrom.
 type SourceSpec struct {
-	URL string `json:"url"`
+	// URL of the chart repository. When the index is read from IndexFrom, relative chart URLs are resolved against
+	// it.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Directory is a path on the manager's filesystem, such as a mounted volume, containing an index.yaml and/or
+	// packaged charts. Charts that aren't in index.yaml are indexed from their archives. Chart URLs point into the
+	// directory, so directory Sources are usually combined with CacheCharts.
+	// +optional
+	Directory string `json:"directory,omitempty"`
+
+	// IndexFrom reads the repository index from a ConfigMap or Secret. It is reread every UpdateFrequency.
+	// +optional
+	IndexFrom *IndexReference `json:"indexFrom,omitempty"`
+
+	// GenerateIndex builds the index from the packaged charts found by listing URL, for repositories without an
+	// index.yaml. URL is either an HTTP directory listing or an S3-compatible bucket,
+	// s3://bucket/prefix?region=us-east-1&endpoint=http://minio:9000, in which case Username and Password are the
+	// access key. Chart metadata is cached between syncs, so unchanged archives aren't downloaded again.
+	// +optional
+	GenerateIndex bool `json:"generateIndex,omitempty"`
+
 	// +optional
 	SkipSync bool `json:"skipSync"`
 	// TODO make this pull from a secret
@@ -41,6 +63,91 @@ type SourceSpec struct {
 	// Duration to sleep after updating before running again. This is a naive frequency, it doesn't make any guarantees
 	// about the time between updates.
 	UpdateFrequency string `json:"updateFrequency,omitempty"`
+
+	// Filter limits which charts and chart versions are synced from the repository.
+	// +optional
+	Filter *SourceFilter `json:"filter,omitempty"`
+
+	// CacheCharts downloads chart archives and provenance files into the marketplace's chart store and rewrites
+	// chart URLs to point at the marketplace, for clusters that can't reach the repository. The manager must be
+	// started with a chart store configured. Cached archives of Sources with credentials are only served to users
+	// that may download the Application's charts.
+	// +optional
+	CacheCharts bool `json:"cacheCharts,omitempty"`
+
+	// ExtractImages records the container images of each chart version, so that they can be mirrored ahead of
+	// installs. Images are read from the chart's artifacthub.io/images annotation when it has one, and otherwise found
+	// by rendering the chart with its default values.
+	// +optional
+	ExtractImages bool `json:"extractImages,omitempty"`
+
+	// ScanImages scans the images each chart version deploys, found as for ExtractImages, for known vulnerabilities,
+	// recording a summary on the version. Versions are rescanned once their scan is older than the
+	// manager's scan interval. The manager must be started with a scanner configured.
+	// +optional
+	ScanImages bool `json:"scanImages,omitempty"`
+
+	// Visibility limits who the Source's Applications are listed for by the marketplace's visible apps endpoint and
+	// CatalogViews. Applications are visible to everyone when it is unset.
+	// +optional
+	Visibility *Visibility `json:"visibility,omitempty"`
+}
+
+// Visibility selects who may see a set of Applications: members of Groups, and users that may browse the catalog
+// from a namespace matched by NamespaceSelector, i.e. that may get CatalogViews in that namespace. Users that may get
+// CatalogViews in every namespace see all Applications. Visibility only filters catalog listings; it doesn't restrict
+// reading the Application objects themselves.
+type Visibility struct {
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// +optional
+	Groups []string `json:"groups,omitempty"`
+}
+
+// IndexReference is a key of a ConfigMap or Secret holding a repository index.
+type IndexReference struct {
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Key defaults to index.yaml.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// SourceFilter selects the charts and chart versions synced from a Source. Filters also apply to what was synced
+// before they changed: versions that are still in the repository index but no longer pass are removed from their
+// Application, and the Applications of charts that no longer pass are deleted.
+type SourceFilter struct {
+	// Charts to sync. Entries are shell globs matched against the chart name, or regular expressions when wrapped in
+	// slashes (e.g. "/^prometheus(-.*)?$/"). All charts are included when empty.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Charts to skip, using the same syntax as Include. Exclusions take precedence over inclusions.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Semver constraints keyed by chart name, e.g. {"mysql": ">= 1.0.0, < 2.0.0"}.
+	// +optional
+	VersionConstraints map[string]string `json:"versionConstraints,omitempty"`
+
+	// Only sync the latest N versions of each chart, counted after the other filters are applied.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	LatestVersions int `json:"latestVersions,omitempty"`
+
+	// Skip versions with a semver pre-release component.
+	// +optional
+	ExcludePrereleases bool `json:"excludePrereleases,omitempty"`
+
+	// Skip versions marked as deprecated.
+	// +optional
+	ExcludeDeprecated bool `json:"excludeDeprecated,omitempty"`
+
+	// Skip charts of type library.
+	// +optional
+	ExcludeLibraries bool `json:"excludeLibraries,omitempty"`
 }
 
 // SourceStatus defines the observed state of Source
@@ -51,6 +158,25 @@ type SourceStatus struct {
 	LastUpdate metav1.Time `json:"lastUpdate,omitempty"`
 	// +optional
 	AppCount int `json:"appCount"`
+	// Number of charts skipped by spec.filter during the last sync.
+	// +optional
+	FilteredCharts int `json:"filteredCharts,omitempty"`
+	// Number of chart versions skipped by spec.filter during the last sync.
+	// +optional
+	FilteredVersions int `json:"filteredVersions,omitempty"`
+	// Applications that could not be written during the last sync.
+	// +optional
+	FailedApps []ApplicationSyncError `json:"failedApps,omitempty"`
+	// Number of chart versions that could not be cached when spec.cacheCharts is set. They are retried on the next
+	// sync.
+	// +optional
+	UncachedVersions int `json:"uncachedVersions,omitempty"`
+}
+
+// ApplicationSyncError records why an Application failed to sync.
+type ApplicationSyncError struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,239 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Maintainer describes a Chart maintainer.
+type Maintainer struct {
+	// Name is a user name or organization name
+	Name string `json:"name,omitempty"`
+
+	// Email is an optional email address to contact the named maintainer
+	Email string `json:"email,omitempty"`
+
+	// URL is an optional URL to an address for the named maintainer
+	// +optional
+	URL string `json:"url,omitempty"`
+}
+
+// Dependency describes a chart upon which another chart depends.
+//
+// Dependencies can be used to express developer intent, or to capture the state
+// of a chart.
+type Dependency struct {
+	// Name is the name of the dependency.
+	Name string `json:"name"`
+
+	// Version is the version (range) of this chart.
+	Version string `json:"version,omitempty"`
+
+	// The URL to the repository.
+	Repository string `json:"repository"`
+
+	// A yaml path that resolves to a boolean, used for enabling/disabling charts (e.g. subchart1.enabled )
+	Condition string `json:"condition,omitempty"`
+
+	// Tags can be used to group charts for enabling/disabling together
+	Tags []string `json:"tags,omitempty"`
+
+	// Enabled bool determines if chart should be loaded
+	Enabled bool `json:"enabled,omitempty"`
+
+	// ImportValues holds the mapping of source values to parent key to be imported
+	ImportValues []ImportValue `json:"import-values,omitempty"`
+
+	// Alias usable alias to be used for the chart
+	Alias string `json:"alias,omitempty"`
+
+	// Application is the name of the catalog Application that satisfies this dependency.
+	// +optional
+	Application string `json:"application,omitempty"`
+
+	// Unresolved is set when no Application in the catalog matches the dependency's repository and version range.
+	// +optional
+	Unresolved bool `json:"unresolved,omitempty"`
+}
+
+// ImportValue is a single import-values entry of a dependency. Helm accepts either the name of a key under the child
+// chart's exports, or an explicit child/parent pair of value paths, so exactly one of Export or Child and Parent is
+// set.
+type ImportValue struct {
+	// Export is the name of a key under the child chart's "exports" values, imported into the parent's root.
+	// +optional
+	Export string `json:"export,omitempty"`
+
+	// Child is the path of the values to import from the child chart.
+	// +optional
+	Child string `json:"child,omitempty"`
+
+	// Parent is the path in the parent chart's values the child values are imported to.
+	// +optional
+	Parent string `json:"parent,omitempty"`
+}
+
+// ScanSummary counts the vulnerabilities found in a chart version's images.
+type ScanSummary struct {
+	// Images that were scanned.
+	Images int `json:"images"`
+	// Critical and High count the vulnerabilities of each severity across the scanned images.
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	// Error is set when the chart couldn't be rendered or an image couldn't be scanned. The counts cover the images
+	// that were scanned.
+	// +optional
+	Error     string      `json:"error,omitempty"`
+	ScannedAt metav1.Time `json:"scannedAt"`
+}
+
+// +kubebuilder:object:generate=true
+type ChartVersion struct {
+	// The URL to a relevant project page, git repo, or contact person
+	// +optional
+	Home string `json:"home,omitempty"`
+
+	// Source is the URL to the source code of this chart
+	// +optional
+	Sources []string `json:"sources,omitempty"`
+
+	// A SemVer 2 conformant version string of the chart
+	Version string `json:"version,omitempty"`
+
+	// A one-sentence description of the chart
+	Description string `json:"description,omitempty"`
+
+	// A list of string keywords
+	Keywords []string `json:"keywords,omitempty"`
+
+	// A list of name and URL/email address combinations for the maintainer(s)
+	Maintainers []*Maintainer `json:"maintainers,omitempty"`
+
+	// The URL to an icon file.
+	Icon string `json:"icon,omitempty"`
+
+	// The API Version of this chart.
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// The condition to check to enable chart
+	//Condition string `json:"condition,omitempty"`
+
+	// The tags to check to enable chart
+	// +optional
+	//Tags string `json:"tags,omitempty"`
+
+	// The version of the application enclosed inside of this chart.
+	AppVersion string `json:"appVersion,omitempty"`
+
+	// Whether or not this chart is deprecated
+	// +optional
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// Annotations are additional mappings uninterpreted by Helm,
+	// made available for inspection by other applications.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// KubeVersion is a SemVer constraint specifying the version of Kubernetes required.
+	// +optional
+	KubeVersion string `json:"kubeVersion,omitempty"`
+
+	// KubeCompatible reports whether KubeVersion is satisfied by the cluster the marketplace is running in. It is
+	// unset when the cluster version could not be determined.
+	// +optional
+	KubeCompatible *bool `json:"kubeCompatible,omitempty"`
+
+	// Dependencies are a list of dependencies for a chart.
+	// +optional
+	Dependencies []*Dependency `json:"dependencies,omitempty"`
+
+	// Specifies the chart type: application or library
+	// +kubebuilder:validation:Enum=application;library
+	Type string `json:"type,omitempty"`
+
+	// +kubebuilder:validation:MinItems=1
+	URLs []string `json:"urls"`
+
+	// UpstreamURLs are the repository's original URLs of a cached chart, whose URLs point at the marketplace.
+	// +optional
+	UpstreamURLs []string `json:"upstreamURLs,omitempty"`
+
+	// Provenance is set when a cached chart has a provenance file, served alongside the archive with a .prov suffix.
+	// +optional
+	Provenance bool `json:"provenance,omitempty"`
+
+	// Images are the container images the chart deploys, from its artifacthub.io/images annotation or otherwise
+	// found by rendering it with its default values, for Sources with extractImages.
+	// +optional
+	Images []string `json:"images,omitempty"`
+
+	// Scan summarizes the vulnerabilities of the images deployed by the chart's default values, for Sources with
+	// scanImages.
+	// +optional
+	Scan *ScanSummary `json:"scan,omitempty"`
+
+	// +optional
+	Created metav1.Time `json:"created,omitempty"`
+
+	// +optional
+	Removed *bool `json:"removed,omitempty"`
+
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// Override chart values schema
+	// +optional
+	Schema []byte `json:"schema,omitempty"`
+
+	// Extra application documents for display in the marketplace. Map of title to string content.
+	// +optional
+	Documents map[string]string `json:"documents,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=app;apps
+// +kubebuilder:printcolumn:name="Source",type="string",JSONPath=".metadata.ownerReferences[0].name",description="Chart Source"
+// +kubebuilder:printcolumn:name="Chart Name",type="string",JSONPath=".appName",description="Name of chart"
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".versions[0].version",description="Latest Version"
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:storageversion
+
+// Application is the Schema for the applications API
+type Application struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// The actual application name
+	AppName string `json:"appName"`
+
+	// +kubebuilder:validation:MinItems=1
+	Versions []ChartVersion `json:"versions"`
+}
+
+// +kubebuilder:object:root=true
+
+// ApplicationList contains a list of Application
+type ApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Application `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Application{}, &ApplicationList{})
+}
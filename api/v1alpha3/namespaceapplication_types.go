@@ -0,0 +1,53 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=nsapp;nsapps
+// +kubebuilder:printcolumn:name="Source",type="string",JSONPath=".metadata.ownerReferences[0].name",description="Chart Source"
+// +kubebuilder:printcolumn:name="Chart Name",type="string",JSONPath=".appName",description="Name of chart"
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".versions[0].version",description="Latest Version"
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NamespaceApplication is an Application synced from a NamespaceSource, which lives in the NamespaceSource's namespace
+type NamespaceApplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// The actual application name
+	AppName string `json:"appName"`
+
+	// +kubebuilder:validation:MinItems=1
+	Versions []ChartVersion `json:"versions"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespaceApplicationList contains a list of NamespaceApplication
+type NamespaceApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespaceApplication `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespaceApplication{}, &NamespaceApplicationList{})
+}
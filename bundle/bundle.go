@@ -0,0 +1,116 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bundle moves a catalog between clusters as a single signed tarball, for clusters without access to the
+// upstream chart repositories.
+//
+// A bundle is a gzipped tar archive containing:
+//
+//   sources/{name}.yaml              Sources, without credentials
+//   applications/{name}.yaml         Applications of those Sources
+//   charts/{source}/{chart}-{version}.tgz[.prov]
+//                                    cached chart archives, when exported with charts
+//   manifest.json                    the SHA-256 of every file above
+//   manifest.sig                     the ed25519 signature of manifest.json
+//
+// The manifest and its signature are written last, and nothing is imported until they have been verified.
+package bundle
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// APIVersion identifies the bundle format.
+	APIVersion = "marketplace.criticalstack.com/bundle/v1"
+
+	manifestFile  = "manifest.json"
+	signatureFile = "manifest.sig"
+
+	sourcesDir      = "sources/"
+	applicationsDir = "applications/"
+	chartsDir       = "charts/"
+
+	// BundleLabel is set on imported Sources and Applications to the name of the bundle they came from.
+	BundleLabel = "marketplace.criticalstack.com/bundle.name"
+	// UpstreamURLAnnotation records an imported Source's original repository URL.
+	UpstreamURLAnnotation = "marketplace.criticalstack.com/bundle.upstream-url"
+)
+
+// Manifest lists the files of a bundle and their SHA-256 digests.
+type Manifest struct {
+	APIVersion string    `json:"apiVersion"`
+	Created    time.Time `json:"created"`
+	Sources    []string  `json:"sources"`
+	// Files maps file names to hex encoded SHA-256 digests.
+	Files map[string]string `json:"files"`
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 ed25519 private key, e.g. as generated by:
+//
+//   openssl genpkey -algorithm ed25519 -out bundle.key
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	b, err := readPEM(filename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s", filename)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%s is not an ed25519 private key", filename)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX ed25519 public key, e.g. as generated by:
+//
+//   openssl pkey -in bundle.key -pubout -out bundle.pub
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	b, err := readPEM(filename, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s", filename)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("%s is not an ed25519 public key", filename)
+	}
+	return pub, nil
+}
+
+func readPEM(filename, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, errors.Errorf("%s does not contain a PEM encoded %s", filename, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,286 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// rewrite copies a bundle, replacing the contents of files with f.
+func rewrite(b []byte, f func(name string, data []byte) []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	Expect(err).ToNot(HaveOccurred())
+	tr := tar.NewReader(gr)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(tr)
+		Expect(err).ToNot(HaveOccurred())
+		data = f(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		Expect(tw.WriteHeader(hdr)).To(Succeed())
+		_, err = tw.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gw.Close()).To(Succeed())
+	return out.Bytes()
+}
+
+var _ = Describe("Bundle", func() {
+
+	ctx := context.Background()
+
+	var (
+		pub      ed25519.PublicKey
+		priv     ed25519.PrivateKey
+		dir      string
+		src      client.Client
+		srcStore chartstore.Store
+		dstStore chartstore.Store
+	)
+
+	newSource := func(name, url string) *marketplacev1alpha2.Source {
+		return &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name)},
+			Spec: marketplacev1alpha2.SourceSpec{
+				URL:         url,
+				Username:    "admin",
+				Password:    "hunter2",
+				CacheCharts: true,
+			},
+		}
+	}
+	newApp := func(source *marketplacev1alpha2.Source, chart string, v marketplacev1alpha3.ChartVersion) *marketplacev1alpha3.Application {
+		app := &marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   source.Name + "." + chart,
+				Labels: map[string]string{"marketplace.criticalstack.com/source.name": source.Name},
+			},
+			AppName:  chart,
+			Versions: []marketplacev1alpha3.ChartVersion{v},
+		}
+		isController := true
+		app.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: marketplacev1alpha2.GroupVersion.String(),
+			Kind:       "Source",
+			Name:       source.Name,
+			UID:        source.UID,
+			Controller: &isController,
+		}}
+		return app
+	}
+
+	export := func(opts ExportOptions) []byte {
+		var buf bytes.Buffer
+		opts.Key = priv
+		_, err := Export(ctx, src, &buf, opts)
+		Expect(err).ToNot(HaveOccurred())
+		return buf.Bytes()
+	}
+
+	BeforeEach(func() {
+		var err error
+		pub, priv, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		dir, err = ioutil.TempDir("", "bundle")
+		Expect(err).ToNot(HaveOccurred())
+		srcStore, err = chartstore.NewDir(filepath.Join(dir, "src"))
+		Expect(err).ToNot(HaveOccurred())
+		dstStore, err = chartstore.NewDir(filepath.Join(dir, "dst"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(srcStore.Put(ctx, "stable/mysql-1.0.0.tgz", strings.NewReader("mysql archive"))).To(Succeed())
+		Expect(srcStore.Put(ctx, "stable/mysql-1.0.0.tgz.prov", strings.NewReader("mysql provenance"))).To(Succeed())
+
+		stable := newSource("stable", "https://charts.example.com")
+		other := newSource("other", "https://other.example.com")
+		src = fake.NewFakeClientWithScheme(scheme,
+			stable,
+			other,
+			newApp(stable, "mysql", marketplacev1alpha3.ChartVersion{
+				Version:      "1.0.0",
+				URLs:         []string{"http://marketplace/charts/files/stable/mysql-1.0.0.tgz"},
+				UpstreamURLs: []string{"https://charts.example.com/mysql-1.0.0.tgz"},
+				Provenance:   true,
+			}),
+			newApp(stable, "redis", marketplacev1alpha3.ChartVersion{
+				Version:      "2.0.0",
+				URLs:         []string{"http://marketplace/charts/files/stable/redis-2.0.0.tgz"},
+				UpstreamURLs: []string{"https://charts.example.com/redis-2.0.0.tgz"},
+			}),
+			newApp(other, "nginx", marketplacev1alpha3.ChartVersion{
+				Version: "0.1.0",
+				URLs:    []string{"https://other.example.com/nginx-0.1.0.tgz"},
+			}),
+		)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Should export and import a catalog", func() {
+		b := export(ExportOptions{Sources: []string{"stable"}, Charts: srcStore})
+
+		dst := fake.NewFakeClientWithScheme(scheme)
+		m, err := Import(ctx, dst, bytes.NewReader(b), ImportOptions{
+			Key:       pub,
+			Location:  "/bundles/catalog.tgz",
+			Charts:    dstStore,
+			ChartsURL: "http://marketplace.local/charts/files",
+			Scheme:    scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Sources).Should(Equal([]string{"stable"}))
+
+		var s marketplacev1alpha2.Source
+		Expect(dst.Get(ctx, client.ObjectKey{Name: "stable"}, &s)).To(Succeed())
+		Expect(s.Spec.URL).Should(Equal("file:///bundles/catalog.tgz"))
+		Expect(s.Spec.SkipSync).Should(BeTrue())
+		Expect(s.Spec.Username).Should(BeEmpty())
+		Expect(s.Spec.Password).Should(BeEmpty())
+		Expect(s.Annotations).Should(HaveKeyWithValue(UpstreamURLAnnotation, "https://charts.example.com"))
+		Expect(s.Labels).Should(HaveKey(BundleLabel))
+
+		var apps marketplacev1alpha3.ApplicationList
+		Expect(dst.List(ctx, &apps)).To(Succeed())
+		Expect(apps.Items).Should(HaveLen(2))
+		for _, app := range apps.Items {
+			Expect(metav1.GetControllerOf(&app).Name).Should(Equal("stable"))
+			v := app.Versions[0]
+			switch app.AppName {
+			case "mysql":
+				Expect(v.URLs).Should(Equal([]string{"http://marketplace.local/charts/files/stable/mysql-1.0.0.tgz"}))
+				Expect(v.UpstreamURLs).Should(Equal([]string{"https://charts.example.com/mysql-1.0.0.tgz"}))
+				Expect(v.Provenance).Should(BeTrue())
+			case "redis":
+				// not in the chart store, so exported with its upstream urls
+				Expect(v.URLs).Should(Equal([]string{"https://charts.example.com/redis-2.0.0.tgz"}))
+				Expect(v.UpstreamURLs).Should(BeEmpty())
+			}
+		}
+
+		rc, err := dstStore.Get(ctx, "stable/mysql-1.0.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		Expect(string(data)).Should(Equal("mysql archive"))
+		ok, err := dstStore.Exists(ctx, "stable/mysql-1.0.0.tgz.prov")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).Should(BeTrue())
+
+		By("Importing the bundle again")
+		_, err = Import(ctx, dst, bytes.NewReader(b), ImportOptions{Key: pub, Charts: dstStore, Scheme: scheme})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should export every source by default", func() {
+		var buf bytes.Buffer
+		m, err := Export(ctx, src, &buf, ExportOptions{Key: priv})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Sources).Should(Equal([]string{"other", "stable"}))
+		Expect(m.Files).Should(HaveLen(5))
+
+		_, err = Export(ctx, src, &buf, ExportOptions{Key: priv, Sources: []string{"missing"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should reject bundles that were modified or signed by another key", func() {
+		b := export(ExportOptions{Charts: srcStore})
+		dst := fake.NewFakeClientWithScheme(scheme)
+		opts := ImportOptions{Key: pub, Charts: dstStore, Scheme: scheme}
+
+		tampered := rewrite(b, func(name string, data []byte) []byte {
+			if name == "charts/stable/mysql-1.0.0.tgz" {
+				return []byte("malicious archive")
+			}
+			return data
+		})
+		_, err := Import(ctx, dst, bytes.NewReader(tampered), opts)
+		Expect(err).Should(MatchError(ContainSubstring("digest mismatch")))
+
+		resigned := rewrite(b, func(name string, data []byte) []byte {
+			if name == manifestFile {
+				return bytes.Replace(data, []byte(`"stable"`), []byte(`"stable" `), 1)
+			}
+			return data
+		})
+		_, err = Import(ctx, dst, bytes.NewReader(resigned), opts)
+		Expect(err).Should(MatchError(ContainSubstring("signature verification failed")))
+
+		otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		opts.Key = otherPub
+		_, err = Import(ctx, dst, bytes.NewReader(b), opts)
+		Expect(err).Should(MatchError(ContainSubstring("signature verification failed")))
+
+		var sources marketplacev1alpha2.SourceList
+		Expect(dst.List(ctx, &sources)).To(Succeed())
+		Expect(sources.Items).Should(BeEmpty())
+	})
+
+	It("Should load PEM encoded keys", func() {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		Expect(err).ToNot(HaveOccurred())
+		keyFile := filepath.Join(dir, "bundle.key")
+		Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+		der, err = x509.MarshalPKIXPublicKey(pub)
+		Expect(err).ToNot(HaveOccurred())
+		pubFile := filepath.Join(dir, "bundle.pub")
+		Expect(ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)).To(Succeed())
+
+		loadedPriv, err := LoadPrivateKey(keyFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loadedPriv).Should(Equal(priv))
+		loadedPub, err := LoadPublicKey(pubFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loadedPub).Should(Equal(pub))
+
+		_, err = LoadPublicKey(keyFile)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,257 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	// Sources to export. Every Source is exported when empty.
+	Sources []string
+	// Charts is the chart store that cached chart archives are read from. Charts aren't exported when it is nil.
+	// Chart versions that aren't cached are exported without their archive.
+	Charts chartstore.Store
+	// Key signs the bundle.
+	Key ed25519.PrivateKey
+	Log logr.Logger
+}
+
+// Export writes a bundle of Sources and their Applications to w.
+func Export(ctx context.Context, c client.Reader, w io.Writer, opts ExportOptions) (*Manifest, error) {
+	if opts.Key == nil {
+		return nil, errors.New("a signing key is required")
+	}
+	if opts.Log == nil {
+		opts.Log = logf.NullLogger{}
+	}
+	sources, err := listSources(ctx, c, opts.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	gw := gzip.NewWriter(w)
+	bw := &writer{
+		tw:       tar.NewWriter(gw),
+		manifest: &Manifest{APIVersion: APIVersion, Created: time.Now().UTC(), Files: make(map[string]string)},
+	}
+	for _, src := range sources {
+		var apps marketplacev1alpha3.ApplicationList
+		if err := c.List(ctx, &apps, client.MatchingLabels{catalog.SourceLabel: src.Name}); err != nil {
+			return nil, err
+		}
+		sort.Slice(apps.Items, func(i, j int) bool {
+			return apps.Items[i].Name < apps.Items[j].Name
+		})
+		for _, app := range apps.Items {
+			if ref := metav1.GetControllerOf(&app); ref == nil || ref.Name != src.Name {
+				continue
+			}
+			if err := bw.writeApplication(ctx, src.Name, &app, opts); err != nil {
+				return nil, errors.Wrapf(err, "cannot export application %s", app.Name)
+			}
+		}
+		if err := bw.writeSource(&src); err != nil {
+			return nil, errors.Wrapf(err, "cannot export source %s", src.Name)
+		}
+		bw.manifest.Sources = append(bw.manifest.Sources, src.Name)
+	}
+
+	manifest, err := json.MarshalIndent(bw.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.writeRaw(manifestFile, manifest); err != nil {
+		return nil, err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(opts.Key, manifest))
+	if err := bw.writeRaw(signatureFile, []byte(sig)); err != nil {
+		return nil, err
+	}
+	if err := bw.tw.Close(); err != nil {
+		return nil, err
+	}
+	return bw.manifest, gw.Close()
+}
+
+func listSources(ctx context.Context, c client.Reader, names []string) ([]marketplacev1alpha2.Source, error) {
+	var all marketplacev1alpha2.SourceList
+	if err := c.List(ctx, &all); err != nil {
+		return nil, err
+	}
+	sort.Slice(all.Items, func(i, j int) bool {
+		return all.Items[i].Name < all.Items[j].Name
+	})
+	if len(names) == 0 {
+		return all.Items, nil
+	}
+	byName := make(map[string]marketplacev1alpha2.Source)
+	for _, src := range all.Items {
+		byName[src.Name] = src
+	}
+	var out []marketplacev1alpha2.Source
+	for _, name := range names {
+		src, ok := byName[name]
+		if !ok {
+			return nil, errors.Errorf("source %q not found", name)
+		}
+		out = append(out, src)
+	}
+	return out, nil
+}
+
+type writer struct {
+	tw       *tar.Writer
+	manifest *Manifest
+}
+
+// writeSource writes src without its credentials or status.
+func (w *writer) writeSource(src *marketplacev1alpha2.Source) error {
+	out := &marketplacev1alpha2.Source{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: marketplacev1alpha2.GroupVersion.String(),
+			Kind:       "Source",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        src.Name,
+			Labels:      src.Labels,
+			Annotations: src.Annotations,
+		},
+		Spec: src.Spec,
+	}
+	out.Spec.Username = ""
+	out.Spec.Password = ""
+	out.Spec.CertFile = ""
+	out.Spec.KeyFile = ""
+	out.Spec.CAFile = ""
+	return w.writeYAML(sourcesDir+src.Name+".yaml", out)
+}
+
+// writeApplication writes app along with any of its cached chart archives. Versions whose archive isn't included
+// are exported with their upstream URLs.
+func (w *writer) writeApplication(ctx context.Context, source string, app *marketplacev1alpha3.Application, opts ExportOptions) error {
+	out := &marketplacev1alpha3.Application{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: marketplacev1alpha3.GroupVersion.String(),
+			Kind:       "Application",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        app.Name,
+			Labels:      app.Labels,
+			Annotations: app.Annotations,
+		},
+		AppName:  app.AppName,
+		Versions: make([]marketplacev1alpha3.ChartVersion, len(app.Versions)),
+	}
+	copy(out.Versions, app.Versions)
+	for i := range out.Versions {
+		v := &out.Versions[i]
+		if len(v.UpstreamURLs) == 0 {
+			continue
+		}
+		if opts.Charts != nil {
+			key := chartstore.ChartKey(source, app.AppName, v.Version)
+			ok, err := w.copyChart(ctx, opts.Charts, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if v.Provenance {
+					if _, err := w.copyChart(ctx, opts.Charts, key+".prov"); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			opts.Log.Info("chart archive is not cached, exporting upstream urls", "app", app.Name, "version", v.Version)
+		}
+		v.URLs = v.UpstreamURLs
+		v.UpstreamURLs = nil
+		v.Provenance = false
+	}
+	return w.writeYAML(applicationsDir+app.Name+".yaml", out)
+}
+
+// copyChart copies key from the chart store into the bundle, reporting whether it exists.
+func (w *writer) copyChart(ctx context.Context, store chartstore.Store, key string) (bool, error) {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, chartstore.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return false, err
+	}
+	return true, w.writeFile(chartsDir+key, data)
+}
+
+func (w *writer) writeYAML(name string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return w.writeFile(name, data)
+}
+
+// writeFile writes a file and records it in the manifest.
+func (w *writer) writeFile(name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	w.manifest.Files[name] = hex.EncodeToString(sum[:])
+	return w.writeRaw(name, data)
+}
+
+func (w *writer) writeRaw(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  w.manifest.Created,
+	}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
@@ -0,0 +1,331 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// Key verifies the bundle signature.
+	Key ed25519.PublicKey
+	// InsecureSkipVerify imports bundles without verifying their signature.
+	InsecureSkipVerify bool
+
+	// Location is where the bundle was read from, recorded as the file:// URL of the imported Sources.
+	Location string
+
+	// Charts is the chart store bundled chart archives are imported into, and ChartsURL the base URL they are served
+	// from. Chart archives are skipped when it is nil.
+	Charts    chartstore.Store
+	ChartsURL string
+
+	Scheme *runtime.Scheme
+	Log    logr.Logger
+}
+
+// bundleFile is a file read from a bundle. Chart archives are spooled to disk, everything else is kept in memory.
+type bundleFile struct {
+	digest string
+	data   []byte
+	path   string
+}
+
+// Import verifies the bundle read from r and creates or updates its Sources and Applications. Sources are imported
+// with skipSync, since their repositories aren't expected to be reachable, and their URL is set to the bundle's
+// location. Chart archives are copied into the chart store and Application URLs pointed at it.
+func Import(ctx context.Context, c client.Client, r io.Reader, opts ImportOptions) (*Manifest, error) {
+	if opts.Key == nil && !opts.InsecureSkipVerify {
+		return nil, errors.New("a verification key is required")
+	}
+	if opts.Log == nil {
+		opts.Log = logf.NullLogger{}
+	}
+	tmp, err := ioutil.TempDir("", "marketplace-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	files, manifest, err := readBundle(r, tmp, opts)
+	if err != nil {
+		return nil, err
+	}
+	name := bundleName(manifest)
+	location := opts.Location
+	if abs, err := filepath.Abs(location); err == nil {
+		location = abs
+	}
+
+	for _, srcName := range manifest.Sources {
+		f, ok := files[sourcesDir+srcName+".yaml"]
+		if !ok {
+			return nil, errors.Errorf("bundle has no file for source %q", srcName)
+		}
+		var in marketplacev1alpha2.Source
+		if err := yaml.UnmarshalStrict(f.data, &in); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode source %s", srcName)
+		}
+		src := &marketplacev1alpha2.Source{}
+		src.Name = in.Name
+		if _, err := controllerutil.CreateOrUpdate(ctx, c, src, func() error {
+			src.Labels = withLabel(in.Labels, name)
+			src.Annotations = in.Annotations
+			if src.Annotations == nil {
+				src.Annotations = make(map[string]string)
+			}
+			src.Annotations[UpstreamURLAnnotation] = in.Spec.URL
+			src.Spec = in.Spec
+			src.Spec.URL = "file://" + filepath.ToSlash(location)
+			src.Spec.SkipSync = true
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "cannot import source %s", srcName)
+		}
+		opts.Log.Info("imported source", "source", src.Name)
+
+		if err := importApplications(ctx, c, src, files, name, opts); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func importApplications(ctx context.Context, c client.Client, src *marketplacev1alpha2.Source, files map[string]*bundleFile, name string, opts ImportOptions) error {
+	var names []string
+	for n := range files {
+		if strings.HasPrefix(n, applicationsDir) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		var in marketplacev1alpha3.Application
+		if err := yaml.UnmarshalStrict(files[n].data, &in); err != nil {
+			return errors.Wrapf(err, "cannot decode %s", n)
+		}
+		if in.Labels[catalog.SourceLabel] != src.Name {
+			continue
+		}
+		versions := make([]marketplacev1alpha3.ChartVersion, len(in.Versions))
+		copy(versions, in.Versions)
+		for i := range versions {
+			if err := importChart(ctx, src.Name, in.AppName, &versions[i], files, opts); err != nil {
+				return errors.Wrapf(err, "cannot import chart %s %s", in.AppName, versions[i].Version)
+			}
+		}
+		app := &marketplacev1alpha3.Application{}
+		app.Name = in.Name
+		if _, err := controllerutil.CreateOrUpdate(ctx, c, app, func() error {
+			app.Labels = withLabel(in.Labels, name)
+			app.Annotations = in.Annotations
+			app.AppName = in.AppName
+			app.Versions = versions
+			return controllerutil.SetControllerReference(src, app, opts.Scheme)
+		}); err != nil {
+			return errors.Wrapf(err, "cannot import application %s", in.Name)
+		}
+	}
+	return nil
+}
+
+// importChart copies a bundled chart archive into the chart store and points cv at it. Versions without an archive
+// keep their upstream URLs.
+func importChart(ctx context.Context, source, chart string, cv *marketplacev1alpha3.ChartVersion, files map[string]*bundleFile, opts ImportOptions) error {
+	key := chartstore.ChartKey(source, chart, cv.Version)
+	f, ok := files[chartsDir+key]
+	if !ok {
+		return nil
+	}
+	if opts.Charts == nil {
+		opts.Log.Info("no chart store configured, skipping chart archive", "chart", chart, "version", cv.Version)
+		if len(cv.UpstreamURLs) > 0 {
+			cv.URLs = cv.UpstreamURLs
+			cv.UpstreamURLs = nil
+			cv.Provenance = false
+		}
+		return nil
+	}
+	if err := putFile(ctx, opts.Charts, key, f); err != nil {
+		return err
+	}
+	cv.Provenance = false
+	if prov, ok := files[chartsDir+key+".prov"]; ok {
+		if err := putFile(ctx, opts.Charts, key+".prov", prov); err != nil {
+			return err
+		}
+		cv.Provenance = true
+	}
+	if len(cv.UpstreamURLs) == 0 {
+		cv.UpstreamURLs = cv.URLs
+	}
+	cv.URLs = []string{strings.TrimSuffix(opts.ChartsURL, "/") + "/" + key}
+	return nil
+}
+
+func putFile(ctx context.Context, store chartstore.Store, key string, f *bundleFile) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return store.Put(ctx, key, file)
+}
+
+// readBundle reads every file of the bundle, then checks them against the manifest and its signature.
+func readBundle(r io.Reader, tmp string, opts ImportOptions) (map[string]*bundleFile, *Manifest, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "bundle is not a gzipped tarball")
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	files := make(map[string]*bundleFile)
+	var manifestData, sigData []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, nil, errors.Errorf("unexpected entry %q in bundle", hdr.Name)
+		}
+		name := hdr.Name
+		if clean := path.Clean(name); clean != name || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+			return nil, nil, errors.Errorf("invalid file name %q in bundle", name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, nil, errors.Errorf("duplicate file %q in bundle", name)
+		}
+		switch {
+		case name == manifestFile:
+			manifestData, err = ioutil.ReadAll(tr)
+		case name == signatureFile:
+			sigData, err = ioutil.ReadAll(tr)
+		case strings.HasPrefix(name, chartsDir):
+			files[name], err = spool(tr, tmp)
+		case strings.HasPrefix(name, sourcesDir), strings.HasPrefix(name, applicationsDir):
+			var data []byte
+			data, err = ioutil.ReadAll(tr)
+			sum := sha256.Sum256(data)
+			files[name] = &bundleFile{digest: hex.EncodeToString(sum[:]), data: data}
+		default:
+			return nil, nil, errors.Errorf("unexpected file %q in bundle", name)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if manifestData == nil {
+		return nil, nil, errors.New("bundle has no manifest")
+	}
+	if !opts.InsecureSkipVerify {
+		sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigData)))
+		if err != nil || len(sigData) == 0 {
+			return nil, nil, errors.New("bundle has no valid signature")
+		}
+		if !ed25519.Verify(opts.Key, manifestData, sig) {
+			return nil, nil, errors.New("bundle signature verification failed")
+		}
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decode manifest")
+	}
+	if manifest.APIVersion != APIVersion {
+		return nil, nil, errors.Errorf("unsupported bundle version %q", manifest.APIVersion)
+	}
+	for name, digest := range manifest.Files {
+		f, ok := files[name]
+		if !ok {
+			return nil, nil, errors.Errorf("bundle is missing %s", name)
+		}
+		if f.digest != digest {
+			return nil, nil, errors.Errorf("digest mismatch for %s", name)
+		}
+	}
+	for name := range files {
+		if _, ok := manifest.Files[name]; !ok {
+			return nil, nil, errors.Errorf("%s is not in the bundle manifest", name)
+		}
+	}
+	return files, &manifest, nil
+}
+
+// spool writes a chart archive to a temporary file, hashing it on the way.
+func spool(r io.Reader, dir string) (*bundleFile, error) {
+	f, err := ioutil.TempFile(dir, "chart-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return nil, err
+	}
+	return &bundleFile{digest: hex.EncodeToString(h.Sum(nil)), path: f.Name()}, nil
+}
+
+// bundleName identifies a bundle by the digest of its manifest.
+func bundleName(m *Manifest) string {
+	b, _ := json.Marshal(m)
+	sum := sha256.Sum256(b)
+	return "sha256-" + hex.EncodeToString(sum[:])[:16]
+}
+
+func withLabel(labels map[string]string, name string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[BundleLabel] = name
+	return out
+}
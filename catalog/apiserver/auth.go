@@ -0,0 +1,185 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// user is the identity the aggregator forwards with each request.
+type user struct {
+	Name   string
+	Groups []string
+	Extra  map[string][]string
+}
+
+type authenticator interface {
+	authenticate(r *http.Request) (*user, error)
+}
+
+type authorizer interface {
+	// authorize reports whether u may perform verb on appsearches, and the reason if not.
+	authorize(ctx context.Context, u *user, verb, name string) (bool, string, error)
+	// canView reports whether u may browse the catalog from namespace, or from every namespace when it is empty, as
+	// for the visibility rules of the catalog API.
+	canView(ctx context.Context, u *user, namespace string) (bool, error)
+}
+
+// requestHeaderAuthenticator trusts the identity headers set by the kube-apiserver aggregator, once its client
+// certificate has been verified against the requestheader CA.
+type requestHeaderAuthenticator struct {
+	allowedNames    []string
+	usernameHeaders []string
+	groupHeaders    []string
+	extraPrefixes   []string
+}
+
+const (
+	authConfigMapNamespace = "kube-system"
+	authConfigMapName      = "extension-apiserver-authentication"
+)
+
+// loadRequestHeaderConfig reads the aggregator's front-proxy configuration that kube-apiserver publishes for
+// extension apiservers, returning the CA pool used to verify client certificates.
+func loadRequestHeaderConfig(ctx context.Context, c client.Reader) (*x509.CertPool, *requestHeaderAuthenticator, error) {
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, client.ObjectKey{Namespace: authConfigMapNamespace, Name: authConfigMapName}, &cm); err != nil {
+		return nil, nil, err
+	}
+	ca := cm.Data["requestheader-client-ca-file"]
+	if ca == "" {
+		return nil, nil, errors.Errorf("%s/%s has no requestheader-client-ca-file", authConfigMapNamespace, authConfigMapName)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return nil, nil, errors.New("cannot parse requestheader-client-ca-file")
+	}
+	a := &requestHeaderAuthenticator{}
+	for key, dst := range map[string]*[]string{
+		"requestheader-allowed-names":        &a.allowedNames,
+		"requestheader-username-headers":     &a.usernameHeaders,
+		"requestheader-group-headers":        &a.groupHeaders,
+		"requestheader-extra-headers-prefix": &a.extraPrefixes,
+	} {
+		if v := cm.Data[key]; v != "" {
+			if err := json.Unmarshal([]byte(v), dst); err != nil {
+				return nil, nil, errors.Wrapf(err, "cannot parse %s", key)
+			}
+		}
+	}
+	return pool, a, nil
+}
+
+func (a *requestHeaderAuthenticator) authenticate(r *http.Request) (*user, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("no verified client certificate")
+	}
+	if len(a.allowedNames) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		allowed := false
+		for _, n := range a.allowedNames {
+			if n == cn {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, errors.Errorf("client certificate %q is not allowed to proxy requests", cn)
+		}
+	}
+	u := &user{Extra: make(map[string][]string)}
+	for _, h := range a.usernameHeaders {
+		if u.Name = r.Header.Get(h); u.Name != "" {
+			break
+		}
+	}
+	if u.Name == "" {
+		return nil, errors.New("no user in request headers")
+	}
+	for _, h := range a.groupHeaders {
+		u.Groups = append(u.Groups, r.Header[textproto.CanonicalMIMEHeaderKey(h)]...)
+	}
+	for h, vv := range r.Header {
+		for _, prefix := range a.extraPrefixes {
+			if !strings.HasPrefix(strings.ToLower(h), strings.ToLower(prefix)) {
+				continue
+			}
+			key, err := url.PathUnescape(strings.ToLower(h[len(prefix):]))
+			if err != nil {
+				continue
+			}
+			u.Extra[key] = append(u.Extra[key], vv...)
+		}
+	}
+	return u, nil
+}
+
+// sarAuthorizer delegates authorization to the cluster with a SubjectAccessReview, so access to appsearches is
+// managed with regular RBAC.
+type sarAuthorizer struct {
+	client client.Client
+}
+
+func (a *sarAuthorizer) authorize(ctx context.Context, u *user, verb, name string) (bool, string, error) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   u.Name,
+			Groups: u.Groups,
+			Extra:  make(map[string]authorizationv1.ExtraValue),
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:    GroupVersion.Group,
+				Version:  GroupVersion.Version,
+				Resource: resourceName,
+				Verb:     verb,
+				Name:     name,
+			},
+		},
+	}
+	for k, v := range u.Extra {
+		sar.Spec.Extra[k] = v
+	}
+	if err := a.client.Create(ctx, sar); err != nil {
+		return false, "", err
+	}
+	return sar.Status.Allowed, sar.Status.Reason, nil
+}
+
+func (a *sarAuthorizer) canView(ctx context.Context, u *user, namespace string) (bool, error) {
+	info := &authenticationv1.UserInfo{
+		Username: u.Name,
+		Groups:   u.Groups,
+		Extra:    make(map[string]authenticationv1.ExtraValue),
+	}
+	for k, v := range u.Extra {
+		info.Extra[k] = v
+	}
+	return (&catalog.SubjectAccessReviewAuthorizer{Client: a.client}).CanView(ctx, info, namespace)
+}
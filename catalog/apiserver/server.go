@@ -0,0 +1,436 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apiserver exposes catalog search as the aggregated API search.marketplace.criticalstack.com, so that
+// searches can be run with kubectl and access is controlled with RBAC:
+//
+//	kubectl get appsearches --field-selector q=postgres,category=database
+//
+// Requests are proxied by the kube-apiserver aggregator, which is authenticated by its front-proxy client
+// certificate. Each request is then authorized with a SubjectAccessReview for the forwarded user, and only sees the
+// Applications the catalog's visibility rules show to that user.
+package apiserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	certutil "k8s.io/client-go/util/cert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// Server serves the search API. It reads Applications through Client, which is expected to be the manager's
+// cache-backed client, and ranks them with Index.
+type Server struct {
+	Client client.Client
+	// APIReader is used to read the aggregator's authentication configuration from kube-system without caching it.
+	APIReader client.Reader
+	Index     *catalog.Index
+	Log       logr.Logger
+
+	// Addr is the address the server listens on.
+	Addr string
+	// CertDir contains the serving certificate, tls.crt and tls.key. A self-signed certificate is generated when
+	// they don't exist.
+	CertDir string
+}
+
+// NeedLeaderElection allows the API to be served by every manager replica.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the API until stop is closed.
+func (s *Server) Start(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	clientCAs, authn, err := loadRequestHeaderConfig(ctx, s.APIReader)
+	if err != nil {
+		return err
+	}
+	cert, err := s.servingCert()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler: s.handler(authn, &sarAuthorizer{client: s.Client}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    clientCAs,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	s.Log.Info("serving search API", "addr", l.Addr().String())
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+	select {
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	case err := <-errCh:
+		return err
+	}
+}
+
+func (s *Server) servingCert() (tls.Certificate, error) {
+	certFile := filepath.Join(s.CertDir, "tls.crt")
+	keyFile := filepath.Join(s.CertDir, "tls.key")
+	if _, err := os.Stat(certFile); err == nil {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	s.Log.Info("no serving certificate found, generating a self-signed certificate", "dir", s.CertDir)
+	certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey("marketplace-search-api", nil, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (s *Server) handler(authn authenticator, authz authorizer) http.Handler {
+	prefix := "/apis/" + GroupVersion.String()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis", s.groupList)
+	mux.HandleFunc("/apis/"+GroupVersion.Group, s.group)
+	mux.HandleFunc(prefix, s.resourceList)
+	mux.HandleFunc(prefix+"/"+resourceName, s.authorized(authn, authz, "list", s.list))
+	mux.HandleFunc(prefix+"/"+resourceName+"/", s.authorized(authn, authz, "get", s.get))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+// authorized authenticates the request and checks that the user may perform verb before calling next with the
+// Viewer the catalog's visibility rules are applied for. Watches are authorized as such but are not supported.
+func (s *Server) authorized(authn authenticator, authz authorizer, verb string, next func(http.ResponseWriter, *http.Request, *visibility, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := authn.authenticate(r)
+		if err != nil {
+			writeStatus(w, apierrors.NewUnauthorized(err.Error()))
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeStatus(w, apierrors.NewMethodNotSupported(groupResource, strings.ToLower(r.Method)))
+			return
+		}
+		name := ""
+		if verb == "get" {
+			name = path.Base(r.URL.Path)
+		}
+		if w := r.URL.Query().Get("watch"); w == "true" || w == "1" {
+			verb = "watch"
+		}
+		ok, reason, err := authz.authorize(r.Context(), u, verb, name)
+		if err != nil {
+			s.Log.Error(err, "authorization failed", "user", u.Name)
+			writeStatus(w, apierrors.NewInternalError(err))
+			return
+		}
+		if !ok {
+			writeStatus(w, apierrors.NewForbidden(groupResource, name, errors.New(reason)))
+			return
+		}
+		if verb == "watch" {
+			writeStatus(w, apierrors.NewMethodNotSupported(groupResource, verb))
+			return
+		}
+		vis, err := s.visibility(r.Context(), authz, u)
+		if err != nil {
+			s.Log.Error(err, "cannot apply visibility rules", "user", u.Name)
+			writeStatus(w, apierrors.NewInternalError(err))
+			return
+		}
+		next(w, r, vis, name)
+	}
+}
+
+// visibility is the catalog's visibility rules and the Viewer they are applied for.
+type visibility struct {
+	rules  *catalog.VisibilityRules
+	viewer *catalog.Viewer
+}
+
+func (s *Server) visibility(ctx context.Context, authz authorizer, u *user) (*visibility, error) {
+	rules, err := catalog.LoadVisibilityRules(ctx, s.Client)
+	if err != nil {
+		return nil, err
+	}
+	if rules.Empty() {
+		return &visibility{rules: rules, viewer: &catalog.Viewer{All: true}}, nil
+	}
+	v, err := catalog.NewViewer(ctx, s.Client, rules, u.Groups, func(ctx context.Context, namespace string) (bool, error) {
+		return authz.canView(ctx, u, namespace)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &visibility{rules: rules, viewer: v}, nil
+}
+
+func (s *Server) groupList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &metav1.APIGroupList{
+		TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+		Groups:   []metav1.APIGroup{apiGroup()},
+	})
+}
+
+func (s *Server) group(w http.ResponseWriter, r *http.Request) {
+	g := apiGroup()
+	g.TypeMeta = metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"}
+	writeJSON(w, &g)
+}
+
+func (s *Server) resourceList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: GroupVersion.String(),
+		APIResources: []metav1.APIResource{{
+			Name:         resourceName,
+			SingularName: "appsearch",
+			Namespaced:   false,
+			Kind:         kindName,
+			Verbs:        metav1.Verbs{"get", "list"},
+			Categories:   []string{"marketplace"},
+		}},
+	})
+}
+
+func apiGroup() metav1.APIGroup {
+	v := metav1.GroupVersionForDiscovery{GroupVersion: GroupVersion.String(), Version: GroupVersion.Version}
+	return metav1.APIGroup{
+		Name:             GroupVersion.Group,
+		Versions:         []metav1.GroupVersionForDiscovery{v},
+		PreferredVersion: v,
+	}
+}
+
+// searchQuery translates the field selector into a catalog search. Supported fields are q, category, source and
+// deprecated, plus metadata.name.
+func searchQuery(r *http.Request) (catalog.Query, string, error) {
+	q := catalog.Query{}
+	name := ""
+	sel, err := fields.ParseSelector(r.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		return q, "", err
+	}
+	for _, req := range sel.Requirements() {
+		if req.Operator != "=" && req.Operator != "==" {
+			return q, "", apierrors.NewBadRequest("only equality field selectors are supported")
+		}
+		switch req.Field {
+		case "q":
+			q.Text = req.Value
+		case "category":
+			q.Category = strings.ToLower(req.Value)
+		case "source":
+			q.Source = req.Value
+		case "deprecated":
+			b, err := strconv.ParseBool(req.Value)
+			if err != nil {
+				return q, "", apierrors.NewBadRequest("deprecated must be true or false")
+			}
+			q.Deprecated = &b
+		case "metadata.name":
+			name = req.Value
+		default:
+			return q, "", apierrors.NewBadRequest("unsupported field selector " + req.Field)
+		}
+	}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return q, "", apierrors.NewBadRequest("invalid limit")
+		}
+		q.Limit = n
+	}
+	return q, name, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, vis *visibility, _ string) {
+	q, name, err := searchQuery(r)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	q.Visible = func(source string, categories []string) bool {
+		return vis.rules.Allows(source, categories, vis.viewer)
+	}
+	// The limit applies to the items left after the metadata.name selector, not to the search hits.
+	limit := q.Limit
+	q.Limit = 0
+	res := s.Index.Search(q)
+	list := &AppSearchList{
+		TypeMeta: metav1.TypeMeta{Kind: kindName + "List", APIVersion: GroupVersion.String()},
+		Items:    make([]AppSearch, 0, len(res.Hits)),
+	}
+	for _, hit := range res.Hits {
+		if limit > 0 && len(list.Items) == limit {
+			break
+		}
+		if name != "" && hit.Name != name {
+			continue
+		}
+		var app marketplacev1alpha3.Application
+		if err := s.Client.Get(r.Context(), client.ObjectKey{Name: hit.Name}, &app); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			writeStatus(w, apierrors.NewInternalError(err))
+			return
+		}
+		list.Items = append(list.Items, newAppSearch(&app, hit.Score))
+	}
+	if wantsTable(r) {
+		writeJSON(w, table(list.Items))
+		return
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, vis *visibility, name string) {
+	var app marketplacev1alpha3.Application
+	if err := s.Client.Get(r.Context(), client.ObjectKey{Name: name}, &app); err != nil {
+		if apierrors.IsNotFound(err) {
+			writeStatus(w, apierrors.NewNotFound(groupResource, name))
+			return
+		}
+		writeStatus(w, apierrors.NewInternalError(err))
+		return
+	}
+	if !vis.rules.Visible(&app, vis.viewer) {
+		writeStatus(w, apierrors.NewNotFound(groupResource, name))
+		return
+	}
+	item := newAppSearch(&app, 0)
+	if wantsTable(r) {
+		writeJSON(w, table([]AppSearch{item}))
+		return
+	}
+	writeJSON(w, &item)
+}
+
+func newAppSearch(app *marketplacev1alpha3.Application, score float64) AppSearch {
+	return AppSearch{
+		TypeMeta: metav1.TypeMeta{Kind: kindName, APIVersion: GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              app.Name,
+			Labels:            app.Labels,
+			CreationTimestamp: app.CreationTimestamp,
+		},
+		Score:   score,
+		Summary: catalog.Summarize(app),
+	}
+}
+
+// wantsTable reports whether the client (e.g. kubectl get) asked for server-side printing.
+func wantsTable(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := make(map[string]string)
+		for _, p := range strings.Split(accept, ";")[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 {
+				params[kv[0]] = kv[1]
+			}
+		}
+		if params["as"] == "Table" && params["g"] == "meta.k8s.io" && params["v"] == "v1" {
+			return true
+		}
+	}
+	return false
+}
+
+func table(items []AppSearch) *metav1.Table {
+	t := &metav1.Table{
+		TypeMeta: metav1.TypeMeta{Kind: "Table", APIVersion: "meta.k8s.io/v1"},
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name"},
+			{Name: "Source", Type: "string"},
+			{Name: "Version", Type: "string"},
+			{Name: "App Version", Type: "string"},
+			{Name: "Score", Type: "number"},
+			{Name: "Description", Type: "string", Priority: 1},
+		},
+		Rows: make([]metav1.TableRow, 0, len(items)),
+	}
+	for _, item := range items {
+		meta, _ := json.Marshal(&metav1.PartialObjectMetadata{
+			TypeMeta:   metav1.TypeMeta{Kind: "PartialObjectMetadata", APIVersion: "meta.k8s.io/v1"},
+			ObjectMeta: item.ObjectMeta,
+		})
+		t.Rows = append(t.Rows, metav1.TableRow{
+			Cells: []interface{}{
+				item.Name,
+				item.Summary.Source,
+				item.Summary.Version,
+				item.Summary.AppVersion,
+				strconv.FormatFloat(item.Score, 'f', 2, 64),
+				item.Summary.Description,
+			},
+			Object: runtime.RawExtension{Raw: meta},
+		})
+	}
+	return t
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, err error) {
+	status := apierrors.NewInternalError(err).Status()
+	if s, ok := err.(apierrors.APIStatus); ok {
+		status = s.Status()
+	}
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	json.NewEncoder(w).Encode(&status)
+}
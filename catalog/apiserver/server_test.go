@@ -0,0 +1,255 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+type fakeAuthenticator struct{}
+
+func (fakeAuthenticator) authenticate(r *http.Request) (*user, error) {
+	return &user{Name: r.Header.Get("X-Remote-User"), Groups: r.Header["X-Remote-Group"]}, nil
+}
+
+// fakeAuthorizer allows the verbs listed for each user.
+type fakeAuthorizer map[string]sets.String
+
+func (a fakeAuthorizer) authorize(_ context.Context, u *user, verb, _ string) (bool, string, error) {
+	if a[u.Name].Has(verb) {
+		return true, "", nil
+	}
+	return false, "not allowed", nil
+}
+
+// canView lets users with the view-all verb browse the catalog from every namespace.
+func (a fakeAuthorizer) canView(_ context.Context, u *user, namespace string) (bool, error) {
+	return namespace == "" && a[u.Name].Has("view-all"), nil
+}
+
+func newApp(source, chart, category string, versions ...marketplacev1alpha3.ChartVersion) *marketplacev1alpha3.Application {
+	return &marketplacev1alpha3.Application{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: source + "." + chart,
+			Labels: map[string]string{
+				catalog.SourceLabel:                    source,
+				catalog.CategoryLabelPrefix + category: "",
+			},
+		},
+		AppName:  chart,
+		Versions: versions,
+	}
+}
+
+var _ = Describe("Server", func() {
+
+	var ts *httptest.Server
+
+	doAs := func(user string, groups []string, path, accept string, v interface{}) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("X-Remote-User", user)
+		for _, g := range groups {
+			req.Header.Add("X-Remote-Group", g)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		if v != nil {
+			Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		}
+		return resp.StatusCode
+	}
+	do := func(user, path, accept string, v interface{}) int {
+		return doAs(user, nil, path, accept, v)
+	}
+
+	BeforeEach(func() {
+		objs := []runtime.Object{
+			newApp("stable", "mysql", "database", marketplacev1alpha3.ChartVersion{
+				Version:     "1.10.0",
+				AppVersion:  "8.0",
+				Description: "Fast, reliable relational database",
+			}),
+			newApp("stable", "redis", "database", marketplacev1alpha3.ChartVersion{Version: "10.5.7", Description: "key-value store"}),
+			newApp("other", "nginx", "web", marketplacev1alpha3.ChartVersion{Version: "0.1.0", Description: "web server"}),
+			newApp("private", "vault", "security", marketplacev1alpha3.ChartVersion{Version: "0.9.0", Description: "secret store"}),
+		}
+		index := catalog.NewIndex()
+		for _, obj := range objs {
+			index.Upsert(obj.(*marketplacev1alpha3.Application))
+		}
+		objs = append(objs, &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "private"},
+			Spec:       marketplacev1alpha2.SourceSpec{Visibility: &marketplacev1alpha2.Visibility{Groups: []string{"security-team"}}},
+		})
+		s := &Server{
+			Client: fake.NewFakeClientWithScheme(scheme, objs...),
+			Log:    logf.Log,
+			Index:  index,
+		}
+		ts = httptest.NewServer(s.handler(fakeAuthenticator{}, fakeAuthorizer{
+			"alice": sets.NewString("get", "list", "watch"),
+			"bob":   sets.NewString("get"),
+			"carol": sets.NewString("get", "list", "view-all"),
+		}))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should serve discovery", func() {
+		var groups metav1.APIGroupList
+		Expect(do("", "/apis", "", &groups)).Should(Equal(http.StatusOK))
+		Expect(groups.Groups).Should(HaveLen(1))
+		Expect(groups.Groups[0].PreferredVersion.GroupVersion).Should(Equal("search.marketplace.criticalstack.com/v1alpha1"))
+
+		var resources metav1.APIResourceList
+		Expect(do("", "/apis/search.marketplace.criticalstack.com/v1alpha1", "", &resources)).Should(Equal(http.StatusOK))
+		Expect(resources.APIResources).Should(HaveLen(1))
+		Expect(resources.APIResources[0].Name).Should(Equal("appsearches"))
+		Expect(resources.APIResources[0].Namespaced).Should(BeFalse())
+	})
+
+	It("Should search with field selectors", func() {
+		var list AppSearchList
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=category%3Ddatabase", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Kind).Should(Equal("AppSearchList"))
+		Expect(list.Items).Should(HaveLen(2))
+
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=q%3Drelational,source%3Dstable", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(1))
+		Expect(list.Items[0].Name).Should(Equal("stable.mysql"))
+		Expect(list.Items[0].Score).Should(BeNumerically(">", 0))
+		Expect(list.Items[0].Summary.Version).Should(Equal("1.10.0"))
+
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=metadata.name%3Dstable.redis&limit=1", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(1))
+		Expect(list.Items[0].Name).Should(Equal("stable.redis"))
+
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?limit=2", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(2))
+
+		var status metav1.Status
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=q!%3Dmysql", "", &status)).Should(Equal(http.StatusBadRequest))
+		Expect(status.Reason).Should(Equal(metav1.StatusReasonBadRequest))
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=spec.foo%3Dbar", "", nil)).Should(Equal(http.StatusBadRequest))
+	})
+
+	It("Should get a single app", func() {
+		var item AppSearch
+		Expect(do("bob", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches/other.nginx", "", &item)).Should(Equal(http.StatusOK))
+		Expect(item.Summary.Name).Should(Equal("other.nginx"))
+		Expect(do("bob", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches/missing", "", nil)).Should(Equal(http.StatusNotFound))
+	})
+
+	It("Should only show Applications visible to the user", func() {
+		const appsearches = "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches"
+		var list AppSearchList
+		Expect(do("alice", appsearches+"?fieldSelector=q%3Dvault", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(BeEmpty())
+		Expect(do("bob", appsearches+"/private.vault", "", nil)).Should(Equal(http.StatusNotFound))
+
+		Expect(doAs("alice", []string{"security-team"}, appsearches+"?fieldSelector=q%3Dvault", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(1))
+		Expect(doAs("bob", []string{"security-team"}, appsearches+"/private.vault", "", nil)).Should(Equal(http.StatusOK))
+
+		Expect(do("carol", appsearches+"?fieldSelector=q%3Dvault", "", &list)).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(1))
+	})
+
+	It("Should print tables for kubectl", func() {
+		var table metav1.Table
+		accept := "application/json;as=Table;v=v1;g=meta.k8s.io,application/json"
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?fieldSelector=q%3Dmysql", accept, &table)).Should(Equal(http.StatusOK))
+		Expect(table.Kind).Should(Equal("Table"))
+		Expect(table.ColumnDefinitions).Should(HaveLen(6))
+		Expect(table.Rows).Should(HaveLen(1))
+		Expect(table.Rows[0].Cells[0]).Should(Equal("stable.mysql"))
+		Expect(table.Rows[0].Cells[3]).Should(Equal("8.0"))
+	})
+
+	It("Should enforce authorization", func() {
+		var status metav1.Status
+		Expect(do("bob", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches", "", &status)).Should(Equal(http.StatusForbidden))
+		Expect(status.Reason).Should(Equal(metav1.StatusReasonForbidden))
+		Expect(do("mallory", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches/stable.mysql", "", nil)).Should(Equal(http.StatusForbidden))
+		Expect(do("alice", "/apis/search.marketplace.criticalstack.com/v1alpha1/appsearches?watch=true", "", nil)).Should(Equal(http.StatusMethodNotAllowed))
+	})
+})
+
+var _ = Describe("requestHeaderAuthenticator", func() {
+
+	a := &requestHeaderAuthenticator{
+		allowedNames:    []string{"front-proxy-client"},
+		usernameHeaders: []string{"X-Remote-User"},
+		groupHeaders:    []string{"X-Remote-Group"},
+		extraPrefixes:   []string{"X-Remote-Extra-"},
+	}
+
+	request := func(cn string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Remote-User", "alice")
+		r.Header.Add("X-Remote-Group", "dev")
+		r.Header.Add("X-Remote-Group", "system:authenticated")
+		r.Header.Set("X-Remote-Extra-Scopes", "view")
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}},
+		}
+		return r
+	}
+
+	It("Should read the forwarded identity", func() {
+		u, err := a.authenticate(request("front-proxy-client"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Name).Should(Equal("alice"))
+		Expect(u.Groups).Should(Equal([]string{"dev", "system:authenticated"}))
+		Expect(u.Extra).Should(HaveKeyWithValue("scopes", []string{"view"}))
+	})
+
+	It("Should reject untrusted proxies", func() {
+		_, err := a.authenticate(request("someone-else"))
+		Expect(err).To(HaveOccurred())
+
+		r := request("front-proxy-client")
+		r.TLS = nil
+		_, err = a.authenticate(r)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,55 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// AppSearches are served by this package, not stored as a CRD.
+// +kubebuilder:skip
+
+package apiserver
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// GroupVersion is the group version served by the search API.
+var GroupVersion = schema.GroupVersion{Group: "search.marketplace.criticalstack.com", Version: "v1alpha1"}
+
+const (
+	resourceName = "appsearches"
+	kindName     = "AppSearch"
+)
+
+var groupResource = GroupVersion.WithResource(resourceName).GroupResource()
+
+// AppSearch is a search hit: a lightweight summary of an Application and its score. AppSearches are read-only and
+// named after the Application they summarize.
+type AppSearch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Score   float64            `json:"score"`
+	Summary catalog.AppSummary `json:"summary"`
+}
+
+// AppSearchList is the result of a search, ordered by score.
+type AppSearchList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []AppSearch `json:"items"`
+}
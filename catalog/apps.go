@@ -0,0 +1,90 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// Labels set on Applications by the Source controller. Releases installed from an Application carry its source and
+// application name labels too.
+const (
+	SourceLabel         = "marketplace.criticalstack.com/source.name"
+	AppNameLabel        = "marketplace.criticalstack.com/application.name"
+	CategoryLabelPrefix = "marketplace.criticalstack.com/application.category."
+	DeprecatedLabel     = "marketplace.criticalstack.com/app.deprecated"
+)
+
+// LatestVersion returns the highest semver version of app, or nil if it has no versions. Versions that aren't valid
+// semver sort before those that are.
+func LatestVersion(app *marketplacev1alpha3.Application) *marketplacev1alpha3.ChartVersion {
+	var latest *marketplacev1alpha3.ChartVersion
+	var latestV *semver.Version
+	for i := range app.Versions {
+		v, err := semver.NewVersion(app.Versions[i].Version)
+		if err != nil {
+			if latest == nil {
+				latest = &app.Versions[i]
+			}
+			continue
+		}
+		if latestV == nil || v.GreaterThan(latestV) {
+			latest, latestV = &app.Versions[i], v
+		}
+	}
+	return latest
+}
+
+// Categories returns the sorted categories of app, taken from its category labels.
+func Categories(app *marketplacev1alpha3.Application) []string {
+	var cats []string
+	for k := range app.Labels {
+		if strings.HasPrefix(k, CategoryLabelPrefix) {
+			cats = append(cats, strings.TrimPrefix(k, CategoryLabelPrefix))
+		}
+	}
+	sort.Strings(cats)
+	return cats
+}
+
+// Summarize returns the listing view of app.
+func Summarize(app *marketplacev1alpha3.Application) AppSummary {
+	s := AppSummary{
+		Name:       app.Name,
+		AppName:    app.AppName,
+		Source:     app.Labels[SourceLabel],
+		Categories: Categories(app),
+		Deprecated: app.Labels[DeprecatedLabel] == "true",
+		Versions:   make([]string, 0, len(app.Versions)),
+	}
+	for _, v := range app.Versions {
+		s.Versions = append(s.Versions, v.Version)
+	}
+	if v := LatestVersion(app); v != nil {
+		s.Description = v.Description
+		s.Icon = v.Icon
+		s.Keywords = v.Keywords
+		s.Version = v.Version
+		s.AppVersion = v.AppVersion
+	}
+	return s
+}
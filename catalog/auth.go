@@ -0,0 +1,133 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+// Authenticator identifies the user making a catalog request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*authenticationv1.UserInfo, error)
+}
+
+// Authorizer decides which namespaces a user browses the catalog from, which charts they may download, and which
+// release manifests they may read.
+type Authorizer interface {
+	// CanView reports whether u may browse the catalog from namespace, or from every namespace when it is empty.
+	CanView(ctx context.Context, u *authenticationv1.UserInfo, namespace string) (bool, error)
+	// CanDownload reports whether u may download the charts of the Application app.
+	CanDownload(ctx context.Context, u *authenticationv1.UserInfo, app string) (bool, error)
+	// CanReadManifest reports whether u may read the manifest of the Release name in namespace.
+	CanReadManifest(ctx context.Context, u *authenticationv1.UserInfo, namespace, name string) (bool, error)
+}
+
+// TokenReviewAuthenticator authenticates the bearer token of a request with a TokenReview, so that clients use
+// their regular Kubernetes credentials.
+type TokenReviewAuthenticator struct {
+	Client client.Client
+	// Audiences the token must be issued for. The apiserver's audiences are used when empty.
+	Audiences []string
+}
+
+func (a *TokenReviewAuthenticator) Authenticate(r *http.Request) (*authenticationv1.UserInfo, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return nil, errors.New("no bearer token")
+	}
+	tr := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     strings.TrimSpace(h[7:]),
+			Audiences: a.Audiences,
+		},
+	}
+	if err := a.Client.Create(r.Context(), tr); err != nil {
+		return nil, err
+	}
+	if !tr.Status.Authenticated {
+		if tr.Status.Error != "" {
+			return nil, errors.New(tr.Status.Error)
+		}
+		return nil, errors.New("invalid token")
+	}
+	return &tr.Status.User, nil
+}
+
+// SubjectAccessReviewAuthorizer lets users browse the catalog from the namespaces they may get CatalogViews in,
+// download the charts of Applications they may get the download subresource of, and read the manifests of Releases
+// they may get the manifest subresource of, so that catalog access follows regular RBAC.
+type SubjectAccessReviewAuthorizer struct {
+	Client client.Client
+}
+
+func (a *SubjectAccessReviewAuthorizer) CanView(ctx context.Context, u *authenticationv1.UserInfo, namespace string) (bool, error) {
+	return a.review(ctx, u, &authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Group:     marketplacev1alpha2.GroupVersion.Group,
+		Resource:  "catalogviews",
+		Verb:      "get",
+	})
+}
+
+func (a *SubjectAccessReviewAuthorizer) CanDownload(ctx context.Context, u *authenticationv1.UserInfo, app string) (bool, error) {
+	return a.review(ctx, u, &authorizationv1.ResourceAttributes{
+		Group:       marketplacev1alpha2.GroupVersion.Group,
+		Resource:    "applications",
+		Subresource: "download",
+		Verb:        "get",
+		Name:        app,
+	})
+}
+
+func (a *SubjectAccessReviewAuthorizer) CanReadManifest(ctx context.Context, u *authenticationv1.UserInfo, namespace, name string) (bool, error) {
+	return a.review(ctx, u, &authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Group:       marketplacev1alpha2.GroupVersion.Group,
+		Resource:    "releases",
+		Subresource: "manifest",
+		Verb:        "get",
+		Name:        name,
+	})
+}
+
+func (a *SubjectAccessReviewAuthorizer) review(ctx context.Context, u *authenticationv1.UserInfo, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               u.Username,
+			UID:                u.UID,
+			Groups:             u.Groups,
+			Extra:              make(map[string]authorizationv1.ExtraValue),
+			ResourceAttributes: attrs,
+		},
+	}
+	for k, v := range u.Extra {
+		sar.Spec.Extra[k] = authorizationv1.ExtraValue(v)
+	}
+	if err := a.Client.Create(ctx, sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
@@ -0,0 +1,370 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// Chart repository index routes. The merged index contains every Source, so charts are keyed by Application name
+// (e.g. stable.mysql) to keep charts of the same name from different Sources apart. A Source's index is keyed by
+// chart name, like the upstream repository.
+const (
+	chartsPrefix        = "/charts/"
+	indexFile           = "index.yaml"
+	sourceIndexPrefix   = chartsPrefix + "sources/"
+	categoryIndexPrefix = chartsPrefix + "categories/"
+	chartFilesPrefix    = chartsPrefix + "files/"
+)
+
+// serveIndex serves a Helm repository index.yaml of the catalog, so it can be added with helm repo add:
+//
+//   GET /charts/index.yaml
+//   GET /charts/sources/{source}/index.yaml
+//   GET /charts/categories/{category}/index.yaml
+//
+// Removed versions are left out. Deprecated charts are included and marked deprecated, as in upstream indexes, unless
+// ?deprecated=false is given. Charts hidden by the visibility rules are only included for users authenticated with a
+// bearer token who may see them.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	q := url.Values{}
+	if d := r.URL.Query().Get("deprecated"); d != "" {
+		q.Set("deprecated", d)
+	}
+	source := ""
+	byChartName := false
+	switch p := r.URL.Path; {
+	case p == chartsPrefix+indexFile:
+	case strings.HasPrefix(p, sourceIndexPrefix) && strings.HasSuffix(p, "/"+indexFile):
+		source = strings.TrimSuffix(strings.TrimPrefix(p, sourceIndexPrefix), "/"+indexFile)
+		byChartName = true
+	case strings.HasPrefix(p, categoryIndexPrefix) && strings.HasSuffix(p, "/"+indexFile):
+		q.Set("category", strings.TrimSuffix(strings.TrimPrefix(p, categoryIndexPrefix), "/"+indexFile))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if strings.Contains(source, "/") || strings.Contains(q.Get("category"), "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	apps, err := s.applications(r.Context(), source)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	match := appMatcher(q)
+	index := repo.NewIndexFile()
+	for i := range apps {
+		if !match(&apps[i]) || !rules.Visible(&apps[i], v) {
+			continue
+		}
+		key := apps[i].Name
+		if byChartName {
+			key = apps[i].AppName
+		}
+		for _, cv := range indexVersions(&apps[i], q.Get("deprecated") == "false") {
+			index.Entries[key] = append(index.Entries[key], cv)
+		}
+	}
+	index.SortEntries()
+	writeIndex(w, r, index)
+}
+
+// indexVersions returns the repository index entries of app's versions, skipping removed versions and, when
+// excludeDeprecated is set, deprecated ones.
+func indexVersions(app *marketplacev1alpha3.Application, excludeDeprecated bool) []*repo.ChartVersion {
+	var out []*repo.ChartVersion
+	for _, v := range app.Versions {
+		if v.Removed != nil && *v.Removed {
+			continue
+		}
+		if excludeDeprecated && v.Deprecated {
+			continue
+		}
+		md := &chart.Metadata{
+			Name:        app.AppName,
+			Home:        v.Home,
+			Sources:     v.Sources,
+			Version:     v.Version,
+			Description: v.Description,
+			Keywords:    v.Keywords,
+			Icon:        v.Icon,
+			APIVersion:  v.APIVersion,
+			AppVersion:  v.AppVersion,
+			Deprecated:  v.Deprecated,
+			Annotations: v.Annotations,
+			KubeVersion: v.KubeVersion,
+			Type:        v.Type,
+		}
+		for _, m := range v.Maintainers {
+			if m != nil {
+				md.Maintainers = append(md.Maintainers, &chart.Maintainer{Name: m.Name, Email: m.Email, URL: m.URL})
+			}
+		}
+		for _, d := range v.Dependencies {
+			if d == nil {
+				continue
+			}
+			md.Dependencies = append(md.Dependencies, &chart.Dependency{
+				Name:         d.Name,
+				Version:      d.Version,
+				Repository:   d.Repository,
+				Condition:    d.Condition,
+				Tags:         d.Tags,
+				Enabled:      d.Enabled,
+				ImportValues: importValues(d.ImportValues),
+				Alias:        d.Alias,
+			})
+		}
+		out = append(out, &repo.ChartVersion{
+			Metadata: md,
+			URLs:     v.URLs,
+			Created:  v.Created.Time.UTC(),
+			Digest:   v.Digest,
+		})
+	}
+	return out
+}
+
+// importValues converts import-values back to the form found in Chart.yaml, either an export name or a child/parent
+// map.
+func importValues(ivs []marketplacev1alpha3.ImportValue) []interface{} {
+	var out []interface{}
+	for _, iv := range ivs {
+		if iv.Export != "" {
+			out = append(out, iv.Export)
+			continue
+		}
+		out = append(out, map[string]interface{}{"child": iv.Child, "parent": iv.Parent})
+	}
+	return out
+}
+
+// writeIndex writes index as YAML. The ETag covers the entries only, since the generated timestamp changes on every
+// request.
+func writeIndex(w http.ResponseWriter, r *http.Request, index *repo.IndexFile) {
+	entries, err := yaml.Marshal(index.Entries)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(entries)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/x-yaml")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write(b)
+}
+
+// serveChartFile serves chart archives and provenance files cached by Sources with spec.cacheCharts:
+//
+//   GET /charts/files/{source}/{chart}-{version}.tgz[.prov]
+//
+// Files of Applications hidden by the visibility rules are only served to users who may see them, and files of Sources
+// with credentials only to authenticated users that may download the Application's charts, as for downloadChart. Files
+// are only served for chart versions of an Application of the Source, and never for NamespaceSources, whose archives
+// are kept under namespaces/.
+func (s *Server) serveChartFile(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	if s.Store == nil {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, chartFilesPrefix)
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	var src marketplacev1alpha2.Source
+	if err := s.Client.Get(r.Context(), client.ObjectKey{Name: parts[0]}, &src); err != nil {
+		if apierrors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+	app, err := s.chartFileApplication(r.Context(), src.Name, strings.TrimSuffix(key, ".prov"))
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if app == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	if !rules.Visible(app, v) {
+		http.NotFound(w, r)
+		return
+	}
+	if hasCredentials(&src) && !s.authorizeDownload(w, r, app) {
+		return
+	}
+	rc, err := s.Store.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, chartstore.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+	defer rc.Close()
+	switch {
+	case strings.HasSuffix(key, ".prov"):
+		w.Header().Set("Content-Type", "application/pgp-signature")
+	default:
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		s.Log.Error(err, "failed to serve chart file", "key", key)
+	}
+}
+
+// chartFileApplication returns the Application of source with a chart version stored at key, or nil if there is
+// none.
+func (s *Server) chartFileApplication(ctx context.Context, source, key string) (*marketplacev1alpha3.Application, error) {
+	apps, err := s.applications(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	for i := range apps {
+		for _, v := range apps[i].Versions {
+			if chartstore.ChartKey(source, apps[i].AppName, v.Version) == key {
+				return &apps[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// hasCredentials reports whether src reads its repository with credentials, so that its charts aren't meant to be
+// public.
+func hasCredentials(src *marketplacev1alpha2.Source) bool {
+	spec := &src.Spec
+	return spec.Username != "" || spec.Password != "" || spec.CertFile != "" || spec.KeyFile != "" ||
+		(spec.IndexFrom != nil && spec.IndexFrom.Kind == "Secret")
+}
+
+// ChartDownloader opens the archive of a chart version from the repository of its Source, with the Source's
+// credentials.
+type ChartDownloader interface {
+	Download(ctx context.Context, app *marketplacev1alpha3.Application, cv *marketplacev1alpha3.ChartVersion) (io.ReadCloser, error)
+}
+
+// downloadChart serves the archive of cv to authenticated users that may download app's charts, so that clients can
+// install from Sources whose credentials they don't have:
+//
+//   GET /api/v1/apps/{name}/versions/{version}/chart
+//
+// Archives are streamed to the client and checked against the version's digest when it has one. Since the digest is
+// only known once the whole archive has been sent, the connection is aborted on a mismatch, so that the client fails
+// with an incomplete response instead of installing the archive.
+func (s *Server) downloadChart(w http.ResponseWriter, r *http.Request, app *marketplacev1alpha3.Application, cv *marketplacev1alpha3.ChartVersion) {
+	if s.Downloader == nil {
+		httpError(w, http.StatusServiceUnavailable, "chart downloads are not enabled")
+		return
+	}
+	if !s.authorizeDownload(w, r, app) {
+		return
+	}
+	rc, err := s.Downloader.Download(r.Context(), app, cv)
+	if err != nil {
+		s.Log.Error(err, "failed to download chart", "app", app.Name, "version", cv.Version)
+		httpError(w, http.StatusBadGateway, "cannot download chart")
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.tgz", app.AppName, cv.Version)))
+	h := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(rc, h)); err != nil {
+		s.Log.Error(err, "failed to serve chart", "app", app.Name, "version", cv.Version)
+		panic(http.ErrAbortHandler)
+	}
+	if cv.Digest != "" && hex.EncodeToString(h.Sum(nil)) != cv.Digest {
+		s.Log.Error(errors.New("digest mismatch"), "failed to serve chart", "app", app.Name, "version", cv.Version)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// authorizeDownload reports whether the user making r may download app's charts, replying with an error when they may
+// not.
+func (s *Server) authorizeDownload(w http.ResponseWriter, r *http.Request, app *marketplacev1alpha3.Application) bool {
+	if s.Authenticator == nil || s.Authorizer == nil {
+		httpError(w, http.StatusServiceUnavailable, "chart downloads are not enabled")
+		return false
+	}
+	u, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	allowed, err := s.Authorizer.CanDownload(r.Context(), u, app.Name)
+	if err != nil {
+		s.serverError(w, err)
+		return false
+	}
+	if !allowed {
+		httpError(w, http.StatusForbidden, "forbidden")
+		return false
+	}
+	return true
+}
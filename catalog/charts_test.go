@@ -0,0 +1,289 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/repo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+var _ = Describe("Chart repository index", func() {
+
+	var ts *httptest.Server
+	var dir string
+
+	index := func(path string) *repo.IndexFile {
+		resp, err := http.Get(ts.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("application/x-yaml"))
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		var i repo.IndexFile
+		Expect(yaml.Unmarshal(b, &i)).To(Succeed())
+		return &i
+	}
+
+	BeforeEach(func() {
+		removed := true
+		objs := []runtime.Object{
+			newApp("stable", "mysql", map[string]string{CategoryLabelPrefix + "database": ""},
+				marketplacev1alpha3.ChartVersion{Version: "1.2.0", URLs: []string{"https://charts.example.com/mysql-1.2.0.tgz"}},
+				marketplacev1alpha3.ChartVersion{
+					Version: "1.10.0",
+					URLs:    []string{"https://charts.example.com/mysql-1.10.0.tgz"},
+					Digest:  "abc123",
+					Dependencies: []*marketplacev1alpha3.Dependency{{
+						Name:         "common",
+						ImportValues: []marketplacev1alpha3.ImportValue{{Export: "data"}, {Child: "a", Parent: "b"}},
+					}},
+				},
+				marketplacev1alpha3.ChartVersion{Version: "0.1.0", Removed: &removed, URLs: []string{"https://charts.example.com/mysql-0.1.0.tgz"}},
+			),
+			newApp("stable", "redis", map[string]string{CategoryLabelPrefix + "database": "", DeprecatedLabel: "true"},
+				marketplacev1alpha3.ChartVersion{Version: "10.5.7", Deprecated: true, URLs: []string{"https://charts.example.com/redis-10.5.7.tgz"}},
+			),
+			newApp("other", "mysql", nil,
+				marketplacev1alpha3.ChartVersion{Version: "2.0.0", URLs: []string{"https://other.example.com/mysql-2.0.0.tgz"}},
+			),
+			&marketplacev1alpha2.Source{ObjectMeta: metav1.ObjectMeta{Name: "stable"}},
+			&marketplacev1alpha2.Source{
+				ObjectMeta: metav1.ObjectMeta{Name: "private"},
+				Spec:       marketplacev1alpha2.SourceSpec{Username: "user", Password: "secret"},
+			},
+			newApp("private", "app", nil, marketplacev1alpha3.ChartVersion{Version: "1.0.0"}),
+		}
+		var err error
+		dir, err = ioutil.TempDir("", "chartstore")
+		Expect(err).ToNot(HaveOccurred())
+		store, err := chartstore.NewDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		for _, key := range []string{"stable/mysql-1.10.0.tgz", "stable/mysql-9.9.9.tgz", "private/app-1.0.0.tgz", "namespaces/team-a/stable/mysql-1.10.0.tgz"} {
+			Expect(store.Put(context.Background(), key, strings.NewReader("archive"))).To(Succeed())
+		}
+
+		auth := &fakeAuth{downloads: map[string][]string{"alice": {"private.app"}}}
+		s := &Server{
+			Client:        fake.NewFakeClientWithScheme(scheme, objs...),
+			Log:           logf.Log,
+			Store:         store,
+			Authenticator: auth,
+			Authorizer:    auth,
+		}
+		ts = httptest.NewServer(s.Handler())
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("Should merge every source keyed by application name", func() {
+		i := index("/charts/index.yaml")
+		Expect(i.APIVersion).Should(Equal(repo.APIVersionV1))
+		Expect(i.Entries).Should(HaveLen(4))
+		Expect(i.Entries).Should(HaveKey("stable.mysql"))
+		Expect(i.Entries).Should(HaveKey("other.mysql"))
+		Expect(i.Entries).Should(HaveKey("private.app"))
+
+		mysql := i.Entries["stable.mysql"]
+		Expect(mysql).Should(HaveLen(2), "removed versions are left out")
+		Expect(mysql[0].Version).Should(Equal("1.10.0"))
+		Expect(mysql[0].Name).Should(Equal("mysql"))
+		Expect(mysql[0].Digest).Should(Equal("abc123"))
+		Expect(mysql[0].URLs).Should(Equal([]string{"https://charts.example.com/mysql-1.10.0.tgz"}))
+		Expect(mysql[0].Dependencies[0].ImportValues).Should(Equal([]interface{}{
+			"data",
+			map[string]interface{}{"child": "a", "parent": "b"},
+		}))
+		Expect(i.Entries["stable.redis"][0].Deprecated).Should(BeTrue())
+	})
+
+	It("Should serve per-source and per-category indexes", func() {
+		i := index("/charts/sources/stable/index.yaml")
+		Expect(i.Entries).Should(HaveLen(2))
+		Expect(i.Entries).Should(HaveKey("mysql"))
+		Expect(i.Entries).Should(HaveKey("redis"))
+
+		i = index("/charts/categories/database/index.yaml?deprecated=false")
+		Expect(i.Entries).Should(HaveLen(1))
+		Expect(i.Entries).Should(HaveKey("stable.mysql"))
+	})
+
+	It("Should support conditional requests", func() {
+		resp, err := http.Get(ts.URL + "/charts/index.yaml")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/charts/index.yaml", nil)
+		req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotModified))
+
+		resp, err = http.Get(ts.URL + "/charts/sources/stable/mysql/index.yaml")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+
+	It("Should serve cached chart archives", func() {
+		resp, err := http.Get(ts.URL + "/charts/files/stable/mysql-1.10.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("application/gzip"))
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(b)).Should(Equal("archive"))
+
+		resp, err = http.Get(ts.URL + "/charts/files/stable/mysql-1.10.0.tgz.prov")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+
+	It("Should only serve files of chart versions of a Source", func() {
+		for _, path := range []string{"/charts/files/stable/mysql-9.9.9.tgz", "/charts/files/namespaces/team-a/stable/mysql-1.10.0.tgz"} {
+			resp, err := http.Get(ts.URL + path)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusNotFound), path)
+		}
+	})
+
+	It("Should only serve files of Sources with credentials to authorized users", func() {
+		get := func(user string) int {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/charts/files/private/app-1.0.0.tgz", nil)
+			Expect(err).ToNot(HaveOccurred())
+			if user != "" {
+				req.Header.Set("Authorization", "Bearer "+user)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		Expect(get("")).Should(Equal(http.StatusUnauthorized))
+		Expect(get("bob")).Should(Equal(http.StatusForbidden))
+		Expect(get("alice")).Should(Equal(http.StatusOK))
+	})
+})
+
+type fakeDownloader map[string]string
+
+func (d fakeDownloader) Download(ctx context.Context, app *marketplacev1alpha3.Application, cv *marketplacev1alpha3.ChartVersion) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(d[app.Name+"-"+cv.Version])), nil
+}
+
+var _ = Describe("Chart downloads", func() {
+
+	var (
+		ts *httptest.Server
+		s  *Server
+	)
+
+	download := func(user, path string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, string(b)
+	}
+
+	BeforeEach(func() {
+		sum := sha256.Sum256([]byte("archive"))
+		auth := &fakeAuth{downloads: map[string][]string{"alice": {"private.app"}}}
+		s = &Server{
+			Client: fake.NewFakeClientWithScheme(scheme,
+				newApp("private", "app", nil,
+					marketplacev1alpha3.ChartVersion{Version: "1.0.0", Digest: hex.EncodeToString(sum[:])},
+					marketplacev1alpha3.ChartVersion{Version: "2.0.0", Digest: hex.EncodeToString(sum[:])},
+				),
+			),
+			Log:           logf.Log,
+			Authenticator: auth,
+			Authorizer:    auth,
+			Downloader:    fakeDownloader{"private.app-1.0.0": "archive", "private.app-2.0.0": "tampered"},
+		}
+		ts = httptest.NewServer(s.Handler())
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should serve archives to authorized users", func() {
+		resp, body := download("alice", "/api/v1/apps/private.app/versions/1.0.0/chart")
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("application/gzip"))
+		Expect(resp.Header.Get("Content-Disposition")).Should(Equal(`attachment; filename="app-1.0.0.tgz"`))
+		Expect(body).Should(Equal("archive"))
+	})
+
+	It("Should reject unauthenticated and unauthorized users", func() {
+		resp, _ := download("", "/api/v1/apps/private.app/versions/1.0.0/chart")
+		Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+		resp, _ = download("bob", "/api/v1/apps/private.app/versions/1.0.0/chart")
+		Expect(resp.StatusCode).Should(Equal(http.StatusForbidden))
+	})
+
+	It("Should abort downloads that don't match their digest", func() {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/apps/private.app/versions/2.0.0/chart", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			_, err = ioutil.ReadAll(resp.Body)
+		}
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should be unavailable without a downloader", func() {
+		s.Downloader = nil
+		resp, _ := download("alice", "/api/v1/apps/private.app/versions/1.0.0/chart")
+		Expect(resp.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -0,0 +1,371 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// Field weights used when scoring a match.
+const (
+	nameWeight        = 5
+	keywordWeight     = 3
+	categoryWeight    = 2
+	descriptionWeight = 1
+	maintainerWeight  = 1
+	annotationWeight  = 0.5
+)
+
+// Match quality multipliers for fuzzy term matching.
+const (
+	exactMatch  = 1.0
+	prefixMatch = 0.7
+	fuzzyMatch  = 0.5
+)
+
+// Index is an in-memory inverted index over Applications. It is kept up to date from Application informer events,
+// see SetupWithManager.
+type Index struct {
+	mu sync.RWMutex
+	// documents keyed by Application name
+	docs map[string]*document
+	// term -> Application name -> weight
+	postings map[string]map[string]float64
+}
+
+type document struct {
+	name       string
+	source     string
+	categories []string
+	deprecated bool
+	terms      map[string]float64
+}
+
+// NewIndex returns an empty Index.
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[string]*document),
+		postings: make(map[string]map[string]float64),
+	}
+}
+
+// SetupWithManager registers the index with the manager's Application informer.
+func (i *Index) SetupWithManager(mgr ctrl.Manager) error {
+	inf, err := mgr.GetCache().GetInformer(context.Background(), &marketplacev1alpha3.Application{})
+	if err != nil {
+		return err
+	}
+	inf.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if app, ok := obj.(*marketplacev1alpha3.Application); ok {
+				i.Upsert(app)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if app, ok := obj.(*marketplacev1alpha3.Application); ok {
+				i.Upsert(app)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if d, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			if app, ok := obj.(*marketplacev1alpha3.Application); ok {
+				i.Delete(app.Name)
+			}
+		},
+	})
+	return nil
+}
+
+// Upsert indexes app, replacing any previous entry with the same name.
+func (i *Index) Upsert(app *marketplacev1alpha3.Application) {
+	doc := &document{
+		name:       app.Name,
+		source:     app.Labels[SourceLabel],
+		categories: Categories(app),
+		deprecated: app.Labels[DeprecatedLabel] == "true",
+		terms:      make(map[string]float64),
+	}
+	add := func(s string, w float64) {
+		for _, t := range tokenize(s) {
+			if doc.terms[t] < w {
+				doc.terms[t] = w
+			}
+		}
+	}
+	add(app.Name, nameWeight)
+	add(app.AppName, nameWeight)
+	for _, c := range doc.categories {
+		add(c, categoryWeight)
+	}
+	if v := LatestVersion(app); v != nil {
+		add(v.Description, descriptionWeight)
+		for _, k := range v.Keywords {
+			add(k, keywordWeight)
+		}
+		for _, m := range v.Maintainers {
+			add(m.Name, maintainerWeight)
+		}
+		for k, val := range v.Annotations {
+			add(k, annotationWeight)
+			add(val, annotationWeight)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(app.Name)
+	i.docs[app.Name] = doc
+	for t, w := range doc.terms {
+		p, ok := i.postings[t]
+		if !ok {
+			p = make(map[string]float64)
+			i.postings[t] = p
+		}
+		p[app.Name] = w
+	}
+}
+
+// Delete removes the named Application from the index.
+func (i *Index) Delete(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(name)
+}
+
+func (i *Index) remove(name string) {
+	doc, ok := i.docs[name]
+	if !ok {
+		return
+	}
+	for t := range doc.terms {
+		delete(i.postings[t], name)
+		if len(i.postings[t]) == 0 {
+			delete(i.postings, t)
+		}
+	}
+	delete(i.docs, name)
+}
+
+// Query is a search over the index. Every term in Text must match an indexed term exactly, as a prefix, or within a
+// small edit distance. An empty Text matches every Application.
+type Query struct {
+	Text       string
+	Category   string
+	Source     string
+	Deprecated *bool
+	Limit      int
+	// Visible restricts the search to the Applications of the Sources and categories it allows, when it is set.
+	Visible func(source string, categories []string) bool
+}
+
+// Hit is a matching Application and its score.
+type Hit struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// Facets count the matching Applications by category, source and deprecation.
+type Facets struct {
+	Categories map[string]int `json:"categories"`
+	Sources    map[string]int `json:"sources"`
+	Deprecated map[string]int `json:"deprecated"`
+}
+
+// Result is the ranked, limited result of a Query. Total and Facets cover every match, not just the returned hits.
+type Result struct {
+	Total  int    `json:"total"`
+	Hits   []Hit  `json:"hits"`
+	Facets Facets `json:"facets"`
+}
+
+// Search runs q against the index.
+func (i *Index) Search(q Query) Result {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var scores map[string]float64
+	if terms := tokenize(q.Text); len(terms) > 0 {
+		for n, t := range terms {
+			matched := i.match(t)
+			if n == 0 {
+				scores = matched
+				continue
+			}
+			for name, s := range scores {
+				if m, ok := matched[name]; ok {
+					scores[name] = s + m
+				} else {
+					delete(scores, name)
+				}
+			}
+		}
+	} else {
+		scores = make(map[string]float64, len(i.docs))
+		for name := range i.docs {
+			scores[name] = 0
+		}
+	}
+
+	res := Result{
+		Hits: make([]Hit, 0),
+		Facets: Facets{
+			Categories: make(map[string]int),
+			Sources:    make(map[string]int),
+			Deprecated: make(map[string]int),
+		},
+	}
+	for name, score := range scores {
+		doc := i.docs[name]
+		if q.Source != "" && doc.source != q.Source {
+			continue
+		}
+		if q.Deprecated != nil && doc.deprecated != *q.Deprecated {
+			continue
+		}
+		if q.Category != "" && !contains(doc.categories, q.Category) {
+			continue
+		}
+		if q.Visible != nil && !q.Visible(doc.source, doc.categories) {
+			continue
+		}
+		res.Hits = append(res.Hits, Hit{Name: name, Score: score})
+		for _, c := range doc.categories {
+			res.Facets.Categories[c]++
+		}
+		res.Facets.Sources[doc.source]++
+		if doc.deprecated {
+			res.Facets.Deprecated["true"]++
+		} else {
+			res.Facets.Deprecated["false"]++
+		}
+	}
+	sort.Slice(res.Hits, func(a, b int) bool {
+		if res.Hits[a].Score != res.Hits[b].Score {
+			return res.Hits[a].Score > res.Hits[b].Score
+		}
+		return res.Hits[a].Name < res.Hits[b].Name
+	})
+	res.Total = len(res.Hits)
+	if q.Limit > 0 && len(res.Hits) > q.Limit {
+		res.Hits = res.Hits[:q.Limit]
+	}
+	return res
+}
+
+// match returns the best score of every document containing a term that matches t.
+func (i *Index) match(t string) map[string]float64 {
+	out := make(map[string]float64)
+	for term, p := range i.postings {
+		quality := matchQuality(t, term)
+		if quality == 0 {
+			continue
+		}
+		for name, w := range p {
+			if s := quality * w; s > out[name] {
+				out[name] = s
+			}
+		}
+	}
+	return out
+}
+
+func matchQuality(q, term string) float64 {
+	switch {
+	case q == term:
+		return exactMatch
+	case len(q) >= 2 && strings.HasPrefix(term, q):
+		return prefixMatch
+	}
+	maxDist := 0
+	switch {
+	case len(q) >= 8:
+		maxDist = 2
+	case len(q) >= 4:
+		maxDist = 1
+	}
+	if maxDist > 0 && levenshtein(q, term, maxDist) <= maxDist {
+		return fuzzyMatch
+	}
+	return 0
+}
+
+// levenshtein returns the edit distance between a and b, or max+1 once it is known to exceed max.
+func levenshtein(a, b string, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
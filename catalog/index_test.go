@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("Index", func() {
+
+	var index *Index
+
+	names := func(res Result) (out []string) {
+		for _, h := range res.Hits {
+			out = append(out, h.Name)
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		index = NewIndex()
+		index.Upsert(newApp("stable", "postgresql", map[string]string{CategoryLabelPrefix + "database": ""},
+			marketplacev1alpha3.ChartVersion{
+				Version:     "8.0.0",
+				Description: "Object-relational database",
+				Keywords:    []string{"postgres", "sql"},
+				Maintainers: []*marketplacev1alpha3.Maintainer{{Name: "bitnami"}},
+			},
+		))
+		index.Upsert(newApp("stable", "pgadmin", map[string]string{CategoryLabelPrefix + "tools": ""},
+			marketplacev1alpha3.ChartVersion{Version: "1.0.0", Description: "Admin UI for postgres"},
+		))
+		index.Upsert(newApp("incubator", "mysql", map[string]string{CategoryLabelPrefix + "database": "", DeprecatedLabel: "true"},
+			marketplacev1alpha3.ChartVersion{Version: "1.0.0", Description: "Relational database"},
+		))
+	})
+
+	It("Should rank name and keyword matches above descriptions", func() {
+		Expect(names(index.Search(Query{Text: "postgres"}))).Should(Equal([]string{"stable.postgresql", "stable.pgadmin"}))
+	})
+
+	It("Should match prefixes and typos", func() {
+		Expect(names(index.Search(Query{Text: "postg"}))).Should(ContainElement("stable.postgresql"))
+		Expect(names(index.Search(Query{Text: "postgrse"}))).Should(ContainElement("stable.postgresql"))
+		Expect(names(index.Search(Query{Text: "bitnmi"}))).Should(Equal([]string{"stable.postgresql"}))
+	})
+
+	It("Should require every term to match", func() {
+		Expect(names(index.Search(Query{Text: "relational database"}))).Should(ConsistOf("stable.postgresql", "incubator.mysql"))
+		Expect(names(index.Search(Query{Text: "relational admin"}))).Should(BeEmpty())
+	})
+
+	It("Should filter and facet", func() {
+		deprecated := false
+		res := index.Search(Query{Text: "database", Deprecated: &deprecated})
+		Expect(names(res)).Should(Equal([]string{"stable.postgresql"}))
+
+		res = index.Search(Query{})
+		Expect(res.Total).Should(Equal(3))
+		Expect(res.Facets.Categories).Should(Equal(map[string]int{"database": 2, "tools": 1}))
+		Expect(res.Facets.Sources).Should(Equal(map[string]int{"stable": 2, "incubator": 1}))
+		Expect(res.Facets.Deprecated).Should(Equal(map[string]int{"true": 1, "false": 2}))
+
+		res = index.Search(Query{Category: "database", Limit: 1})
+		Expect(res.Total).Should(Equal(2))
+		Expect(res.Hits).Should(HaveLen(1))
+	})
+
+	It("Should update incrementally", func() {
+		index.Upsert(newApp("stable", "pgadmin", nil, marketplacev1alpha3.ChartVersion{Version: "2.0.0", Description: "Web console"}))
+		Expect(names(index.Search(Query{Text: "postgres"}))).Should(Equal([]string{"stable.postgresql"}))
+		Expect(names(index.Search(Query{Text: "console"}))).Should(Equal([]string{"stable.pgadmin"}))
+
+		index.Delete("stable.postgresql")
+		Expect(names(index.Search(Query{Text: "postgres"}))).Should(BeEmpty())
+		Expect(index.postings).ShouldNot(HaveKey("bitnami"))
+	})
+})
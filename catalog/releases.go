@@ -0,0 +1,81 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const releasesPrefix = "/api/v1/releases/"
+
+// ReleaseManifests reads the rendered manifest of a release from helm's storage.
+type ReleaseManifests interface {
+	Manifest(ctx context.Context, namespace, name string) (string, error)
+}
+
+// getReleaseManifest serves the manifest of a Release that is mirrored without it:
+//
+//	GET /api/v1/releases/{namespace}/{name}/manifest
+//
+// The manifest holds every resource of the release, Secrets included, so it is only served to users who may get the
+// manifest subresource of the Release.
+func (s *Server) getReleaseManifest(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, releasesPrefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] != "manifest" {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, name := parts[0], parts[1]
+	if s.Authenticator == nil || s.Authorizer == nil || s.Manifests == nil {
+		httpError(w, http.StatusServiceUnavailable, "release manifests are not enabled")
+		return
+	}
+	u, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	allowed, err := s.Authorizer.CanReadManifest(r.Context(), u, namespace, name)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if !allowed {
+		httpError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	manifest, err := s.Manifests.Manifest(r.Context(), namespace, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			httpError(w, http.StatusNotFound, "release not found")
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := io.WriteString(w, manifest); err != nil {
+		s.Log.Error(err, "failed to serve release manifest", "namespace", namespace, "release", name)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// fakeManifests serves the manifests of namespace/name releases.
+type fakeManifests map[string]string
+
+func (m fakeManifests) Manifest(ctx context.Context, namespace, name string) (string, error) {
+	manifest, ok := m[namespace+"/"+name]
+	if !ok {
+		return "", apierrors.NewNotFound(schema.GroupResource{Resource: "releases"}, name)
+	}
+	return manifest, nil
+}
+
+var _ = Describe("Release manifests", func() {
+
+	var ts *httptest.Server
+
+	get := func(user, path string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, string(b)
+	}
+
+	BeforeEach(func() {
+		auth := &fakeAuth{manifests: map[string][]string{"alice": {"team-a/db", "team-a/missing"}}}
+		s := &Server{
+			Log:           logf.Log,
+			Authenticator: auth,
+			Authorizer:    auth,
+			Manifests:     fakeManifests{"team-a/db": "kind: Secret\n"},
+		}
+		ts = httptest.NewServer(s.Handler())
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should serve manifests to authorized users", func() {
+		resp, body := get("alice", "/api/v1/releases/team-a/db/manifest")
+		Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("application/yaml"))
+		Expect(body).Should(Equal("kind: Secret\n"))
+	})
+
+	It("Should reject unauthenticated and unauthorized users", func() {
+		resp, _ := get("", "/api/v1/releases/team-a/db/manifest")
+		Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+		resp, _ = get("bob", "/api/v1/releases/team-a/db/manifest")
+		Expect(resp.StatusCode).Should(Equal(http.StatusForbidden))
+	})
+
+	It("Should return not found for unknown releases and paths", func() {
+		resp, _ := get("alice", "/api/v1/releases/team-a/missing/manifest")
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		resp, _ = get("alice", "/api/v1/releases/team-a/db")
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+	})
+})
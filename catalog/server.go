@@ -0,0 +1,617 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package catalog serves a read-only JSON API over the marketplace catalog for UIs and other clients that shouldn't
+// have to list raw Application objects through the apiserver.
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Server serves the catalog API. Reads go through Client, which is expected to be the manager's cache-backed client.
+type Server struct {
+	Client client.Reader
+	Log    logr.Logger
+
+	// Index serves /api/v1/search. Search is unavailable when it is nil.
+	Index *Index
+
+	// Store serves cached chart archives under /charts/files/.
+	Store chartstore.Store
+
+	// Authenticator and Authorizer serve /api/v1/visible/apps, chart downloads, cached charts of Sources with
+	// credentials and release manifests, which are unavailable when either is nil. Every other route that lists or
+	// reads Applications applies the visibility rules, and only shows the Applications that no rule restricts when
+	// either is nil or the request has no bearer token.
+	Authenticator Authenticator
+	Authorizer    Authorizer
+
+	// Downloader serves chart downloads, which are unavailable when it is nil.
+	Downloader ChartDownloader
+
+	// Manifests serves the manifests of Releases mirrored without them, which are unavailable when it is nil.
+	Manifests ReleaseManifests
+
+	// Addr is the address the server listens on.
+	Addr string
+}
+
+// NeedLeaderElection allows the API to be served by every manager replica.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the API until stop is closed.
+func (s *Server) Start(stop <-chan struct{}) error {
+	srv := &http.Server{
+		Handler: s.Handler(),
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.Log.Info("serving catalog API", "addr", l.Addr().String())
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+	select {
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	case err := <-errCh:
+		return err
+	}
+}
+
+// Handler returns the API routes:
+//
+//   GET /api/v1/apps?q=&category=&source=&deprecated=&limit=&continue=
+//   GET /api/v1/visible/apps?q=&category=&source=&deprecated=&limit=&continue=
+//   GET /api/v1/apps/{name}
+//   GET /api/v1/apps/{name}/versions/{version}
+//   GET /api/v1/apps/{name}/versions/{version}/documents
+//   GET /api/v1/apps/{name}/versions/{version}/schema
+//   GET /api/v1/apps/{name}/versions/{version}/chart
+//   GET /api/v1/categories
+//   GET /api/v1/sources
+//   GET /api/v1/search?q=&category=&source=&deprecated=&limit=
+//   GET /api/v1/releases/{namespace}/{name}/manifest
+//
+// and the Helm repository, see serveIndex and serveChartFile.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/apps", s.listApps)
+	mux.HandleFunc("/api/v1/apps/", s.getApp)
+	mux.HandleFunc("/api/v1/visible/apps", s.listVisibleApps)
+	mux.HandleFunc("/api/v1/search", s.search)
+	mux.HandleFunc("/api/v1/categories", s.listCategories)
+	mux.HandleFunc("/api/v1/sources", s.listSources)
+	mux.HandleFunc(releasesPrefix, s.getReleaseManifest)
+	mux.HandleFunc(chartsPrefix, s.serveIndex)
+	mux.HandleFunc(chartFilesPrefix, s.serveChartFile)
+	return mux
+}
+
+// AppList is a page of application summaries.
+type AppList struct {
+	Items []AppSummary `json:"items"`
+	// Continue is set when more results are available, and is passed as the continue parameter to fetch them.
+	Continue string `json:"continue,omitempty"`
+}
+
+// AppSummary is the listing view of an Application, described by its latest version.
+type AppSummary struct {
+	Name        string   `json:"name"`
+	AppName     string   `json:"appName"`
+	Source      string   `json:"source"`
+	Categories  []string `json:"categories,omitempty"`
+	Deprecated  bool     `json:"deprecated,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Icon        string   `json:"icon,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+	Version     string   `json:"version"`
+	AppVersion  string   `json:"appVersion,omitempty"`
+	Versions    []string `json:"versions"`
+}
+
+// SearchResult is a ranked page of search hits along with facet counts over all matches.
+type SearchResult struct {
+	Total  int         `json:"total"`
+	Items  []SearchHit `json:"items"`
+	Facets Facets      `json:"facets"`
+}
+
+// SearchHit is an application summary and its search score.
+type SearchHit struct {
+	AppSummary
+	Score float64 `json:"score"`
+}
+
+// Category is a category label and the number of applications in it.
+type Category struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// SourceSummary is the listing view of a Source. Credentials are never included.
+type SourceSummary struct {
+	Name            string                              `json:"name"`
+	URL             string                              `json:"url"`
+	State           marketplacev1alpha2.SourceSyncState `json:"state,omitempty"`
+	Reason          string                              `json:"reason,omitempty"`
+	AppCount        int                                 `json:"appCount"`
+	LastUpdate      *time.Time                          `json:"lastUpdate,omitempty"`
+	UpdateFrequency string                              `json:"updateFrequency,omitempty"`
+}
+
+func (s *Server) listApps(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	s.writeAppList(w, r, func(app *marketplacev1alpha3.Application) bool {
+		return rules.Visible(app, v)
+	})
+}
+
+// listVisibleApps lists the Applications that the visibility rules of Sources and categories allow the requesting
+// user to see. The user is authenticated with a bearer token.
+func (s *Server) listVisibleApps(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	if s.Authenticator == nil || s.Authorizer == nil {
+		httpError(w, http.StatusServiceUnavailable, "visibility filtering is not enabled")
+		return
+	}
+	u, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	rules, err := LoadVisibilityRules(r.Context(), s.Client)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	v, err := s.viewer(r.Context(), u, rules)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	s.writeAppList(w, r, func(app *marketplacev1alpha3.Application) bool {
+		return rules.Visible(app, v)
+	})
+}
+
+// authenticate identifies the user making r, replying 401 Unauthorized when that fails.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*authenticationv1.UserInfo, bool) {
+	u, err := s.Authenticator.Authenticate(r)
+	if err != nil {
+		s.Log.V(1).Info("unauthenticated catalog request", "reason", err.Error())
+		httpError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+	return u, true
+}
+
+// viewer finds the namespaces u browses the catalog from.
+func (s *Server) viewer(ctx context.Context, u *authenticationv1.UserInfo, rules *VisibilityRules) (*Viewer, error) {
+	return NewViewer(ctx, s.Client, rules, u.Groups, func(ctx context.Context, namespace string) (bool, error) {
+		return s.Authorizer.CanView(ctx, u, namespace)
+	})
+}
+
+// visibility returns the visibility rules and the Viewer making r, for every route that lists or reads Applications.
+// Requests without a bearer token, and every request when authentication isn't configured, are anonymous and only see
+// the Applications that no rule restricts. It replies 401 Unauthorized when a bearer token can't be authenticated.
+func (s *Server) visibility(w http.ResponseWriter, r *http.Request) (*VisibilityRules, *Viewer, bool) {
+	rules, err := LoadVisibilityRules(r.Context(), s.Client)
+	if err != nil {
+		s.serverError(w, err)
+		return nil, nil, false
+	}
+	if rules.Empty() {
+		return rules, &Viewer{All: true}, true
+	}
+	if s.Authenticator == nil || s.Authorizer == nil || r.Header.Get("Authorization") == "" {
+		return rules, &Viewer{}, true
+	}
+	u, ok := s.authenticate(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	v, err := s.viewer(r.Context(), u, rules)
+	if err != nil {
+		s.serverError(w, err)
+		return nil, nil, false
+	}
+	return rules, v, true
+}
+
+// writeAppList writes a page of the visible Applications matching the query parameters.
+func (s *Server) writeAppList(w http.ResponseWriter, r *http.Request, visible func(*marketplacev1alpha3.Application) bool) {
+	q := r.URL.Query()
+	limit := defaultPageSize
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	after := ""
+	if c := q.Get("continue"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid continue token")
+			return
+		}
+		after = string(b)
+	}
+
+	apps, err := s.applications(r.Context(), q.Get("source"))
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	match := appMatcher(q)
+
+	list := AppList{Items: make([]AppSummary, 0)}
+	for _, app := range apps {
+		if app.Name <= after || !match(&app) || !visible(&app) {
+			continue
+		}
+		if len(list.Items) == limit {
+			list.Continue = base64.RawURLEncoding.EncodeToString([]byte(list.Items[limit-1].Name))
+			break
+		}
+		list.Items = append(list.Items, Summarize(&app))
+	}
+	writeJSON(w, r, list)
+}
+
+// appMatcher builds the filter for the q, category, source and deprecated query parameters.
+func appMatcher(q map[string][]string) func(*marketplacev1alpha3.Application) bool {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	text := strings.ToLower(get("q"))
+	category := strings.ToLower(get("category"))
+	deprecated := get("deprecated")
+	return func(app *marketplacev1alpha3.Application) bool {
+		if category != "" {
+			if _, ok := app.Labels[CategoryLabelPrefix+category]; !ok {
+				return false
+			}
+		}
+		if deprecated != "" && strconv.FormatBool(app.Labels[DeprecatedLabel] == "true") != deprecated {
+			return false
+		}
+		if text == "" {
+			return true
+		}
+		if strings.Contains(strings.ToLower(app.Name), text) {
+			return true
+		}
+		if v := LatestVersion(app); v != nil {
+			if strings.Contains(strings.ToLower(v.Description), text) {
+				return true
+			}
+			for _, k := range v.Keywords {
+				if strings.ToLower(k) == text {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func (s *Server) getApp(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	// {name}[/versions/{version}[/documents|/schema]]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/apps/"), "/")
+	var app marketplacev1alpha3.Application
+	if err := s.Client.Get(r.Context(), client.ObjectKey{Name: parts[0]}, &app); err != nil {
+		if apierrors.IsNotFound(err) {
+			httpError(w, http.StatusNotFound, "application not found")
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+	if !rules.Visible(&app, v) {
+		httpError(w, http.StatusNotFound, "application not found")
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, r, &app)
+		return
+	}
+	if parts[1] != "versions" || len(parts) < 3 || len(parts) > 4 {
+		http.NotFound(w, r)
+		return
+	}
+	var cv *marketplacev1alpha3.ChartVersion
+	for i := range app.Versions {
+		if app.Versions[i].Version == parts[2] {
+			cv = &app.Versions[i]
+			break
+		}
+	}
+	if cv == nil {
+		httpError(w, http.StatusNotFound, "version not found")
+		return
+	}
+	if len(parts) == 3 {
+		writeJSON(w, r, cv)
+		return
+	}
+	switch parts[3] {
+	case "documents":
+		docs := cv.Documents
+		if docs == nil {
+			docs = map[string]string{}
+		}
+		writeJSON(w, r, docs)
+	case "schema":
+		if len(cv.Schema) == 0 {
+			httpError(w, http.StatusNotFound, "version has no schema")
+			return
+		}
+		writeJSON(w, r, json.RawMessage(cv.Schema))
+	case "chart":
+		s.downloadChart(w, r, &app, cv)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	if s.Index == nil {
+		httpError(w, http.StatusServiceUnavailable, "search is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	query := Query{
+		Text:     q.Get("q"),
+		Category: strings.ToLower(q.Get("category")),
+		Source:   q.Get("source"),
+		Limit:    defaultPageSize,
+	}
+	if d := q.Get("deprecated"); d != "" {
+		b, err := strconv.ParseBool(d)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid deprecated")
+			return
+		}
+		query.Deprecated = &b
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		query.Limit = n
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	query.Visible = func(source string, categories []string) bool {
+		return rules.Allows(source, categories, v)
+	}
+
+	res := s.Index.Search(query)
+	out := SearchResult{
+		Total:  res.Total,
+		Items:  make([]SearchHit, 0, len(res.Hits)),
+		Facets: res.Facets,
+	}
+	for _, hit := range res.Hits {
+		var app marketplacev1alpha3.Application
+		if err := s.Client.Get(r.Context(), client.ObjectKey{Name: hit.Name}, &app); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			s.serverError(w, err)
+			return
+		}
+		out.Items = append(out.Items, SearchHit{AppSummary: Summarize(&app), Score: hit.Score})
+	}
+	writeJSON(w, r, out)
+}
+
+func (s *Server) listCategories(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	apps, err := s.applications(r.Context(), "")
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	counts := make(map[string]int)
+	for _, app := range apps {
+		if !rules.Visible(&app, v) {
+			continue
+		}
+		for _, c := range Categories(&app) {
+			counts[c]++
+		}
+	}
+	cats := make([]Category, 0, len(counts))
+	for name, n := range counts {
+		cats = append(cats, Category{Name: name, Count: n})
+	}
+	sort.Slice(cats, func(i, j int) bool {
+		return cats[i].Name < cats[j].Name
+	})
+	writeJSON(w, r, cats)
+}
+
+func (s *Server) listSources(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rules, v, ok := s.visibility(w, r)
+	if !ok {
+		return
+	}
+	var sources marketplacev1alpha2.SourceList
+	if err := s.Client.List(r.Context(), &sources); err != nil {
+		s.serverError(w, err)
+		return
+	}
+	out := make([]SourceSummary, 0, len(sources.Items))
+	for _, src := range sources.Items {
+		if !rules.Allows(src.Name, nil, v) {
+			continue
+		}
+		ss := SourceSummary{
+			Name:            src.Name,
+			URL:             src.Spec.URL,
+			State:           src.Status.State,
+			Reason:          src.Status.Reason,
+			AppCount:        src.Status.AppCount,
+			UpdateFrequency: src.Spec.UpdateFrequency,
+		}
+		if !src.Status.LastUpdate.IsZero() {
+			t := src.Status.LastUpdate.Time
+			ss.LastUpdate = &t
+		}
+		out = append(out, ss)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	writeJSON(w, r, out)
+}
+
+// applications lists Applications sorted by name, optionally limited to a single Source.
+func (s *Server) applications(ctx context.Context, source string) ([]marketplacev1alpha3.Application, error) {
+	var opts []client.ListOption
+	if source != "" {
+		opts = append(opts, client.MatchingLabels{SourceLabel: source})
+	}
+	var apps marketplacev1alpha3.ApplicationList
+	if err := s.Client.List(ctx, &apps, opts...); err != nil {
+		return nil, err
+	}
+	sort.Slice(apps.Items, func(i, j int) bool {
+		return apps.Items[i].Name < apps.Items[j].Name
+	})
+	return apps.Items, nil
+}
+
+func (s *Server) serverError(w http.ResponseWriter, err error) {
+	s.Log.Error(err, "catalog request failed")
+	httpError(w, http.StatusInternalServerError, "internal error")
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// writeJSON writes v with an ETag derived from its encoding, replying 304 Not Modified when the client already has
+// it.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write(b)
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
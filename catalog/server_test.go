@@ -0,0 +1,191 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+func newApp(source, chart string, labels map[string]string, versions ...marketplacev1alpha3.ChartVersion) *marketplacev1alpha3.Application {
+	app := &marketplacev1alpha3.Application{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: source + "." + chart,
+			Labels: map[string]string{
+				SourceLabel: source,
+				"marketplace.criticalstack.com/application.name": chart,
+			},
+		},
+		AppName:  chart,
+		Versions: versions,
+	}
+	for k, v := range labels {
+		app.Labels[k] = v
+	}
+	return app
+}
+
+var _ = Describe("Server", func() {
+
+	var ts *httptest.Server
+
+	get := func(path string, v interface{}) *http.Response {
+		resp, err := http.Get(ts.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		}
+		return resp
+	}
+
+	BeforeEach(func() {
+		objs := []runtime.Object{
+			&marketplacev1alpha2.Source{
+				ObjectMeta: metav1.ObjectMeta{Name: "stable"},
+				Spec: marketplacev1alpha2.SourceSpec{
+					URL:      "https://charts.example.com",
+					Username: "admin",
+					Password: "hunter2",
+				},
+			},
+			newApp("stable", "mysql", map[string]string{CategoryLabelPrefix + "database": ""},
+				marketplacev1alpha3.ChartVersion{Version: "1.2.0", Description: "old"},
+				marketplacev1alpha3.ChartVersion{
+					Version:     "1.10.0",
+					Description: "Fast, reliable relational database",
+					Keywords:    []string{"sql"},
+					Documents:   map[string]string{"README": "hello"},
+					Schema:      []byte(`{"type":"object"}`),
+				},
+			),
+			newApp("stable", "redis", map[string]string{CategoryLabelPrefix + "database": "", DeprecatedLabel: "true"},
+				marketplacev1alpha3.ChartVersion{Version: "10.5.7", Description: "key-value store"},
+			),
+			newApp("other", "nginx", nil, marketplacev1alpha3.ChartVersion{Version: "0.1.0"}),
+		}
+		for i := 0; i < 5; i++ {
+			objs = append(objs, newApp("paged", fmt.Sprintf("app%d", i), nil, marketplacev1alpha3.ChartVersion{Version: "1.0.0"}))
+		}
+		index := NewIndex()
+		for _, obj := range objs {
+			if app, ok := obj.(*marketplacev1alpha3.Application); ok {
+				index.Upsert(app)
+			}
+		}
+		s := &Server{
+			Client: fake.NewFakeClientWithScheme(scheme, objs...),
+			Log:    logf.Log,
+			Index:  index,
+		}
+		ts = httptest.NewServer(s.Handler())
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should summarize apps by their latest version", func() {
+		var list AppList
+		Expect(get("/api/v1/apps?source=stable", &list).StatusCode).Should(Equal(http.StatusOK))
+		Expect(list.Items).Should(HaveLen(2))
+		Expect(list.Items[0].Name).Should(Equal("stable.mysql"))
+		Expect(list.Items[0].Version).Should(Equal("1.10.0"))
+		Expect(list.Items[0].Categories).Should(Equal([]string{"database"}))
+		Expect(list.Items[1].Deprecated).Should(BeTrue())
+	})
+
+	It("Should filter apps", func() {
+		var list AppList
+		get("/api/v1/apps?q=relational", &list)
+		Expect(list.Items).Should(HaveLen(1))
+		get("/api/v1/apps?category=database&deprecated=false", &list)
+		Expect(list.Items).Should(HaveLen(1))
+		Expect(list.Items[0].Name).Should(Equal("stable.mysql"))
+	})
+
+	It("Should paginate", func() {
+		var names []string
+		path := "/api/v1/apps?source=paged&limit=2"
+		for {
+			var list AppList
+			get(path, &list)
+			for _, item := range list.Items {
+				names = append(names, item.Name)
+			}
+			if list.Continue == "" {
+				break
+			}
+			path = "/api/v1/apps?source=paged&limit=2&continue=" + list.Continue
+		}
+		Expect(names).Should(Equal([]string{"paged.app0", "paged.app1", "paged.app2", "paged.app3", "paged.app4"}))
+	})
+
+	It("Should serve version details", func() {
+		var cv marketplacev1alpha3.ChartVersion
+		Expect(get("/api/v1/apps/stable.mysql/versions/1.10.0", &cv).StatusCode).Should(Equal(http.StatusOK))
+		Expect(cv.Description).Should(Equal("Fast, reliable relational database"))
+
+		var docs map[string]string
+		get("/api/v1/apps/stable.mysql/versions/1.10.0/documents", &docs)
+		Expect(docs).Should(HaveKeyWithValue("README", "hello"))
+
+		var schema map[string]interface{}
+		get("/api/v1/apps/stable.mysql/versions/1.10.0/schema", &schema)
+		Expect(schema).Should(HaveKeyWithValue("type", "object"))
+
+		Expect(get("/api/v1/apps/stable.mysql/versions/9.9.9", nil).StatusCode).Should(Equal(http.StatusNotFound))
+		Expect(get("/api/v1/apps/stable.missing", nil).StatusCode).Should(Equal(http.StatusNotFound))
+	})
+
+	It("Should search", func() {
+		var res SearchResult
+		Expect(get("/api/v1/search?q=relatonal", &res).StatusCode).Should(Equal(http.StatusOK))
+		Expect(res.Total).Should(Equal(1))
+		Expect(res.Items[0].Name).Should(Equal("stable.mysql"))
+		Expect(res.Items[0].Version).Should(Equal("1.10.0"))
+		Expect(res.Items[0].Score).Should(BeNumerically(">", 0))
+		Expect(res.Facets.Sources).Should(HaveKeyWithValue("stable", 1))
+	})
+
+	It("Should count categories", func() {
+		var cats []Category
+		get("/api/v1/categories", &cats)
+		Expect(cats).Should(Equal([]Category{{Name: "database", Count: 2}}))
+	})
+
+	It("Should not expose Source credentials", func() {
+		resp, err := http.Get(ts.URL + "/api/v1/sources")
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		var raw []map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&raw)).To(Succeed())
+		Expect(raw).Should(HaveLen(1))
+		Expect(raw[0]).ShouldNot(HaveKey("password"))
+		Expect(raw[0]).ShouldNot(HaveKey("username"))
+	})
+
+	It("Should honor ETags", func() {
+		resp := get("/api/v1/apps", nil)
+		etag := resp.Header.Get("ETag")
+		Expect(etag).ShouldNot(BeEmpty())
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/apps", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("If-None-Match", etag)
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusNotModified))
+	})
+})
@@ -0,0 +1,223 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// The categories ConfigMap maps categories to the applications in them. Its VisibilityKey maps categories to the
+// Visibility of their Applications instead, e.g.
+//
+//	visibility.yaml: |
+//	  application.security:
+//	    groups: [security-team]
+//	    namespaceSelector:
+//	      matchLabels: {team: security}
+const (
+	CategoriesConfigMapNamespace = "critical-stack"
+	CategoriesConfigMapName      = "marketplace-app-categories"
+	VisibilityKey                = "visibility.yaml"
+)
+
+// Viewer is who the visibility of Applications is decided for: the members of Groups, browsing the catalog from
+// Namespaces, or from every namespace when All is set.
+type Viewer struct {
+	Groups     []string
+	Namespaces []corev1.Namespace
+	All        bool
+}
+
+type visibilityRule struct {
+	groups   map[string]bool
+	selector labels.Selector
+}
+
+func newVisibilityRule(v *marketplacev1alpha2.Visibility) *visibilityRule {
+	rule := &visibilityRule{groups: make(map[string]bool)}
+	for _, g := range v.Groups {
+		rule.groups[g] = true
+	}
+	if v.NamespaceSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(v.NamespaceSelector)
+		if err != nil {
+			// an invalid selector hides the Applications rather than showing them to everyone
+			sel = labels.Nothing()
+		}
+		rule.selector = sel
+	}
+	return rule
+}
+
+func (rule *visibilityRule) selects(ns *corev1.Namespace) bool {
+	return rule.selector != nil && rule.selector.Matches(labels.Set(ns.Labels))
+}
+
+func (rule *visibilityRule) allows(v *Viewer) bool {
+	if v.All {
+		return true
+	}
+	for _, g := range v.Groups {
+		if rule.groups[g] {
+			return true
+		}
+	}
+	for i := range v.Namespaces {
+		if rule.selects(&v.Namespaces[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// VisibilityRules are the visibility restrictions of Sources and categories. An Application is visible when the rule
+// of its Source and the rules of all its categories allow it.
+type VisibilityRules struct {
+	sources    map[string]*visibilityRule
+	categories map[string]*visibilityRule
+}
+
+// NewVisibilityRules builds the rules of Sources and of categories, keyed by category.
+func NewVisibilityRules(sources []marketplacev1alpha2.Source, categories map[string]*marketplacev1alpha2.Visibility) *VisibilityRules {
+	rules := &VisibilityRules{
+		sources:    make(map[string]*visibilityRule),
+		categories: make(map[string]*visibilityRule),
+	}
+	for _, src := range sources {
+		if src.Spec.Visibility != nil {
+			rules.sources[src.Name] = newVisibilityRule(src.Spec.Visibility)
+		}
+	}
+	for cat, v := range categories {
+		if v != nil {
+			rules.categories[strings.ToLower(cat)] = newVisibilityRule(v)
+		}
+	}
+	return rules
+}
+
+// LoadVisibilityRules reads the rules from the Sources and the categories ConfigMap. The ConfigMap is optional.
+func LoadVisibilityRules(ctx context.Context, c client.Reader) (*VisibilityRules, error) {
+	var sources marketplacev1alpha2.SourceList
+	if err := c.List(ctx, &sources); err != nil {
+		return nil, err
+	}
+	var categories map[string]*marketplacev1alpha2.Visibility
+	var cm corev1.ConfigMap
+	err := c.Get(ctx, client.ObjectKey{Namespace: CategoriesConfigMapNamespace, Name: CategoriesConfigMapName}, &cm)
+	switch {
+	case err == nil:
+		if s, ok := cm.Data[VisibilityKey]; ok {
+			if categories, err = ParseCategoryVisibility(s); err != nil {
+				return nil, err
+			}
+		}
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	return NewVisibilityRules(sources.Items, categories), nil
+}
+
+// ParseCategoryVisibility parses the VisibilityKey of the categories ConfigMap.
+func ParseCategoryVisibility(s string) (map[string]*marketplacev1alpha2.Visibility, error) {
+	var categories map[string]*marketplacev1alpha2.Visibility
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(s), 128).Decode(&categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// Visible reports whether app is visible to v.
+func (rules *VisibilityRules) Visible(app *marketplacev1alpha3.Application, v *Viewer) bool {
+	return rules.Allows(app.Labels[SourceLabel], Categories(app), v)
+}
+
+// Allows reports whether the Applications of source in categories are visible to v.
+func (rules *VisibilityRules) Allows(source string, categories []string, v *Viewer) bool {
+	if rule, ok := rules.sources[source]; ok && !rule.allows(v) {
+		return false
+	}
+	for _, c := range categories {
+		if rule, ok := rules.categories[c]; ok && !rule.allows(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty reports whether there are no rules, so that every Application is visible to everyone.
+func (rules *VisibilityRules) Empty() bool {
+	return len(rules.sources) == 0 && len(rules.categories) == 0
+}
+
+// Selects reports whether any rule allows Applications to be seen from ns, so that only those namespaces need to be
+// checked when finding the namespaces a user browses the catalog from.
+func (rules *VisibilityRules) Selects(ns *corev1.Namespace) bool {
+	for _, rule := range rules.sources {
+		if rule.selects(ns) {
+			return true
+		}
+	}
+	for _, rule := range rules.categories {
+		if rule.selects(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewViewer finds the namespaces the members of groups browse the catalog from, as decided by canView, which is
+// asked about every namespace with an empty namespace first. Only namespaces selected by a rule are checked.
+func NewViewer(ctx context.Context, c client.Reader, rules *VisibilityRules, groups []string, canView func(ctx context.Context, namespace string) (bool, error)) (*Viewer, error) {
+	v := &Viewer{Groups: groups}
+	all, err := canView(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		v.All = true
+		return v, nil
+	}
+	var namespaces corev1.NamespaceList
+	if err := c.List(ctx, &namespaces); err != nil {
+		return nil, err
+	}
+	for _, ns := range namespaces.Items {
+		if !rules.Selects(&ns) {
+			continue
+		}
+		ok, err := canView(ctx, ns.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			v.Namespaces = append(v.Namespaces, ns)
+		}
+	}
+	return v, nil
+}
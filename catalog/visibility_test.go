@@ -0,0 +1,294 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// fakeAuth authenticates the bearer token as a username, lets users browse the catalog from the namespaces in
+// namespaces, where "*" is every namespace, download the apps in downloads, and read the manifests of the
+// namespace/name releases in manifests.
+type fakeAuth struct {
+	groups     map[string][]string
+	namespaces map[string][]string
+	downloads  map[string][]string
+	manifests  map[string][]string
+}
+
+func (a *fakeAuth) Authenticate(r *http.Request) (*authenticationv1.UserInfo, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") || h == "Bearer " {
+		return nil, errors.New("no bearer token")
+	}
+	name := strings.TrimPrefix(h, "Bearer ")
+	return &authenticationv1.UserInfo{Username: name, Groups: a.groups[name]}, nil
+}
+
+func (a *fakeAuth) CanView(ctx context.Context, u *authenticationv1.UserInfo, namespace string) (bool, error) {
+	for _, ns := range a.namespaces[u.Username] {
+		if ns == "*" || ns == namespace {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *fakeAuth) CanDownload(ctx context.Context, u *authenticationv1.UserInfo, app string) (bool, error) {
+	for _, name := range a.downloads[u.Username] {
+		if name == app {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *fakeAuth) CanReadManifest(ctx context.Context, u *authenticationv1.UserInfo, namespace, name string) (bool, error) {
+	for _, rel := range a.manifests[u.Username] {
+		if rel == namespace+"/"+name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var _ = Describe("Visibility", func() {
+
+	namespace := func(name string, labels map[string]string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+
+	It("Should combine Source and category rules", func() {
+		rules := NewVisibilityRules([]marketplacev1alpha2.Source{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal"},
+				Spec: marketplacev1alpha2.SourceSpec{Visibility: &marketplacev1alpha2.Visibility{
+					Groups:            []string{"platform"},
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+				}},
+			},
+		}, map[string]*marketplacev1alpha2.Visibility{
+			"Security": {Groups: []string{"security"}},
+		})
+		vault := newApp("internal", "vault", map[string]string{CategoryLabelPrefix + "security": ""})
+		tool := newApp("internal", "tool", nil)
+		mysql := newApp("stable", "mysql", nil)
+
+		anyone := &Viewer{}
+		Expect(rules.Visible(mysql, anyone)).To(BeTrue())
+		Expect(rules.Visible(tool, anyone)).To(BeFalse())
+
+		teamA := &Viewer{Namespaces: []corev1.Namespace{namespace("a", map[string]string{"team": "a"})}}
+		Expect(rules.Visible(tool, teamA)).To(BeTrue())
+		Expect(rules.Visible(vault, teamA)).To(BeFalse())
+		Expect(rules.Visible(vault, &Viewer{Groups: []string{"platform", "security"}})).To(BeTrue())
+		Expect(rules.Visible(vault, &Viewer{All: true})).To(BeTrue())
+	})
+
+	It("Should hide Applications behind invalid selectors", func() {
+		rules := NewVisibilityRules([]marketplacev1alpha2.Source{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal"},
+				Spec: marketplacev1alpha2.SourceSpec{Visibility: &marketplacev1alpha2.Visibility{
+					NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "team", Operator: "Bogus"},
+					}},
+				}},
+			},
+		}, nil)
+		v := &Viewer{Namespaces: []corev1.Namespace{namespace("a", map[string]string{"team": "a"})}}
+		Expect(rules.Visible(newApp("internal", "tool", nil), v)).To(BeFalse())
+	})
+
+	It("Should parse category rules", func() {
+		cats, err := ParseCategoryVisibility("database:\n  groups: [dba]\n  namespaceSelector:\n    matchLabels: {tier: data}\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cats).To(HaveKey("database"))
+		Expect(cats["database"].Groups).To(Equal([]string{"dba"}))
+		Expect(cats["database"].NamespaceSelector.MatchLabels).To(HaveKeyWithValue("tier", "data"))
+	})
+
+	Describe("visible apps endpoint", func() {
+
+		var ts *httptest.Server
+
+		list := func(user string) (int, []string) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/visible/apps", nil)
+			Expect(err).NotTo(HaveOccurred())
+			if user != "" {
+				req.Header.Set("Authorization", "Bearer "+user)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			var names []string
+			if resp.StatusCode == http.StatusOK {
+				var list AppList
+				Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+				for _, item := range list.Items {
+					names = append(names, item.Name)
+				}
+			}
+			return resp.StatusCode, names
+		}
+
+		get := func(user, path string, v interface{}) int {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			if user != "" {
+				req.Header.Set("Authorization", "Bearer "+user)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			if v != nil && resp.StatusCode == http.StatusOK {
+				b, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(yaml.Unmarshal(b, v)).To(Succeed())
+			}
+			return resp.StatusCode
+		}
+
+		BeforeEach(func() {
+			a := namespace("a", map[string]string{"team": "a"})
+			b := namespace("b", nil)
+			apps := []*marketplacev1alpha3.Application{
+				newApp("stable", "mysql", nil, marketplacev1alpha3.ChartVersion{Version: "1.0.0"}),
+				newApp("stable", "scanner", map[string]string{CategoryLabelPrefix + "security": ""}, marketplacev1alpha3.ChartVersion{Version: "1.0.0"}),
+				newApp("team", "tool", nil, marketplacev1alpha3.ChartVersion{Version: "1.0.0"}),
+			}
+			index := NewIndex()
+			for _, app := range apps {
+				index.Upsert(app)
+			}
+			c := fake.NewFakeClientWithScheme(scheme,
+				&a, &b,
+				&marketplacev1alpha2.Source{ObjectMeta: metav1.ObjectMeta{Name: "stable"}},
+				&marketplacev1alpha2.Source{
+					ObjectMeta: metav1.ObjectMeta{Name: "team"},
+					Spec: marketplacev1alpha2.SourceSpec{Visibility: &marketplacev1alpha2.Visibility{
+						NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+					}},
+				},
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: CategoriesConfigMapNamespace, Name: CategoriesConfigMapName},
+					Data: map[string]string{
+						"mpcats.yaml": "security:\n- scanner\n",
+						VisibilityKey: "security:\n  groups: [security]\n",
+					},
+				},
+				apps[0], apps[1], apps[2],
+			)
+			auth := &fakeAuth{
+				groups: map[string][]string{"erin": {"security"}},
+				namespaces: map[string][]string{
+					"admin": {"*"},
+					"bob":   {"b"},
+					"carol": {"a"},
+				},
+			}
+			s := &Server{
+				Client:        c,
+				Log:           logf.Log,
+				Index:         index,
+				Authenticator: auth,
+				Authorizer:    auth,
+			}
+			ts = httptest.NewServer(s.Handler())
+		})
+
+		AfterEach(func() {
+			ts.Close()
+		})
+
+		It("Should require authentication", func() {
+			code, _ := list("")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should only list the apps visible to the user", func() {
+			for user, expected := range map[string][]string{
+				"bob":   {"stable.mysql"},
+				"carol": {"stable.mysql", "team.tool"},
+				"erin":  {"stable.mysql", "stable.scanner"},
+				"admin": {"stable.mysql", "stable.scanner", "team.tool"},
+			} {
+				code, names := list(user)
+				Expect(code).To(Equal(http.StatusOK))
+				Expect(names).To(Equal(expected), user)
+			}
+		})
+
+		It("Should apply the rules to every route", func() {
+			var apps AppList
+			Expect(get("", "/api/v1/apps", &apps)).To(Equal(http.StatusOK))
+			Expect(apps.Items).To(HaveLen(1))
+			Expect(apps.Items[0].Name).To(Equal("stable.mysql"))
+			Expect(get("carol", "/api/v1/apps", &apps)).To(Equal(http.StatusOK))
+			Expect(apps.Items).To(HaveLen(2))
+
+			Expect(get("", "/api/v1/apps/team.tool", nil)).To(Equal(http.StatusNotFound))
+			Expect(get("", "/api/v1/apps/team.tool/versions/1.0.0", nil)).To(Equal(http.StatusNotFound))
+			Expect(get("carol", "/api/v1/apps/team.tool", nil)).To(Equal(http.StatusOK))
+
+			var res SearchResult
+			Expect(get("", "/api/v1/search?q=scanner", &res)).To(Equal(http.StatusOK))
+			Expect(res.Total).To(BeZero())
+			Expect(get("erin", "/api/v1/search?q=scanner", &res)).To(Equal(http.StatusOK))
+			Expect(res.Total).To(Equal(1))
+
+			var cats []Category
+			Expect(get("", "/api/v1/categories", &cats)).To(Equal(http.StatusOK))
+			Expect(cats).To(BeEmpty())
+			Expect(get("erin", "/api/v1/categories", &cats)).To(Equal(http.StatusOK))
+			Expect(cats).To(Equal([]Category{{Name: "security", Count: 1}}))
+
+			var sources []SourceSummary
+			Expect(get("", "/api/v1/sources", &sources)).To(Equal(http.StatusOK))
+			Expect(sources).To(HaveLen(1))
+			Expect(get("carol", "/api/v1/sources", &sources)).To(Equal(http.StatusOK))
+			Expect(sources).To(HaveLen(2))
+
+			var index repo.IndexFile
+			Expect(get("", "/charts/index.yaml", &index)).To(Equal(http.StatusOK))
+			Expect(index.Entries).To(HaveLen(1))
+			Expect(index.Entries).To(HaveKey("stable.mysql"))
+			Expect(get("admin", "/charts/index.yaml", &index)).To(Equal(http.StatusOK))
+			Expect(index.Entries).To(HaveLen(3))
+		})
+
+		It("Should reject bearer tokens that can't be authenticated", func() {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/apps", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should be unavailable without an authenticator", func() {
+			s := &Server{Client: fake.NewFakeClientWithScheme(scheme), Log: logf.Log}
+			ts.Config.Handler = s.Handler()
+			code, _ := list("bob")
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+})
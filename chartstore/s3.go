@@ -0,0 +1,309 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chartstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+
+	amzDateFormat = "20060102T150405Z"
+	// emptyPayloadHash is the SHA-256 of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3 is a Store backed by an S3-compatible bucket. Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	// Endpoint is the base URL of the S3 API. It defaults to https://s3.{region}.amazonaws.com.
+	Endpoint string
+	// Region defaults to us-east-1.
+	Region string
+	Bucket string
+	// Prefix is prepended to every key.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Put buffers r in memory, since the payload hash is part of the request signature. Chart archives are small enough
+// that this isn't a concern.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+}
+
+func (s *S3) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, s3Error(resp)
+	}
+}
+
+// Object is an entry of a bucket listing.
+type Object struct {
+	// Key is relative to the store's Prefix.
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		ETag         string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the objects whose keys start with prefix, following continuation tokens until the listing is complete.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	full := prefix
+	if s.Prefix != "" {
+		full = s.Prefix + "/" + prefix
+	}
+	q := url.Values{"list-type": {"2"}, "prefix": {full}}
+	var out []Object
+	for {
+		resp, err := s.request(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode bucket listing")
+		}
+		for _, c := range result.Contents {
+			key := c.Key
+			if s.Prefix != "" {
+				key = strings.TrimPrefix(key, s.Prefix+"/")
+			}
+			out = append(out, Object{
+				Key:          key,
+				ETag:         strings.Trim(c.ETag, `"`),
+				Size:         c.Size,
+				LastModified: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return out, nil
+		}
+		q.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// URL returns the path-style URL of key.
+func (s *S3) URL(key string) string {
+	k := key
+	if s.Prefix != "" {
+		k = s.Prefix + "/" + k
+	}
+	return s.bucketURL() + "/" + (&url.URL{Path: k}).EscapedPath()
+}
+
+func (s *S3) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	k, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.Prefix != "" {
+		k = s.Prefix + "/" + k
+	}
+	return s.request(ctx, method, "/"+k, nil, body)
+}
+
+// request sends a signed request for path, relative to the bucket.
+func (s *S3) request(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	region := s.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	u, err := url.Parse(s.bucketURL() + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	signV4(req, body, s.AccessKeyID, s.SecretAccessKey, region, time.Now())
+
+	c := s.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return c.Do(req)
+}
+
+func (s *S3) bucketURL() string {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		region := s.Region
+		if region == "" {
+			region = defaultS3Region
+		}
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + s.Bucket
+}
+
+// canonicalQuery encodes query as AWS expects, with spaces escaped as %20 rather than +.
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req. The host, range, content-type and x-amz-*
+// headers are signed.
+func signV4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region string, t time.Time) {
+	t = t.UTC()
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{t.Format("20060102"), region, "s3", "aws4_request"}, "/")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Error(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return errors.Errorf("s3: %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(b))
+}
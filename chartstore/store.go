@@ -0,0 +1,116 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chartstore stores cached chart archives and provenance files, so that the marketplace can serve charts to
+// clusters that can't reach the upstream repositories.
+package chartstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Get when the key doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is a flat key/value store for chart files. Keys are slash-separated relative paths, e.g.
+// "stable/mysql-1.6.0.tgz".
+type Store interface {
+	// Put writes the contents of r to key, replacing any existing file.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens key for reading. It returns ErrNotFound if key doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Exists reports whether key exists.
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// New returns the Store described by rawurl:
+//
+//   /var/lib/marketplace/charts
+//   file:///var/lib/marketplace/charts
+//   s3://bucket/prefix?region=us-east-1&endpoint=http://minio.minio-system:9000
+//
+// S3 credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables. Requests use path-style addressing, so S3-compatible stores such as MinIO work without DNS setup.
+func New(rawurl string) (Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		return NewDir(u.Path)
+	case "s3":
+		s, err := s3FromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		s.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		return s, nil
+	default:
+		return nil, errors.Errorf("unsupported chart store scheme %q", u.Scheme)
+	}
+}
+
+// ParseS3URL returns the S3 store described by an s3://bucket/prefix?region=&endpoint= URL, as accepted by New. The
+// store has no credentials.
+func ParseS3URL(rawurl string) (*S3, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" {
+		return nil, errors.Errorf("%q is not an s3 url", rawurl)
+	}
+	return s3FromURL(u)
+}
+
+func s3FromURL(u *url.URL) (*S3, error) {
+	if u.Host == "" {
+		return nil, errors.Errorf("missing bucket in %q", u.String())
+	}
+	q := u.Query()
+	return &S3{
+		Endpoint: q.Get("endpoint"),
+		Region:   q.Get("region"),
+		Bucket:   u.Host,
+		Prefix:   strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// ChartKey is where a chart version's archive is stored. Its provenance file is stored next to it with a .prov
+// suffix, which is where helm looks for it when verifying.
+func ChartKey(source, chart, version string) string {
+	return path.Join(source, fmt.Sprintf("%s-%s.tgz", chart, version))
+}
+
+// cleanKey validates key, rejecting anything that could escape the store's root.
+func cleanKey(key string) (string, error) {
+	k := path.Clean("/" + key)[1:]
+	if k == "" || k != key {
+		return "", errors.Errorf("invalid key %q", key)
+	}
+	return k, nil
+}
@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// NewCache builds the manager's cache, which holds ConfigMaps of the categories ConfigMap's namespace only. The
+// categories ConfigMap is the only one read through the cache; helm release ConfigMaps are watched by the release
+// controller with an informer of its own.
+func NewCache(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+	c, err := cache.New(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.Namespace = catalog.CategoriesConfigMapNamespace
+	configMaps, err := cache.New(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &configMapCache{Cache: c, configMaps: configMaps}, nil
+}
+
+// configMapCache serves ConfigMaps from configMaps and everything else from Cache.
+type configMapCache struct {
+	cache.Cache
+	configMaps cache.Cache
+}
+
+var configMapKind = corev1.SchemeGroupVersion.WithKind("ConfigMap")
+
+func isConfigMap(obj runtime.Object) bool {
+	switch obj.(type) {
+	case *corev1.ConfigMap, *corev1.ConfigMapList:
+		return true
+	}
+	return false
+}
+
+func (c *configMapCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if isConfigMap(obj) {
+		return c.configMaps.Get(ctx, key, obj)
+	}
+	return c.Cache.Get(ctx, key, obj)
+}
+
+func (c *configMapCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if isConfigMap(list) {
+		return c.configMaps.List(ctx, list, opts...)
+	}
+	return c.Cache.List(ctx, list, opts...)
+}
+
+func (c *configMapCache) GetInformer(ctx context.Context, obj runtime.Object) (cache.Informer, error) {
+	if isConfigMap(obj) {
+		return c.configMaps.GetInformer(ctx, obj)
+	}
+	return c.Cache.GetInformer(ctx, obj)
+}
+
+func (c *configMapCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk == configMapKind {
+		return c.configMaps.GetInformerForKind(ctx, gvk)
+	}
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+func (c *configMapCache) IndexField(ctx context.Context, obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	if isConfigMap(obj) {
+		return c.configMaps.IndexField(ctx, obj, field, extractValue)
+	}
+	return c.Cache.IndexField(ctx, obj, field, extractValue)
+}
+
+func (c *configMapCache) Start(stop <-chan struct{}) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.configMaps.Start(stop)
+	}()
+	if err := c.Cache.Start(stop); err != nil {
+		return err
+	}
+	return <-errCh
+}
+
+func (c *configMapCache) WaitForCacheSync(stop <-chan struct{}) bool {
+	return c.Cache.WaitForCacheSync(stop) && c.configMaps.WaitForCacheSync(stop)
+}
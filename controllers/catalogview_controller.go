@@ -0,0 +1,173 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// CatalogViewReconciler reconciles a CatalogView object
+type CatalogViewReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=catalogviews,verbs=get;list;watch
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=catalogviews/status,verbs=get;update;patch
+
+func (r *CatalogViewReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("catalogview", req.NamespacedName)
+
+	var view marketplacev1alpha2.CatalogView
+	if err := r.Get(ctx, req.NamespacedName, &view); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	var ns corev1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: view.Namespace}, &ns); err != nil {
+		return ctrl.Result{}, err
+	}
+	rules, err := catalog.LoadVisibilityRules(ctx, r)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status, err := r.summarize(ctx, &ns, rules)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status.LastUpdate = view.Status.LastUpdate
+	if equality.Semantic.DeepEqual(status, view.Status) {
+		return ctrl.Result{}, nil
+	}
+	log.Info("catalog view changed", "apps", status.AppCount)
+	old := view.DeepCopy()
+	status.LastUpdate = metav1.Now()
+	view.Status = status
+	return ctrl.Result{}, r.Status().Patch(ctx, &view, client.MergeFrom(old))
+}
+
+// summarize lists the Applications visible from ns, and the NamespaceApplications in it.
+func (r *CatalogViewReconciler) summarize(ctx context.Context, ns *corev1.Namespace, rules *catalog.VisibilityRules) (marketplacev1alpha2.CatalogViewStatus, error) {
+	var status marketplacev1alpha2.CatalogViewStatus
+	var apps marketplacev1alpha3.ApplicationList
+	if err := r.List(ctx, &apps); err != nil {
+		return status, err
+	}
+	v := &catalog.Viewer{Namespaces: []corev1.Namespace{*ns}}
+	sources := make(map[string]bool)
+	categories := make(map[string]bool)
+	for i := range apps.Items {
+		app := &apps.Items[i]
+		if !rules.Visible(app, v) {
+			continue
+		}
+		status.Applications = append(status.Applications, app.Name)
+		if s := app.Labels[catalog.SourceLabel]; s != "" {
+			sources[s] = true
+		}
+		for _, c := range catalog.Categories(app) {
+			categories[c] = true
+		}
+	}
+	status.AppCount = len(status.Applications)
+	status.Sources = sortedKeys(sources)
+	status.Categories = sortedKeys(categories)
+	sort.Strings(status.Applications)
+
+	var nsApps marketplacev1alpha3.NamespaceApplicationList
+	if err := r.List(ctx, &nsApps, client.InNamespace(ns.Name)); err != nil {
+		return status, err
+	}
+	for _, app := range nsApps.Items {
+		status.NamespaceApplications = append(status.NamespaceApplications, app.Name)
+	}
+	sort.Strings(status.NamespaceApplications)
+	return status, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetupWithManager resyncs CatalogViews when anything that decides visibility changes: Sources, Applications, the
+// categories ConfigMap, and the labels of their Namespace. The manager's cache only holds ConfigMaps of the categories
+// ConfigMap's namespace, see NewCache.
+func (r *CatalogViewReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	all := &handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(func(handler.MapObject) []reconcile.Request {
+		return r.views("")
+	})}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&marketplacev1alpha2.CatalogView{}).
+		Watches(&source.Kind{Type: &marketplacev1alpha2.Source{}}, all).
+		Watches(&source.Kind{Type: &marketplacev1alpha3.Application{}}, all).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				if o.Meta.GetNamespace() != catalog.CategoriesConfigMapNamespace || o.Meta.GetName() != catalog.CategoriesConfigMapName {
+					return nil
+				}
+				return r.views("")
+			}),
+		}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				return r.views(o.Meta.GetName())
+			}),
+		}).
+		Watches(&source.Kind{Type: &marketplacev1alpha3.NamespaceApplication{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				return r.views(o.Meta.GetNamespace())
+			}),
+		}).
+		Complete(r)
+}
+
+// views returns requests for the CatalogViews in namespace, or in every namespace when it is empty.
+func (r *CatalogViewReconciler) views(namespace string) []reconcile.Request {
+	var list marketplacev1alpha2.CatalogViewList
+	if err := r.List(context.Background(), &list, client.InNamespace(namespace)); err != nil {
+		r.Log.Error(err, "failed to list catalog views")
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(list.Items))
+	for _, v := range list.Items {
+		reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: v.Namespace, Name: v.Name}})
+	}
+	return reqs
+}
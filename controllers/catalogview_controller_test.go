@@ -0,0 +1,121 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+var _ = Describe("CatalogView", func() {
+
+	ctx := context.Background()
+
+	app := func(source, chart string, labels map[string]string) *marketplacev1alpha3.Application {
+		a := &marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   source + "." + chart,
+				Labels: map[string]string{catalog.SourceLabel: source},
+			},
+			AppName: chart,
+		}
+		for k, v := range labels {
+			a.Labels[k] = v
+		}
+		return a
+	}
+
+	var (
+		r   *CatalogViewReconciler
+		key = types.NamespacedName{Namespace: "team-a", Name: "default"}
+	)
+
+	BeforeEach(func() {
+		s := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+		c := fake.NewFakeClientWithScheme(s,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+			&marketplacev1alpha2.CatalogView{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}},
+			&marketplacev1alpha2.Source{ObjectMeta: metav1.ObjectMeta{Name: "stable"}},
+			&marketplacev1alpha2.Source{
+				ObjectMeta: metav1.ObjectMeta{Name: "team-b"},
+				Spec: marketplacev1alpha2.SourceSpec{Visibility: &marketplacev1alpha2.Visibility{
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}},
+				}},
+			},
+			app("stable", "mysql", map[string]string{catalog.CategoryLabelPrefix + "database": ""}),
+			app("stable", "nginx", nil),
+			app("team-b", "tool", nil),
+			&marketplacev1alpha3.NamespaceApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "private.app"}},
+			&marketplacev1alpha3.NamespaceApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "private.tool"}},
+		)
+		r = &CatalogViewReconciler{Client: c, Log: logf.NullLogger{}, Scheme: s}
+	})
+
+	It("Should summarize the catalog visible from its namespace", func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		var view marketplacev1alpha2.CatalogView
+		Expect(r.Get(ctx, key, &view)).To(Succeed())
+		Expect(view.Status.AppCount).To(Equal(2))
+		Expect(view.Status.Applications).To(Equal([]string{"stable.mysql", "stable.nginx"}))
+		Expect(view.Status.NamespaceApplications).To(Equal([]string{"private.app"}))
+		Expect(view.Status.Sources).To(Equal([]string{"stable"}))
+		Expect(view.Status.Categories).To(Equal([]string{"database"}))
+		Expect(view.Status.LastUpdate.IsZero()).To(BeFalse())
+	})
+
+	It("Should only update the status when the catalog changes", func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		var before marketplacev1alpha2.CatalogView
+		Expect(r.Get(ctx, key, &before)).To(Succeed())
+
+		_, err = r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		var after marketplacev1alpha2.CatalogView
+		Expect(r.Get(ctx, key, &after)).To(Succeed())
+		Expect(after.ResourceVersion).To(Equal(before.ResourceVersion))
+
+		var ns corev1.Namespace
+		Expect(r.Get(ctx, client.ObjectKey{Name: "team-a"}, &ns)).To(Succeed())
+		ns.Labels["team"] = "b"
+		Expect(r.Update(ctx, &ns)).To(Succeed())
+		_, err = r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Get(ctx, key, &after)).To(Succeed())
+		Expect(after.Status.Applications).To(Equal([]string{"stable.mysql", "stable.nginx", "team-b.tool"}))
+	})
+})
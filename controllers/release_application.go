@@ -0,0 +1,113 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// chartDigestAnnotation may be set on a stored release by whatever installed it, to the digest of the chart archive
+// as the index of its Source records it, the hex encoded sha256 of the archive. helm doesn't record the digest itself,
+// and it's too long for a label. Since helm stores every revision in a Secret or ConfigMap of its own, installers
+// annotate each after installing or upgrading, for example:
+//
+//   kubectl annotate secret sh.helm.release.v1.db.v2 marketplace.criticalstack.com/chart.digest=<digest>
+//
+// Releases stored by helm's sql driver can't be annotated.
+const chartDigestAnnotation = "marketplace.criticalstack.com/chart.digest"
+
+// releaseApplication identifies the catalog Application a release was installed from, by the name and version of
+// its chart. When several Sources publish the version, the digest annotation and source label of the stored release
+// narrow them down; a release that still matches more than one Application isn't linked to any. The digest of the
+// reference is only set when the annotation confirmed it, since without it there is no telling which archive was
+// installed.
+func (r *ReleaseReconciler) releaseApplication(ctx context.Context, owner ownerObject, labels map[string]string, spec marketplacev1alpha2.ReleaseSpec) (*marketplacev1alpha2.ApplicationReference, error) {
+	if spec.Chart == nil || spec.Chart.Metadata == nil || spec.Chart.Metadata.Name == "" {
+		return nil, nil
+	}
+	md := spec.Chart.Metadata
+	var apps marketplacev1alpha3.ApplicationList
+	if err := r.List(ctx, &apps, client.MatchingLabels{catalog.AppNameLabel: md.Name}); err != nil {
+		return nil, err
+	}
+	var digest string
+	if owner != nil {
+		digest = owner.GetAnnotations()[chartDigestAnnotation]
+	}
+	source := labels[catalog.SourceLabel]
+
+	var refs []*marketplacev1alpha2.ApplicationReference
+	for i := range apps.Items {
+		app := &apps.Items[i]
+		if source != "" && app.Labels[catalog.SourceLabel] != source {
+			continue
+		}
+		for _, cv := range app.Versions {
+			if cv.Version != md.Version || (digest != "" && cv.Digest != digest) {
+				continue
+			}
+			refs = append(refs, &marketplacev1alpha2.ApplicationReference{
+				Name:    app.Name,
+				Source:  app.Labels[catalog.SourceLabel],
+				Version: cv.Version,
+				Digest:  digest,
+			})
+			break
+		}
+	}
+	if len(refs) != 1 {
+		return nil, nil
+	}
+	return refs[0], nil
+}
+
+// storedReleases maps an Application to the stored releases of its chart and those linked to it, so that releases
+// installed before their Source was synced are linked once it is, and links are cleared when the Application is
+// deleted or another Source starts publishing the same version.
+func (r *ReleaseReconciler) storedReleases(obj handler.MapObject) []reconcile.Request {
+	app, ok := obj.Object.(*marketplacev1alpha3.Application)
+	if !ok {
+		return nil
+	}
+	var releases marketplacev1alpha2.ReleaseList
+	if err := r.List(context.Background(), &releases); err != nil {
+		r.Log.Error(err, "unable to list releases")
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, rel := range releases.Items {
+		linked := rel.Status.Application != nil && rel.Status.Application.Name == app.Name
+		sameChart := rel.Spec.Chart != nil && rel.Spec.Chart.Metadata != nil &&
+			rel.Spec.Chart.Metadata.Name == app.Labels[catalog.AppNameLabel]
+		if !linked && !sameChart {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKey{
+			Namespace: rel.Namespace,
+			Name:      releaseStorageKey(rel.Spec.Name, rel.Spec.Version),
+		}})
+	}
+	return reqs
+}
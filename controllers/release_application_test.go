@@ -0,0 +1,154 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+var _ = Describe("Release application links", func() {
+
+	ctx := context.Background()
+
+	var (
+		s *runtime.Scheme
+		r *ReleaseReconciler
+	)
+
+	application := func(source, digest string) *marketplacev1alpha3.Application {
+		return &marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   source + ".mysql",
+				Labels: map[string]string{catalog.SourceLabel: source, catalog.AppNameLabel: "mysql"},
+			},
+			AppName: "mysql",
+			Versions: []marketplacev1alpha3.ChartVersion{
+				{Version: "1.6.5", URLs: []string{"mysql-1.6.5.tgz"}},
+				{Version: "1.6.6", URLs: []string{"mysql-1.6.6.tgz"}, Digest: digest},
+			},
+		}
+	}
+
+	reconcile := func(secret *corev1.Secret, objs ...runtime.Object) *marketplacev1alpha2.Release {
+		r = &ReleaseReconciler{
+			Client: fake.NewFakeClientWithScheme(s, append(objs, secret)...),
+			Log:    ctrl.Log.WithName("test"),
+			Scheme: s,
+		}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: secret.Namespace, Name: secret.Name}})
+		Expect(err).ToNot(HaveOccurred())
+		var rel marketplacev1alpha2.Release
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &rel)).To(Succeed())
+		return &rel
+	}
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+	})
+
+	It("links releases to the Application that publishes their chart version", func() {
+		rel := reconcile(releaseSecret("default", "mysql", "1.6.6"), application("stable", "abc"))
+		Expect(rel.Labels).To(HaveKeyWithValue(catalog.SourceLabel, "stable"))
+		Expect(rel.Labels).To(HaveKeyWithValue(catalog.AppNameLabel, "mysql"))
+		Expect(rel.Status.Application).To(Equal(&marketplacev1alpha2.ApplicationReference{
+			Name:    "stable.mysql",
+			Source:  "stable",
+			Version: "1.6.6",
+		}))
+	})
+
+	It("tells Sources publishing the same version apart by the chart digest", func() {
+		secret := releaseSecret("default", "mysql", "1.6.6")
+		secret.Annotations = map[string]string{chartDigestAnnotation: "def"}
+		rel := reconcile(secret, application("stable", "abc"), application("mirror", "def"))
+		Expect(rel.Labels).To(HaveKeyWithValue(catalog.SourceLabel, "mirror"))
+		Expect(rel.Status.Application.Name).To(Equal("mirror.mysql"))
+		Expect(rel.Status.Application.Digest).To(Equal("def"))
+	})
+
+	It("doesn't link releases that match several Applications or none", func() {
+		existing := &marketplacev1alpha2.Release{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "db",
+				Labels:    map[string]string{catalog.SourceLabel: "removed", catalog.AppNameLabel: "mysql"},
+			},
+		}
+		rel := reconcile(releaseSecret("default", "mysql", "1.6.6"), existing, application("stable", "abc"), application("mirror", "def"))
+		Expect(rel.Labels).ToNot(HaveKey(catalog.SourceLabel))
+		Expect(rel.Labels).ToNot(HaveKey(catalog.AppNameLabel))
+		Expect(rel.Status.Application).To(BeNil())
+
+		rel = reconcile(releaseSecret("default", "mysql", "2.0.0"), application("stable", "abc"))
+		Expect(rel.Status.Application).To(BeNil())
+	})
+
+	It("clears the link of releases whose Application is deleted", func() {
+		app := application("stable", "abc")
+		rel := reconcile(releaseSecret("default", "mysql", "1.6.6"), app)
+		Expect(rel.Status.Application.Name).To(Equal("stable.mysql"))
+
+		Expect(r.Delete(ctx, app)).To(Succeed())
+		reqs := r.storedReleases(handler.MapObject{Meta: app, Object: app})
+		Expect(reqs).To(HaveLen(1))
+		_, err := r.Reconcile(reqs[0])
+		Expect(err).ToNot(HaveOccurred())
+		var unlinked marketplacev1alpha2.Release
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &unlinked)).To(Succeed())
+		Expect(unlinked.Status.Application).To(BeNil())
+		Expect(unlinked.Labels).ToNot(HaveKey(catalog.SourceLabel))
+		Expect(unlinked.Labels).ToNot(HaveKey(catalog.AppNameLabel))
+	})
+
+	It("requeues the releases of an Application's chart", func() {
+		rel := reconcile(releaseSecret("default", "mysql", "1.6.6"))
+		Expect(rel.Status.Application).To(BeNil())
+
+		app := application("stable", "abc")
+		reqs := r.storedReleases(handler.MapObject{Meta: app, Object: app})
+		Expect(reqs).To(HaveLen(1))
+		Expect(reqs[0].NamespacedName).To(Equal(client.ObjectKey{Namespace: "default", Name: "sh.helm.release.v1.db.v1"}))
+
+		other := application("stable", "abc")
+		other.Labels[catalog.AppNameLabel] = "postgresql"
+		Expect(r.storedReleases(handler.MapObject{Meta: other, Object: other})).To(BeEmpty())
+
+		// linked releases are requeued too, since another Source publishing the version makes the link ambiguous
+		rel = reconcile(releaseSecret("default", "mysql", "1.6.6"), app)
+		Expect(rel.Status.Application).ToNot(BeNil())
+		mirror := application("mirror", "def")
+		Expect(r.storedReleases(handler.MapObject{Meta: mirror, Object: mirror})).To(HaveLen(1))
+	})
+})
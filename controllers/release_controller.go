@@ -19,7 +19,9 @@ package controllers
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"strings"
+	"time"
 
 	"compress/gzip"
 	"encoding/base64"
@@ -28,19 +30,54 @@ import (
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
 )
 
+const helmReleaseSecretType = "helm.sh/release.v1"
+
 // ReleaseReconciler reconciles a Release object
 type ReleaseReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// SQL is the database of helm's sql storage driver, polled every SQLPollInterval for releases when set.
+	SQL             *sql.DB
+	SQLPollInterval time.Duration
+	// Retention is how long Releases of releases uninstalled with their history kept remain as tombstones.
+	Retention time.Duration
+
+	// MirrorLevel is how much of each release is mirrored, the whole release when empty.
+	MirrorLevel marketplacev1alpha2.ReleaseMirrorLevel
+	// CompressManifests stores mirrored manifests gzipped, in spec.compressedManifest.
+	CompressManifests bool
+	// RedactValues are names or dotted paths of values that are redacted from mirrored values, in addition to those
+	// the chart's values schema marks sensitive and those named like credentials.
+	RedactValues []string
+	// ManifestURL is the base URL the catalog API serves the manifests of releases from, recorded on Releases that
+	// are mirrored without them.
+	ManifestURL string
+
+	secrets    corelisters.SecretLister
+	configMaps corelisters.ConfigMapLister
 }
 
 // +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=releases,verbs=get;list;watch;create;update;patch;delete
@@ -52,8 +89,8 @@ func (r *ReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	log.Info("reconcile release")
 
-	var secret corev1.Secret
-	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+	secret, err := r.getSecret(ctx, req.NamespacedName)
+	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
 			return ctrl.Result{}, nil
 		}
@@ -61,55 +98,136 @@ func (r *ReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
-	if secret.Type != "helm.sh/release.v1" {
+	// The labels helm sets on the Secret are enough to skip superseded revisions without decoding them.
+	if secret.Type != helmReleaseSecretType || !isStoredRelease(secret) {
 		return ctrl.Result{}, nil
 	}
 
-	decodedSecret, err := decodeSecretRelease(secret)
+	decodedSecret, err := decodeSecretRelease(*secret)
 	if err != nil {
 		log.Error(err, "unable to decode Secret")
 		return ctrl.Result{}, err
 	}
 
-	if decodedSecret.Info.Status == marketplacev1alpha2.StatusSuperseded {
+	result, err := r.mirrorRelease(ctx, log, secret, secret.Labels, decodedSecret)
+	if err != nil {
+		log.Error(err, "unable to create or update Release CRD")
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// mirrorRelease creates or updates the Release for a decoded helm release. Marketplace labels are copied from the
+// labels of the stored release, and the Release is owned by owner, if any, so that it is removed along with it.
+//
+// Releases uninstalled with their history kept are mirrored as tombstones, recording when they were uninstalled, and
+// deleted once the Retention period has passed. The returned result requeues the release until then.
+func (r *ReleaseReconciler) mirrorRelease(ctx context.Context, log logr.Logger, owner ownerObject, labels map[string]string, spec marketplacev1alpha2.ReleaseSpec) (ctrl.Result, error) {
+	if spec.Info != nil && spec.Info.Status == marketplacev1alpha2.StatusSuperseded {
 		return ctrl.Result{}, nil
 	}
 
 	var release marketplacev1alpha2.Release
-	release.Namespace = secret.Namespace
-	release.Labels = make(map[string]string)
-	for k, v := range secret.Labels {
-		if strings.HasPrefix(k, "marketplace.criticalstack.com/") {
-			release.Labels[k] = v
-		}
+	release.Namespace = spec.Namespace
+	if owner != nil {
+		release.Namespace = owner.GetNamespace()
 	}
-	release.Name = secret.Labels["name"]
+	release.Name = labels["name"]
 	if release.Name == "" {
-		log.V(1).Info("unable to get release name from secret")
+		release.Name = spec.Name
+	}
+	if release.Name == "" {
+		log.V(1).Info("unable to get release name")
 		return ctrl.Result{}, nil
 	}
 
-	release.Spec = decodedSecret
+	var uninstalledAt *metav1.Time
+	if spec.Info != nil && spec.Info.Status == marketplacev1alpha2.StatusUninstalled {
+		uninstalledAt = releaseDeletedAt(spec.Info)
+		if remaining := r.Retention - time.Since(uninstalledAt.Time); remaining <= 0 {
+			log.V(1).Info("deleting uninstalled release", "release", release.Name)
+			return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, &release))
+		}
+	}
+
+	mirrored, err := r.mirroredSpec(spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	app, err := r.releaseApplication(ctx, owner, labels, spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	_, err = ctrl.CreateOrUpdate(ctx, r.Client, &release, controllerutil.MutateFn(func() error {
-		if err := controllerutil.SetOwnerReference(&secret, &release, r.Scheme); err != nil {
-			return err
+		if release.Labels == nil {
+			release.Labels = make(map[string]string)
+		}
+		delete(release.Labels, catalog.SourceLabel)
+		delete(release.Labels, catalog.AppNameLabel)
+		for k, v := range labels {
+			if strings.HasPrefix(k, "marketplace.criticalstack.com/") {
+				release.Labels[k] = v
+			}
 		}
-		release.Spec = decodedSecret
+		if app != nil {
+			release.Labels[catalog.SourceLabel] = app.Source
+			release.Labels[catalog.AppNameLabel] = spec.Chart.Metadata.Name
+		}
+		if owner != nil {
+			if err := controllerutil.SetOwnerReference(owner, &release, r.Scheme); err != nil {
+				return err
+			}
+		}
+		release.Spec = mirrored
 
 		return nil
 	}))
 	if err != nil {
-		log.Error(err, "unable to create or update Release CRD")
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	status := marketplacev1alpha2.ReleaseStatus{
+		UninstalledAt: uninstalledAt,
+		MirrorLevel:   r.mirrorLevel(),
+		ManifestURL:   r.manifestURL(&release),
+		Application:   app,
+	}
+	if !equality.Semantic.DeepEqual(release.Status, status) {
+		release.Status = status
+		if err := r.Status().Update(ctx, &release); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if uninstalledAt == nil {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.Retention - time.Since(uninstalledAt.Time)}, nil
+}
+
+// releaseDeletedAt returns when helm uninstalled a release, falling back to now if it wasn't recorded. It is truncated
+// to seconds, like times of objects, so that it compares equal to the one recorded on the Release.
+func releaseDeletedAt(info *marketplacev1alpha2.Info) *metav1.Time {
+	t, err := time.Parse(time.RFC3339Nano, info.Deleted)
+	if err != nil || t.IsZero() {
+		t = time.Now()
+	}
+	return &metav1.Time{Time: t.Truncate(time.Second)}
 }
 
 func decodeSecretRelease(secret corev1.Secret) (marketplacev1alpha2.ReleaseSpec, error) {
+	return decodeRelease(secret.Data["release"])
+}
+
+func decodeConfigMapRelease(cm corev1.ConfigMap) (marketplacev1alpha2.ReleaseSpec, error) {
+	return decodeRelease([]byte(cm.Data["release"]))
+}
+
+// decodeRelease decodes a release as helm stores it with each of its storage drivers: base64 encoded, gzipped JSON.
+func decodeRelease(encodedRelease []byte) (marketplacev1alpha2.ReleaseSpec, error) {
 	var releaseSpec marketplacev1alpha2.ReleaseSpec
 
-	encodedRelease := secret.Data["release"]
 	strRel := string(encodedRelease)
 	dst, err := base64.StdEncoding.DecodeString(strRel)
 	if err != nil {
@@ -134,9 +252,152 @@ func decodeSecretRelease(secret corev1.Secret) (marketplacev1alpha2.ReleaseSpec,
 	return releaseSpec, nil
 }
 
+// configMapReleaseReconciler mirrors releases stored by helm's configmap driver, sharing the decoding of
+// ReleaseReconciler.
+type configMapReleaseReconciler struct {
+	*ReleaseReconciler
+}
+
+func (r *configMapReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("configmap", req.NamespacedName)
+
+	log.Info("reconcile release")
+
+	cm, err := r.getConfigMap(ctx, req.NamespacedName)
+	if err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "unable to get configmap")
+		return ctrl.Result{}, err
+	}
+
+	if !isStoredRelease(cm) {
+		return ctrl.Result{}, nil
+	}
+
+	decoded, err := decodeConfigMapRelease(*cm)
+	if err != nil {
+		log.Error(err, "unable to decode ConfigMap")
+		return ctrl.Result{}, err
+	}
+
+	result, err := r.mirrorRelease(ctx, log, cm, cm.Labels, decoded)
+	if err != nil {
+		log.Error(err, "unable to create or update Release CRD")
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// getSecret reads a Secret from the informer of helm release Secrets, or from the client when it isn't set up.
+func (r *ReleaseReconciler) getSecret(ctx context.Context, key client.ObjectKey) (*corev1.Secret, error) {
+	if r.secrets == nil {
+		var secret corev1.Secret
+		return &secret, r.Get(ctx, key, &secret)
+	}
+	secret, err := r.secrets.Secrets(key.Namespace).Get(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	return secret.DeepCopy(), nil
+}
+
+// getConfigMap reads a ConfigMap from the informer of helm release ConfigMaps, or from the client when it isn't set
+// up.
+func (r *ReleaseReconciler) getConfigMap(ctx context.Context, key client.ObjectKey) (*corev1.ConfigMap, error) {
+	if r.configMaps == nil {
+		var cm corev1.ConfigMap
+		return &cm, r.Get(ctx, key, &cm)
+	}
+	cm, err := r.configMaps.ConfigMaps(key.Namespace).Get(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	return cm.DeepCopy(), nil
+}
+
+// isStoredRelease reports whether obj holds a release stored by helm's secret or configmap driver that is mirrored,
+// using only the labels helm sets on it.
+func isStoredRelease(obj metav1.Object) bool {
+	labels := obj.GetLabels()
+	return labels["owner"] == "helm" && labels["status"] != string(marketplacev1alpha2.StatusSuperseded)
+}
+
+// SetupWithManager watches Secrets and ConfigMaps with informers of their own, limited to helm release Secrets and
+// ConfigMaps, rather than with the manager's cache, which would hold every Secret and ConfigMap of the cluster in
+// memory.
 func (r *ReleaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).
-		Owns(&marketplacev1alpha2.Release{}).
-		Complete(r)
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = "owner=helm"
+		opts.FieldSelector = fields.OneTermEqualSelector("type", helmReleaseSecretType).String()
+	}))
+	secrets := factory.Core().V1().Secrets()
+	r.secrets = secrets.Lister()
+	// ConfigMaps have no type to select on
+	configMapFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = "owner=helm"
+	}))
+	configMaps := configMapFactory.Core().V1().ConfigMaps()
+	r.configMaps = configMaps.Lister()
+
+	storedRelease := predicate.NewPredicateFuncs(func(meta metav1.Object, _ runtime.Object) bool {
+		return isStoredRelease(meta)
+	})
+	c, err := controller.New("release", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Informer{Informer: secrets.Informer()}, &handler.EnqueueRequestForObject{}, storedRelease); err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &marketplacev1alpha2.Release{}}, &handler.EnqueueRequestForOwner{
+		OwnerType:    &corev1.Secret{},
+		IsController: true,
+	})
+	if err != nil {
+		return err
+	}
+	storedReleases := &handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.storedReleases)}
+	if err := c.Watch(&source.Kind{Type: &marketplacev1alpha3.Application{}}, storedReleases); err != nil {
+		return err
+	}
+
+	c, err = controller.New("release-configmap", mgr, controller.Options{Reconciler: &configMapReleaseReconciler{r}})
+	if err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Informer{Informer: configMaps.Informer()}, &handler.EnqueueRequestForObject{}, storedRelease); err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &marketplacev1alpha2.Release{}}, &handler.EnqueueRequestForOwner{
+		OwnerType:    &corev1.ConfigMap{},
+		IsController: true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Kind{Type: &marketplacev1alpha3.Application{}}, storedReleases); err != nil {
+		return err
+	}
+
+	err = mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		factory.Start(stop)
+		configMapFactory.Start(stop)
+		<-stop
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+	if r.SQL != nil {
+		return mgr.Add(&sqlReleasePoller{r})
+	}
+	return nil
 }
@@ -139,7 +139,8 @@ func createSecretJSON(key types.NamespacedName, appName string, releaseEnc strin
 			Name:      key.Name,
 			Namespace: key.Namespace,
 			Labels: map[string]string{
-				"name": appName,
+				"name":  appName,
+				"owner": "helm",
 			},
 		},
 		Data: map[string][]byte{
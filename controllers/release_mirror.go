@@ -0,0 +1,189 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+func (r *ReleaseReconciler) mirrorLevel() marketplacev1alpha2.ReleaseMirrorLevel {
+	if r.MirrorLevel == "" {
+		return marketplacev1alpha2.ReleaseMirrorFull
+	}
+	return r.MirrorLevel
+}
+
+// mirroredSpec returns the part of spec that is mirrored at the MirrorLevel of the controller. The manifest, hook
+// manifests and chart templates are what makes releases of big charts exceed the size limit of objects, so they are
+// only mirrored in full, and the manifest is compressed if CompressManifests is set. Sensitive values, the data of
+// rendered Secrets and the values of those Secrets in the release notes are redacted.
+func (r *ReleaseReconciler) mirroredSpec(spec marketplacev1alpha2.ReleaseSpec) (marketplacev1alpha2.ReleaseSpec, error) {
+	level := r.mirrorLevel()
+	var sr secretRedactor
+	spec.Manifest = sr.redactManifest(spec.Manifest)
+	var hooks []*marketplacev1alpha2.Hook
+	for _, h := range spec.Hooks {
+		if h == nil {
+			continue
+		}
+		hook := *h
+		hook.Manifest = sr.redactManifest(hook.Manifest)
+		hooks = append(hooks, &hook)
+	}
+	spec.Hooks = hooks
+	if spec.Info != nil {
+		info := *spec.Info
+		info.Notes = sr.redactNotes(info.Notes)
+		spec.Info = &info
+	}
+	if level != marketplacev1alpha2.ReleaseMirrorMetadata {
+		var schema []byte
+		if spec.Chart != nil {
+			schema = spec.Chart.Schema
+		}
+		config, err := redactValues(spec.Config, schema, r.RedactValues)
+		if err != nil {
+			return spec, errors.Wrap(err, "cannot redact values")
+		}
+		spec.Config = config
+	}
+	if level == marketplacev1alpha2.ReleaseMirrorFull {
+		if !r.CompressManifests || spec.Manifest == "" {
+			return spec, nil
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(spec.Manifest)); err != nil {
+			return spec, err
+		}
+		if err := zw.Close(); err != nil {
+			return spec, err
+		}
+		spec.Manifest = ""
+		spec.CompressedManifest = buf.Bytes()
+		return spec, nil
+	}
+
+	mirrored := marketplacev1alpha2.ReleaseSpec{
+		Name:      spec.Name,
+		Info:      spec.Info,
+		Version:   spec.Version,
+		Namespace: spec.Namespace,
+	}
+	if spec.Chart != nil {
+		mirrored.Chart = &marketplacev1alpha2.Chart{
+			Metadata: spec.Chart.Metadata,
+			Lock:     spec.Chart.Lock,
+		}
+	}
+	for _, h := range spec.Hooks {
+		h.Manifest = ""
+		mirrored.Hooks = append(mirrored.Hooks, h)
+	}
+	if level == marketplacev1alpha2.ReleaseMirrorValues {
+		mirrored.Config = spec.Config
+	}
+	return mirrored, nil
+}
+
+// manifestURL returns where the catalog API serves the manifest of rel, when it isn't mirrored.
+func (r *ReleaseReconciler) manifestURL(rel *marketplacev1alpha2.Release) string {
+	if r.ManifestURL == "" || r.mirrorLevel() == marketplacev1alpha2.ReleaseMirrorFull {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s/manifest", strings.TrimSuffix(r.ManifestURL, "/"), rel.Namespace, rel.Name)
+}
+
+// ReleaseManifests reads the manifests of releases from where helm stores them, for Releases that are mirrored
+// without them.
+type ReleaseManifests struct {
+	// Client reads Releases and the Secrets and ConfigMaps releases are stored in. It should read from the API
+	// server, since the manager doesn't cache Secrets.
+	Client client.Reader
+	// SQL is the database of helm's sql storage driver, if releases are polled from it.
+	SQL *sql.DB
+}
+
+func (m *ReleaseManifests) Manifest(ctx context.Context, namespace, name string) (string, error) {
+	var rel marketplacev1alpha2.Release
+	if err := m.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &rel); err != nil {
+		return "", err
+	}
+	key := releaseStorageKey(rel.Spec.Name, rel.Spec.Version)
+
+	var (
+		spec marketplacev1alpha2.ReleaseSpec
+		err  error
+	)
+	switch {
+	case rel.Labels[releaseStorageLabel] == "sql":
+		if m.SQL == nil {
+			return "", errors.New("sql release storage is not configured")
+		}
+		var body string
+		err = m.SQL.QueryRowContext(ctx, `SELECT body FROM releases_v1 WHERE key = $1 AND namespace = $2`, key, namespace).Scan(&body)
+		if err == sql.ErrNoRows {
+			return "", apierrors.NewNotFound(marketplacev1alpha2.GroupVersion.WithResource("releases").GroupResource(), name)
+		}
+		if err != nil {
+			return "", err
+		}
+		spec, err = decodeRelease([]byte(body))
+	case ownedBy(&rel, "ConfigMap"):
+		var cm corev1.ConfigMap
+		if err := m.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: key}, &cm); err != nil {
+			return "", err
+		}
+		spec, err = decodeConfigMapRelease(cm)
+	default:
+		var secret corev1.Secret
+		if err := m.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: key}, &secret); err != nil {
+			return "", err
+		}
+		spec, err = decodeSecretRelease(secret)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot decode release %s", key)
+	}
+	return spec.Manifest, nil
+}
+
+// releaseStorageKey returns the name helm stores a revision of a release under, whichever driver stores it.
+func releaseStorageKey(name string, version int) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, version)
+}
+
+func ownedBy(rel *marketplacev1alpha2.Release, kind string) bool {
+	for _, ref := range rel.OwnerReferences {
+		if ref.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("Release mirroring", func() {
+
+	ctx := context.Background()
+
+	var s *runtime.Scheme
+
+	spec := marketplacev1alpha2.ReleaseSpec{
+		Name:      "db",
+		Namespace: "default",
+		Version:   1,
+		Info:      &marketplacev1alpha2.Info{Status: marketplacev1alpha2.StatusDeployed},
+		Chart: &marketplacev1alpha2.Chart{
+			Metadata:  &marketplacev1alpha2.Metadata{Name: "mysql", Version: "1.6.6"},
+			Templates: []*marketplacev1alpha2.File{{Name: "templates/secret.yaml", Data: []byte("kind: Secret")}},
+		},
+		Config:   &runtime.RawExtension{Raw: []byte(`{"replicas":2}`)},
+		Manifest: "kind: Secret\n",
+		Hooks:    []*marketplacev1alpha2.Hook{{Name: "migrate", Kind: "Job", Manifest: "kind: Job\n"}},
+	}
+
+	secret := func() *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "sh.helm.release.v1.db.v1",
+				Labels:    map[string]string{"owner": "helm", "name": "db", "status": "deployed"},
+			},
+			Type: helmReleaseSecretType,
+			Data: map[string][]byte{"release": encodeRelease(spec)},
+		}
+	}
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+		stubReleaseRows = nil
+	})
+
+	It("mirrors only metadata, leaving out values, manifests and templates", func() {
+		r := &ReleaseReconciler{MirrorLevel: marketplacev1alpha2.ReleaseMirrorMetadata}
+		mirrored, err := r.mirroredSpec(spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirrored.Config).To(BeNil())
+		Expect(mirrored.Manifest).To(BeEmpty())
+		Expect(mirrored.Chart.Metadata.Name).To(Equal("mysql"))
+		Expect(mirrored.Chart.Templates).To(BeEmpty())
+		Expect(mirrored.Hooks).To(HaveLen(1))
+		Expect(mirrored.Hooks[0].Name).To(Equal("migrate"))
+		Expect(mirrored.Hooks[0].Manifest).To(BeEmpty())
+		Expect(spec.Hooks[0].Manifest).ToNot(BeEmpty())
+	})
+
+	It("mirrors values along with metadata", func() {
+		r := &ReleaseReconciler{MirrorLevel: marketplacev1alpha2.ReleaseMirrorValues}
+		mirrored, err := r.mirroredSpec(spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirrored.Config.Raw).To(MatchJSON(`{"replicas":2}`))
+		Expect(mirrored.Manifest).To(BeEmpty())
+	})
+
+	It("compresses the manifests of releases mirrored in full", func() {
+		r := &ReleaseReconciler{CompressManifests: true}
+		mirrored, err := r.mirroredSpec(spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirrored.Manifest).To(BeEmpty())
+		Expect(mirrored.Chart.Templates).To(HaveLen(1))
+		zr, err := gzip.NewReader(bytes.NewReader(mirrored.CompressedManifest))
+		Expect(err).ToNot(HaveOccurred())
+		b, err := ioutil.ReadAll(zr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(b)).To(Equal(spec.Manifest))
+	})
+
+	It("redacts the data of rendered Secrets from manifests, hooks and notes", func() {
+		spec := *spec.DeepCopy()
+		spec.Manifest = "---\n# Source: mysql/templates/secret.yaml\napiVersion: v1\nkind: Secret\nmetadata:\n  name: db\n" +
+			"data:\n  mysql-root-password: aHVudGVyMg==\n---\n# Source: mysql/templates/svc.yaml\nkind: Service\n"
+		spec.Hooks[0].Manifest = "kind: Secret\nstringData:\n  token: s3cr3t-token\n"
+		spec.Info.Notes = "Log in with the password hunter2 or the token s3cr3t-token."
+		r := &ReleaseReconciler{}
+		mirrored, err := r.mirroredSpec(spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirrored.Manifest).To(Equal("---\n# Source: mysql/templates/secret.yaml\napiVersion: v1\n" +
+			"data:\n  mysql-root-password: UkVEQUNURUQ=\nkind: Secret\nmetadata:\n  name: db\n" +
+			"---\n# Source: mysql/templates/svc.yaml\nkind: Service\n"))
+		Expect(mirrored.Hooks[0].Manifest).To(Equal("kind: Secret\nstringData:\n  token: REDACTED\n"))
+		Expect(mirrored.Info.Notes).To(Equal("Log in with the password REDACTED or the token REDACTED."))
+		Expect(spec.Hooks[0].Manifest).To(ContainSubstring("s3cr3t-token"))
+		Expect(spec.Info.Notes).To(ContainSubstring("hunter2"))
+	})
+
+	It("records where the manifest of partially mirrored releases is served", func() {
+		r := &ReleaseReconciler{
+			Client:      fake.NewFakeClientWithScheme(s, secret()),
+			Log:         ctrl.Log.WithName("test"),
+			Scheme:      s,
+			MirrorLevel: marketplacev1alpha2.ReleaseMirrorMetadata,
+			ManifestURL: "http://catalog/api/v1/releases/",
+		}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "sh.helm.release.v1.db.v1"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		var rel marketplacev1alpha2.Release
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &rel)).To(Succeed())
+		Expect(rel.Spec.Manifest).To(BeEmpty())
+		Expect(rel.Status.MirrorLevel).To(Equal(marketplacev1alpha2.ReleaseMirrorMetadata))
+		Expect(rel.Status.ManifestURL).To(Equal("http://catalog/api/v1/releases/default/db/manifest"))
+
+		m := &ReleaseManifests{Client: r.Client}
+		manifest, err := m.Manifest(ctx, "default", "db")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest).To(Equal(spec.Manifest))
+	})
+
+	It("reads the manifests of SQL-stored releases from the database", func() {
+		rel := &marketplacev1alpha2.Release{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "db",
+				Labels:    map[string]string{releaseStorageLabel: "sql"},
+			},
+			Spec: marketplacev1alpha2.ReleaseSpec{Name: "db", Namespace: "default", Version: 1},
+		}
+		db, err := sql.Open("releasestub", "")
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		stubReleaseRows = []string{string(encodeRelease(spec))}
+
+		m := &ReleaseManifests{Client: fake.NewFakeClientWithScheme(s, rel), SQL: db}
+		manifest, err := m.Manifest(ctx, "default", "db")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest).To(Equal(spec.Manifest))
+
+		_, err = m.Manifest(ctx, "default", "missing")
+		Expect(err).To(HaveOccurred())
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+	})
+})
@@ -0,0 +1,222 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-logr/logr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+)
+
+// ReleasePolicyPath is where the release policy webhook is served.
+const ReleasePolicyPath = "/validate-helm-release"
+
+// ReleasePolicyWebhook rejects helm releases that violate a MarketplacePolicy. Helm writes every revision of a
+// release as a new Secret, so only creates are checked; status updates of existing revisions, including uninstalls,
+// are always allowed.
+type ReleasePolicyWebhook struct {
+	client.Client
+	Log logr.Logger
+}
+
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=marketplacepolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (w *ReleasePolicyWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(ReleasePolicyPath, &webhook.Admission{Handler: w})
+	return nil
+}
+
+func (w *ReleasePolicyWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create {
+		return admission.Allowed("")
+	}
+	var secret corev1.Secret
+	if err := json.Unmarshal(req.Object.Raw, &secret); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if secret.Type != helmReleaseSecretType {
+		return admission.Allowed("")
+	}
+	rel, err := decodeSecretRelease(secret)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if rel.Chart == nil || rel.Chart.Metadata == nil {
+		return admission.Denied("release has no chart metadata")
+	}
+	namespace := rel.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	violations, err := w.check(ctx, namespace, rel.Chart.Metadata)
+	if err != nil {
+		w.Log.Error(err, "failed to evaluate marketplace policies", "release", rel.Name, "namespace", namespace)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(violations) > 0 {
+		return admission.Denied(fmt.Sprintf("release %s of chart %s %s violates marketplace policy: %s",
+			rel.Name, rel.Chart.Metadata.Name, rel.Chart.Metadata.Version, strings.Join(violations, "; ")))
+	}
+	return admission.Allowed("")
+}
+
+// check evaluates every policy that applies to namespace, returning the violations prefixed with the policy name.
+func (w *ReleasePolicyWebhook) check(ctx context.Context, namespace string, md *marketplacev1alpha2.Metadata) ([]string, error) {
+	var policies marketplacev1alpha2.MarketplacePolicyList
+	if err := w.List(ctx, &policies); err != nil {
+		return nil, err
+	}
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+	var ns corev1.Namespace
+	if err := w.Get(ctx, client.ObjectKey{Name: namespace}, &ns); err != nil {
+		return nil, err
+	}
+	var apps marketplacev1alpha3.ApplicationList
+	if err := w.List(ctx, &apps, client.MatchingLabels{"marketplace.criticalstack.com/application.name": md.Name}); err != nil {
+		return nil, err
+	}
+	sort.Slice(apps.Items, func(i, j int) bool { return apps.Items[i].Name < apps.Items[j].Name })
+
+	var violations []string
+	for _, p := range policies.Items {
+		if p.Spec.NamespaceSelector != nil {
+			sel, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("%s: invalid namespaceSelector: %v", p.Name, err))
+				continue
+			}
+			if !sel.Matches(labels.Set(ns.Labels)) {
+				continue
+			}
+		}
+		for _, v := range evaluatePolicy(&p.Spec, md, apps.Items) {
+			violations = append(violations, p.Name+": "+v)
+		}
+	}
+	return violations, nil
+}
+
+// evaluatePolicy returns the reasons a chart violates policy. A chart version may be published by several Sources;
+// it is allowed when any of the catalog Applications that have the version satisfies the policy. Versions are matched
+// by name and version only, since a release doesn't carry the digest of the archive its chart was installed from.
+func evaluatePolicy(policy *marketplacev1alpha2.MarketplacePolicySpec, md *marketplacev1alpha2.Metadata, apps []marketplacev1alpha3.Application) []string {
+	var violations []string
+	if c, ok := policy.VersionConstraints[md.Name]; ok {
+		if constraint, err := semver.NewConstraint(c); err != nil {
+			violations = append(violations, fmt.Sprintf("invalid version constraint %q: %v", c, err))
+		} else if v, err := semver.NewVersion(md.Version); err != nil || !constraint.Check(v) {
+			violations = append(violations, fmt.Sprintf("version %s does not satisfy %q", md.Version, c))
+		}
+	}
+
+	needsCatalog := policy.RequireCatalog || len(policy.AllowedSources) > 0 || len(policy.AllowedCategories) > 0 ||
+		policy.DenyDeprecated || policy.DenyRemoved || policy.RequireProvenance
+	if len(policy.AllowedCharts) == 0 && !needsCatalog {
+		return violations
+	}
+
+	var best []string
+	found := false
+	for i := range apps {
+		app := &apps[i]
+		var cv *marketplacev1alpha3.ChartVersion
+		for j := range app.Versions {
+			if app.Versions[j].Version == md.Version {
+				cv = &app.Versions[j]
+				break
+			}
+		}
+		if cv == nil {
+			continue
+		}
+		appViolations := evaluateApplication(policy, md, app, cv)
+		if !found || len(appViolations) < len(best) {
+			best = appViolations
+		}
+		found = true
+	}
+	switch {
+	case found:
+		violations = append(violations, best...)
+	case needsCatalog:
+		violations = append(violations, fmt.Sprintf("chart %s %s is not in the marketplace catalog", md.Name, md.Version))
+	case !contains(policy.AllowedCharts, md.Name):
+		violations = append(violations, fmt.Sprintf("chart %s is not allowed", md.Name))
+	}
+	return violations
+}
+
+// evaluateApplication checks the rules that depend on the catalog against one Application's version of the chart.
+func evaluateApplication(policy *marketplacev1alpha2.MarketplacePolicySpec, md *marketplacev1alpha2.Metadata, app *marketplacev1alpha3.Application, cv *marketplacev1alpha3.ChartVersion) []string {
+	var violations []string
+	source := app.Labels[catalog.SourceLabel]
+	if len(policy.AllowedCharts) > 0 && !contains(policy.AllowedCharts, md.Name) && !contains(policy.AllowedCharts, app.Name) {
+		violations = append(violations, fmt.Sprintf("chart %s is not allowed", app.Name))
+	}
+	if len(policy.AllowedSources) > 0 && !contains(policy.AllowedSources, source) {
+		violations = append(violations, fmt.Sprintf("source %s is not allowed", source))
+	}
+	if len(policy.AllowedCategories) > 0 {
+		allowed := false
+		for _, c := range catalog.Categories(app) {
+			allowed = allowed || contains(policy.AllowedCategories, c)
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s is not in an allowed category", app.Name))
+		}
+	}
+	if policy.DenyDeprecated && cv.Deprecated {
+		violations = append(violations, fmt.Sprintf("%s %s is deprecated", app.Name, cv.Version))
+	}
+	if policy.DenyRemoved && cv.Removed != nil && *cv.Removed {
+		violations = append(violations, fmt.Sprintf("%s %s has been removed", app.Name, cv.Version))
+	}
+	if policy.RequireProvenance && !cv.Provenance {
+		violations = append(violations, fmt.Sprintf("%s %s has no provenance file", app.Name, cv.Version))
+	}
+	return violations
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// encodeRelease stores rel the way helm's Secret driver does: gzipped JSON, base64 encoded in the release key.
+func encodeRelease(rel marketplacev1alpha2.ReleaseSpec) []byte {
+	b, err := json.Marshal(rel)
+	Expect(err).ToNot(HaveOccurred())
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(b)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(zw.Close()).To(Succeed())
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func releaseSecret(namespace, chartName, version string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.db.v1",
+			Namespace: namespace,
+			Labels:    map[string]string{"owner": "helm", "name": "db"},
+		},
+		Type: "helm.sh/release.v1",
+		Data: map[string][]byte{"release": encodeRelease(marketplacev1alpha2.ReleaseSpec{
+			Name:      "db",
+			Namespace: namespace,
+			Version:   1,
+			Info:      &marketplacev1alpha2.Info{Status: marketplacev1alpha2.StatusPendingInstall},
+			Chart: &marketplacev1alpha2.Chart{
+				Metadata: &marketplacev1alpha2.Metadata{Name: chartName, Version: version},
+			},
+		})},
+	}
+}
+
+var _ = Describe("Release policy webhook", func() {
+
+	ctx := context.Background()
+	yes := true
+
+	var (
+		s    *runtime.Scheme
+		objs []runtime.Object
+	)
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+		objs = []runtime.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"env": "prod"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"env": "dev"}}},
+			&marketplacev1alpha3.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: "stable.mysql", Labels: map[string]string{
+					"marketplace.criticalstack.com/source.name":                   "stable",
+					"marketplace.criticalstack.com/application.name":              "mysql",
+					"marketplace.criticalstack.com/application.category.database": "",
+				}},
+				AppName: "mysql",
+				Versions: []marketplacev1alpha3.ChartVersion{
+					{Version: "1.3.0", Deprecated: true},
+					{Version: "1.6.0", Provenance: true},
+					{Version: "1.6.1", Removed: &yes},
+				},
+			},
+			&marketplacev1alpha3.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: "incubator.mysql", Labels: map[string]string{
+					"marketplace.criticalstack.com/source.name":      "incubator",
+					"marketplace.criticalstack.com/application.name": "mysql",
+				}},
+				AppName:  "mysql",
+				Versions: []marketplacev1alpha3.ChartVersion{{Version: "2.0.0"}},
+			},
+		}
+	})
+
+	review := func(op admissionv1beta1.Operation, secret *corev1.Secret, policies ...marketplacev1alpha2.MarketplacePolicySpec) admission.Response {
+		for i, p := range policies {
+			objs = append(objs, &marketplacev1alpha2.MarketplacePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: []string{"first", "second"}[i]},
+				Spec:       p,
+			})
+		}
+		w := &ReleasePolicyWebhook{Client: fake.NewFakeClientWithScheme(s, objs...), Log: logf.NullLogger{}}
+		raw, err := json.Marshal(secret)
+		Expect(err).ToNot(HaveOccurred())
+		return w.Handle(ctx, admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: op,
+			Namespace: secret.Namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+	}
+
+	It("Should allow releases when there are no policies", func() {
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "unknown", "0.1.0")).Allowed).To(BeTrue())
+	})
+
+	It("Should only check new release revisions", func() {
+		policy := marketplacev1alpha2.MarketplacePolicySpec{RequireCatalog: true}
+		Expect(review(admissionv1beta1.Update, releaseSecret("prod", "unknown", "0.1.0"), policy).Allowed).To(BeTrue())
+	})
+
+	It("Should reject charts that aren't in the catalog", func() {
+		resp := review(admissionv1beta1.Create, releaseSecret("prod", "unknown", "0.1.0"),
+			marketplacev1alpha2.MarketplacePolicySpec{RequireCatalog: true})
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("first: chart unknown 0.1.0 is not in the marketplace catalog"))
+	})
+
+	It("Should reject deprecated, removed and unsigned versions", func() {
+		policy := marketplacev1alpha2.MarketplacePolicySpec{DenyDeprecated: true, DenyRemoved: true, RequireProvenance: true}
+		resp := review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.3.0"), policy)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("stable.mysql 1.3.0 is deprecated"))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("stable.mysql 1.3.0 has no provenance file"))
+
+		resp = review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.6.1"))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("stable.mysql 1.6.1 has been removed"))
+
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.6.0")).Allowed).To(BeTrue())
+	})
+
+	It("Should restrict sources, categories, charts and versions", func() {
+		policy := marketplacev1alpha2.MarketplacePolicySpec{
+			AllowedSources:     []string{"stable"},
+			AllowedCategories:  []string{"database"},
+			VersionConstraints: map[string]string{"mysql": ">= 1.5.0"},
+		}
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.6.0"), policy).Allowed).To(BeTrue())
+
+		resp := review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "2.0.0"))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("source incubator is not allowed"))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("incubator.mysql is not in an allowed category"))
+
+		resp = review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.3.0"))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring(`version 1.3.0 does not satisfy ">= 1.5.0"`))
+	})
+
+	It("Should allow listed charts by chart or application name", func() {
+		policy := marketplacev1alpha2.MarketplacePolicySpec{AllowedCharts: []string{"incubator.mysql", "redis"}}
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "2.0.0"), policy).Allowed).To(BeTrue())
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "redis", "10.0.0")).Allowed).To(BeTrue())
+		resp := review(admissionv1beta1.Create, releaseSecret("prod", "mysql", "1.6.0"))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("chart stable.mysql is not allowed"))
+		Expect(review(admissionv1beta1.Create, releaseSecret("prod", "nginx", "1.0.0")).Allowed).To(BeFalse())
+	})
+
+	It("Should only apply policies to selected namespaces", func() {
+		resp := review(admissionv1beta1.Create, releaseSecret("prod", "unknown", "0.1.0"),
+			marketplacev1alpha2.MarketplacePolicySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}},
+				RequireCatalog:    true,
+			},
+			marketplacev1alpha2.MarketplacePolicySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "dev"}},
+				AllowedCharts:     []string{"mysql"},
+			})
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("first:"))
+		Expect(string(resp.Result.Reason)).ToNot(ContainSubstring("second:"))
+
+		Expect(review(admissionv1beta1.Create, releaseSecret("dev", "mysql", "2.0.0")).Allowed).To(BeTrue())
+	})
+
+	It("Should ignore other secrets", func() {
+		secret := releaseSecret("prod", "unknown", "0.1.0")
+		secret.Type = corev1.SecretTypeOpaque
+		secret.Data["release"] = []byte("not a release")
+		Expect(review(admissionv1beta1.Create, secret, marketplacev1alpha2.MarketplacePolicySpec{RequireCatalog: true}).Allowed).To(BeTrue())
+	})
+})
@@ -0,0 +1,272 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// redactedValue replaces sensitive values in the config of mirrored releases.
+const redactedValue = "REDACTED"
+
+// sensitiveKeyPatterns are substrings of the names of values that hold credentials, matched against names lowercased
+// and stripped of - and _. Names that refer to where a credential is, like existingSecret or passwordFile, are left
+// alone.
+var (
+	sensitiveKeyPatterns = []string{"password", "passwd", "secret", "token", "credential", "apikey", "privatekey", "accesskey"}
+	referenceKeyPrefixes = []string{"existing"}
+	referenceKeySuffixes = []string{"name", "ref", "file", "path"}
+)
+
+// redactValues returns config with its sensitive values replaced by redactedValue, so that they aren't readable by
+// everyone who may read Releases. Values are sensitive when schema, the values.schema.json of the chart, marks them
+// writeOnly or with format password, when their name or dotted path is in denied, or when they are scalars named like
+// a credential, except booleans and numbers.
+func redactValues(config *runtime.RawExtension, schema []byte, denied []string) (*runtime.RawExtension, error) {
+	if config == nil || len(config.Raw) == 0 {
+		return config, nil
+	}
+	var values interface{}
+	if err := json.Unmarshal(config.Raw, &values); err != nil {
+		return nil, err
+	}
+	var s *valuesSchema
+	if len(schema) > 0 {
+		// An invalid schema only disables schema based redaction, helm would have refused values it doesn't accept.
+		if err := json.Unmarshal(schema, &s); err != nil {
+			s = nil
+		}
+	}
+	rd := &redactor{denied: make(map[string]bool)}
+	for _, d := range denied {
+		rd.denied[strings.ToLower(d)] = true
+	}
+	b, err := json.Marshal(rd.redact("", "", values, s))
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.RawExtension{Raw: b}, nil
+}
+
+// valuesSchema is the part of a JSON schema that marks values sensitive.
+type valuesSchema struct {
+	Properties           map[string]*valuesSchema `json:"properties,omitempty"`
+	AdditionalProperties json.RawMessage          `json:"additionalProperties,omitempty"`
+	Items                json.RawMessage          `json:"items,omitempty"`
+	WriteOnly            bool                     `json:"writeOnly,omitempty"`
+	Format               string                   `json:"format,omitempty"`
+}
+
+func (s *valuesSchema) sensitive() bool {
+	return s != nil && (s.WriteOnly || s.Format == "password")
+}
+
+func (s *valuesSchema) property(name string) *valuesSchema {
+	if s == nil {
+		return nil
+	}
+	if p, ok := s.Properties[name]; ok {
+		return p
+	}
+	return subschema(s.AdditionalProperties)
+}
+
+func (s *valuesSchema) item() *valuesSchema {
+	if s == nil {
+		return nil
+	}
+	return subschema(s.Items)
+}
+
+// subschema decodes keywords that are either a schema or something else, like a boolean additionalProperties or a
+// list of items schemas, which aren't followed.
+func subschema(raw json.RawMessage) *valuesSchema {
+	var s *valuesSchema
+	if len(raw) == 0 || json.Unmarshal(raw, &s) != nil {
+		return nil
+	}
+	return s
+}
+
+type redactor struct {
+	denied map[string]bool
+}
+
+func (rd *redactor) redact(path, key string, v interface{}, s *valuesSchema) interface{} {
+	if v == nil {
+		return nil
+	}
+	if s.sensitive() || rd.denied[strings.ToLower(path)] || rd.denied[strings.ToLower(key)] {
+		return redactedValue
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			v[k] = rd.redact(p, k, child, s.property(k))
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rd.redact(path, key, child, s.item())
+		}
+		return v
+	case string:
+		if sensitiveKey(key) {
+			return redactedValue
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+	for _, p := range referenceKeyPrefixes {
+		if strings.HasPrefix(key, p) {
+			return false
+		}
+	}
+	for _, s := range referenceKeySuffixes {
+		if strings.HasSuffix(key, s) {
+			return false
+		}
+	}
+	for _, p := range sensitiveKeyPatterns {
+		if strings.Contains(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestSeparator separates the documents of rendered manifests, like helm's releaseutil.SplitManifests.
+var manifestSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// minRedactedSecretLength is the length under which values of Secrets aren't redacted from release notes, so that
+// short values like "true" or "80" don't redact unrelated words.
+const minRedactedSecretLength = 4
+
+// secretRedactor redacts the data of Secrets from rendered manifests, remembering it so that it can also be redacted
+// from the release notes, which charts often use to print generated passwords.
+type secretRedactor struct {
+	values map[string]bool
+}
+
+// redactManifest returns manifest with the data and stringData of its Secrets replaced by redactedValue. Documents
+// other than Secrets are left as they are.
+func (sr *secretRedactor) redactManifest(manifest string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range manifestSeparator.FindAllStringIndex(manifest, -1) {
+		b.WriteString(sr.redactDocument(manifest[last:loc[0]]))
+		b.WriteString(manifest[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(sr.redactDocument(manifest[last:]))
+	return b.String()
+}
+
+func (sr *secretRedactor) redactDocument(doc string) string {
+	var obj struct {
+		Kind       string                 `json:"kind"`
+		Data       map[string]string      `json:"data"`
+		StringData map[string]interface{} `json:"stringData"`
+	}
+	if err := yaml.Unmarshal([]byte(doc), &obj); err != nil || obj.Kind != "Secret" {
+		return doc
+	}
+	if len(obj.Data) == 0 && len(obj.StringData) == 0 {
+		return doc
+	}
+	var full map[string]interface{}
+	if err := yaml.Unmarshal([]byte(doc), &full); err != nil {
+		return doc
+	}
+	if sr.values == nil {
+		sr.values = make(map[string]bool)
+	}
+	if len(obj.Data) > 0 {
+		// data stays base64 encoded so that the redacted Secret is still valid
+		redacted := make(map[string]string, len(obj.Data))
+		for k, v := range obj.Data {
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				sr.values[string(b)] = true
+			}
+			redacted[k] = base64.StdEncoding.EncodeToString([]byte(redactedValue))
+		}
+		full["data"] = redacted
+	}
+	if len(obj.StringData) > 0 {
+		redacted := make(map[string]string, len(obj.StringData))
+		for k, v := range obj.StringData {
+			if v, ok := v.(string); ok {
+				sr.values[v] = true
+			}
+			redacted[k] = redactedValue
+		}
+		full["stringData"] = redacted
+	}
+	b, err := yaml.Marshal(full)
+	if err != nil {
+		return doc
+	}
+
+	// keep the "# Source:" comments helm adds in front of every document
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(doc, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		out.WriteString(line)
+	}
+	out.Write(b)
+	return out.String()
+}
+
+// redactNotes returns notes with the values of the Secrets redacted so far replaced by redactedValue.
+func (sr *secretRedactor) redactNotes(notes string) string {
+	var values []string
+	for v := range sr.values {
+		if len(v) >= minRedactedSecretLength {
+			values = append(values, v)
+		}
+	}
+	// longest first, so that values containing others are redacted whole
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	for _, v := range values {
+		notes = strings.ReplaceAll(notes, v, redactedValue)
+	}
+	return notes
+}
@@ -0,0 +1,84 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+var _ = Describe("Release value redaction", func() {
+
+	redact := func(values, schema string, denied ...string) string {
+		config, err := redactValues(&runtime.RawExtension{Raw: []byte(values)}, []byte(schema), denied)
+		Expect(err).ToNot(HaveOccurred())
+		return string(config.Raw)
+	}
+
+	It("redacts values the chart schema marks sensitive", func() {
+		schema := `{
+			"properties": {
+				"auth": {
+					"properties": {
+						"rootPassword": {"type": "string", "format": "password"},
+						"users": {"type": "array", "items": {"properties": {"pass": {"writeOnly": true}}}}
+					}
+				},
+				"tls": {"writeOnly": true}
+			}
+		}`
+		values := `{"auth":{"rootPassword":"hunter2","users":[{"name":"app","pass":"s3cret"}]},"tls":{"cert":"abc"},"replicas":2}`
+		Expect(redact(values, schema)).To(MatchJSON(
+			`{"auth":{"rootPassword":"REDACTED","users":[{"name":"app","pass":"REDACTED"}]},"tls":"REDACTED","replicas":2}`,
+		))
+	})
+
+	It("redacts strings named like credentials, but not references to them", func() {
+		values := `{
+			"db": {"password": "hunter2", "api_key": "k", "existingSecret": "db-creds", "passwordFile": "/etc/pw"},
+			"enablePasswordAuth": true,
+			"tokens": ["a", "b"],
+			"image": "mysql:8"
+		}`
+		Expect(redact(values, "")).To(MatchJSON(`{
+			"db": {"password": "REDACTED", "api_key": "REDACTED", "existingSecret": "db-creds", "passwordFile": "/etc/pw"},
+			"enablePasswordAuth": true,
+			"tokens": ["REDACTED", "REDACTED"],
+			"image": "mysql:8"
+		}`))
+	})
+
+	It("redacts values in the deny list by name or path", func() {
+		values := `{"ldap":{"bind":"cn=admin","url":"ldap://x"},"smtp":{"url":"smtp://u:p@x"},"url":"http://x"}`
+		Expect(redact(values, "not a schema", "ldap.bind", "SMTP")).To(MatchJSON(
+			`{"ldap":{"bind":"REDACTED","url":"ldap://x"},"smtp":"REDACTED","url":"http://x"}`,
+		))
+	})
+
+	It("redacts mirrored release values", func() {
+		r := &ReleaseReconciler{MirrorLevel: marketplacev1alpha2.ReleaseMirrorValues}
+		mirrored, err := r.mirroredSpec(marketplacev1alpha2.ReleaseSpec{
+			Name:   "db",
+			Config: &runtime.RawExtension{Raw: []byte(`{"mysqlRootPassword":"hunter2"}`)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirrored.Config.Raw).To(MatchJSON(`{"mysqlRootPassword":"REDACTED"}`))
+	})
+})
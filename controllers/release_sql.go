@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+const (
+	releaseStorageLabel = "marketplace.criticalstack.com/release.storage"
+
+	// sqlReleaseQuery selects the releases stored by helm's sql driver, in the releases_v1 table it creates. Each
+	// revision is a row, so only the latest of each release is kept.
+	sqlReleaseQuery = `SELECT body FROM releases_v1 WHERE owner = 'helm' AND status <> 'superseded' ORDER BY namespace, name, version`
+)
+
+// sqlReleasePoller periodically mirrors the releases of helm's sql storage driver. Unlike Secrets and ConfigMaps
+// there is nothing to watch, nor to own the Releases, so those that are no longer stored are deleted by the poller.
+type sqlReleasePoller struct {
+	*ReleaseReconciler
+}
+
+func (p *sqlReleasePoller) Start(stop <-chan struct{}) error {
+	interval := p.SQLPollInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.poll(context.Background()); err != nil {
+			p.Log.Error(err, "unable to poll sql releases")
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll mirrors every stored release and deletes the Releases previously mirrored from releases that are gone.
+func (p *sqlReleasePoller) poll(ctx context.Context) error {
+	log := p.Log.WithValues("storage", "sql")
+
+	rows, err := p.SQL.QueryContext(ctx, sqlReleaseQuery)
+	if err != nil {
+		return errors.Wrap(err, "cannot query releases")
+	}
+	defer rows.Close()
+
+	latest := make(map[client.ObjectKey]marketplacev1alpha2.ReleaseSpec)
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return errors.Wrap(err, "cannot read release")
+		}
+		spec, err := decodeRelease([]byte(body))
+		if err != nil {
+			log.Error(err, "unable to decode release")
+			continue
+		}
+		key := client.ObjectKey{Namespace: spec.Namespace, Name: spec.Name}
+		if prev, ok := latest[key]; !ok || spec.Version >= prev.Version {
+			latest[key] = spec
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "cannot read releases")
+	}
+
+	for key, spec := range latest {
+		labels := map[string]string{"name": key.Name, releaseStorageLabel: "sql"}
+		if _, err := p.mirrorRelease(ctx, log, nil, labels, spec); err != nil {
+			log.Error(err, "unable to create or update Release CRD", "release", key)
+		}
+	}
+
+	var releases marketplacev1alpha2.ReleaseList
+	if err := p.List(ctx, &releases, client.MatchingLabels{releaseStorageLabel: "sql"}); err != nil {
+		return err
+	}
+	for i := range releases.Items {
+		rel := &releases.Items[i]
+		if _, ok := latest[client.ObjectKey{Namespace: rel.Namespace, Name: rel.Name}]; ok {
+			continue
+		}
+		if err := p.Delete(ctx, rel); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to delete Release CRD", "release", rel.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// stubReleaseRows are the release bodies returned by the stub sql driver, standing in for helm's releases_v1 table.
+var stubReleaseRows []string
+
+func init() {
+	sql.Register("releasestub", stubDriver{})
+}
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) { return stubConn{}, nil }
+
+type stubConn struct{}
+
+func (stubConn) Prepare(query string) (driver.Stmt, error) { return stubStmt{}, nil }
+func (stubConn) Close() error                              { return nil }
+func (stubConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type stubStmt struct{}
+
+func (stubStmt) Close() error                               { return nil }
+func (stubStmt) NumInput() int                              { return -1 }
+func (stubStmt) Exec([]driver.Value) (driver.Result, error) { return nil, driver.ErrSkip }
+func (stubStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &stubRows{rows: stubReleaseRows}, nil
+}
+
+type stubRows struct {
+	rows []string
+}
+
+func (r *stubRows) Columns() []string { return []string{"body"} }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.rows[0]
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func storedRelease(namespace, name string, version int, status marketplacev1alpha2.Status) string {
+	return string(encodeRelease(marketplacev1alpha2.ReleaseSpec{
+		Name:      name,
+		Namespace: namespace,
+		Version:   version,
+		Info:      &marketplacev1alpha2.Info{Status: status},
+		Chart: &marketplacev1alpha2.Chart{
+			Metadata: &marketplacev1alpha2.Metadata{Name: "mysql", Version: "1.6.6"},
+		},
+	}))
+}
+
+var _ = Describe("Release storage", func() {
+
+	ctx := context.Background()
+
+	var s *runtime.Scheme
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+		stubReleaseRows = nil
+	})
+
+	reconciler := func(objs ...runtime.Object) *ReleaseReconciler {
+		return &ReleaseReconciler{
+			Client: fake.NewFakeClientWithScheme(s, objs...),
+			Log:    ctrl.Log.WithName("test"),
+			Scheme: s,
+		}
+	}
+
+	It("decodes releases stored in ConfigMaps like those in Secrets", func() {
+		encoded := storedRelease("default", "db", 2, marketplacev1alpha2.StatusDeployed)
+		fromCM, err := decodeConfigMapRelease(corev1.ConfigMap{Data: map[string]string{"release": encoded}})
+		Expect(err).ToNot(HaveOccurred())
+		fromSecret, err := decodeSecretRelease(corev1.Secret{Data: map[string][]byte{"release": []byte(encoded)}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fromCM).To(Equal(fromSecret))
+		Expect(fromCM.Name).To(Equal("db"))
+		Expect(fromCM.Version).To(Equal(2))
+	})
+
+	It("mirrors ConfigMap-stored releases as Releases owned by the ConfigMap", func() {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "sh.helm.release.v1.db.v2",
+				Labels: map[string]string{
+					"owner":                           "helm",
+					"name":                            "db",
+					"marketplace.criticalstack.com/x": "y",
+				},
+			},
+			Data: map[string]string{"release": storedRelease("default", "db", 2, marketplacev1alpha2.StatusDeployed)},
+		}
+		r := &configMapReleaseReconciler{reconciler(cm)}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: cm.Name}})
+		Expect(err).ToNot(HaveOccurred())
+
+		var rel marketplacev1alpha2.Release
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &rel)).To(Succeed())
+		Expect(rel.Spec.Version).To(Equal(2))
+		Expect(rel.Labels).To(HaveKeyWithValue("marketplace.criticalstack.com/x", "y"))
+		Expect(rel.OwnerReferences).To(HaveLen(1))
+		Expect(rel.OwnerReferences[0].Kind).To(Equal("ConfigMap"))
+		Expect(rel.OwnerReferences[0].Name).To(Equal(cm.Name))
+	})
+
+	It("ignores ConfigMaps that aren't stored by helm", func() {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", Labels: map[string]string{"name": "db"}},
+			Data:       map[string]string{"release": "not a release"},
+		}
+		r := &configMapReleaseReconciler{reconciler(cm)}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "db"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		var releases marketplacev1alpha2.ReleaseList
+		Expect(r.List(ctx, &releases)).To(Succeed())
+		Expect(releases.Items).To(BeEmpty())
+	})
+
+	It("mirrors the latest revision of SQL-stored releases and removes those that are gone", func() {
+		stale := &marketplacev1alpha2.Release{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "old",
+				Labels:    map[string]string{releaseStorageLabel: "sql"},
+			},
+		}
+		secretBacked := &marketplacev1alpha2.Release{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		}
+		r := reconciler(stale, secretBacked)
+		db, err := sql.Open("releasestub", "")
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		r.SQL = db
+
+		stubReleaseRows = []string{
+			storedRelease("default", "db", 1, marketplacev1alpha2.StatusFailed),
+			storedRelease("default", "db", 3, marketplacev1alpha2.StatusDeployed),
+			storedRelease("kube-system", "dns", 1, marketplacev1alpha2.StatusDeployed),
+		}
+		Expect((&sqlReleasePoller{r}).poll(ctx)).To(Succeed())
+
+		var rel marketplacev1alpha2.Release
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &rel)).To(Succeed())
+		Expect(rel.Spec.Version).To(Equal(3))
+		Expect(rel.Labels).To(HaveKeyWithValue(releaseStorageLabel, "sql"))
+		Expect(rel.OwnerReferences).To(BeEmpty())
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "kube-system", Name: "dns"}, &rel)).To(Succeed())
+		Expect(r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "web"}, &rel)).To(Succeed())
+
+		err = r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "old"}, &rel)
+		Expect(err).To(HaveOccurred())
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+	})
+})
+
+var _ = Describe("Release lifecycle", func() {
+
+	ctx := context.Background()
+
+	var (
+		s *runtime.Scheme
+		r *ReleaseReconciler
+	)
+
+	secret := func(labels map[string]string, info *marketplacev1alpha2.Info) *corev1.Secret {
+		labels["owner"] = "helm"
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sh.helm.release.v1.db.v2", Labels: labels},
+			Type:       "helm.sh/release.v1",
+			Data: map[string][]byte{"release": encodeRelease(marketplacev1alpha2.ReleaseSpec{
+				Name:      "db",
+				Namespace: "default",
+				Version:   2,
+				Info:      info,
+			})},
+		}
+	}
+
+	reconcile := func(objs ...runtime.Object) (ctrl.Result, error) {
+		r = &ReleaseReconciler{
+			Client:    fake.NewFakeClientWithScheme(s, objs...),
+			Log:       ctrl.Log.WithName("test"),
+			Scheme:    s,
+			Retention: time.Hour,
+		}
+		return r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "sh.helm.release.v1.db.v2"}})
+	}
+
+	getRelease := func() (*marketplacev1alpha2.Release, error) {
+		var rel marketplacev1alpha2.Release
+		err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "db"}, &rel)
+		return &rel, err
+	}
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+	})
+
+	It("derives the name from the release when the name label is missing", func() {
+		_, err := reconcile(secret(map[string]string{}, &marketplacev1alpha2.Info{Status: marketplacev1alpha2.StatusDeployed}))
+		Expect(err).ToNot(HaveOccurred())
+		rel, err := getRelease()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rel.Spec.Version).To(Equal(2))
+		Expect(rel.Status.UninstalledAt).To(BeNil())
+	})
+
+	It("keeps releases uninstalled with their history as tombstones during the retention period", func() {
+		deleted := time.Now().Add(-10 * time.Minute).UTC()
+		result, err := reconcile(secret(map[string]string{"name": "db"}, &marketplacev1alpha2.Info{
+			Status:  marketplacev1alpha2.StatusUninstalled,
+			Deleted: deleted.Format(time.RFC3339Nano),
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically("~", 50*time.Minute, time.Minute))
+
+		rel, err := getRelease()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rel.Status.UninstalledAt).ToNot(BeNil())
+		Expect(rel.Status.UninstalledAt.Unix()).To(Equal(deleted.Unix()))
+	})
+
+	It("deletes tombstones once the retention period has passed", func() {
+		existing := &marketplacev1alpha2.Release{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+		result, err := reconcile(existing, secret(map[string]string{"name": "db"}, &marketplacev1alpha2.Info{
+			Status:  marketplacev1alpha2.StatusUninstalled,
+			Deleted: time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano),
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeZero())
+
+		_, err = getRelease()
+		Expect(err).To(HaveOccurred())
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+	})
+
+	It("clears the tombstone when the release is installed again", func() {
+		existing := &marketplacev1alpha2.Release{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Status:     marketplacev1alpha2.ReleaseStatus{UninstalledAt: &metav1.Time{Time: time.Now()}},
+		}
+		_, err := reconcile(existing, secret(map[string]string{"name": "db"}, &marketplacev1alpha2.Info{Status: marketplacev1alpha2.StatusDeployed}))
+		Expect(err).ToNot(HaveOccurred())
+		rel, err := getRelease()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rel.Status.UninstalledAt).To(BeNil())
+	})
+})
+
+var _ = Describe("Release secret filtering", func() {
+
+	var s *runtime.Scheme
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+	})
+
+	It("only mirrors releases helm stores that aren't superseded", func() {
+		Expect(isStoredRelease(&metav1.ObjectMeta{Labels: map[string]string{"owner": "helm", "status": "deployed"}})).To(BeTrue())
+		Expect(isStoredRelease(&metav1.ObjectMeta{Labels: map[string]string{"owner": "helm", "status": "superseded"}})).To(BeFalse())
+		Expect(isStoredRelease(&metav1.ObjectMeta{Labels: map[string]string{"name": "db"}})).To(BeFalse())
+	})
+
+	It("reads Secrets from the informer and skips superseded ones without decoding them", func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		Expect(indexer.Add(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "sh.helm.release.v1.db.v1",
+				Labels:    map[string]string{"owner": "helm", "name": "db", "status": "superseded"},
+			},
+			Type: helmReleaseSecretType,
+			Data: map[string][]byte{"release": []byte("not a release")},
+		})).To(Succeed())
+		current := releaseSecret("default", "mysql", "1.6.6")
+		current.Name = "sh.helm.release.v1.db.v2"
+		Expect(indexer.Add(current)).To(Succeed())
+
+		r := &ReleaseReconciler{
+			Client:  fake.NewFakeClientWithScheme(s),
+			Log:     ctrl.Log.WithName("test"),
+			Scheme:  s,
+			secrets: corelisters.NewSecretLister(indexer),
+		}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "sh.helm.release.v1.db.v1"}})
+		Expect(err).ToNot(HaveOccurred())
+		var releases marketplacev1alpha2.ReleaseList
+		Expect(r.List(context.Background(), &releases)).To(Succeed())
+		Expect(releases.Items).To(BeEmpty())
+
+		_, err = r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "sh.helm.release.v1.db.v2"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.List(context.Background(), &releases)).To(Succeed())
+		Expect(releases.Items).To(HaveLen(1))
+		Expect(releases.Items[0].Name).To(Equal("db"))
+
+		_, err = r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "missing"}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,198 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// cacheChart copies the archive of cv, and its provenance file if the repository has one, into the chart store and
+// points cv's URLs at ChartStoreURL. Archives that are already stored aren't downloaded again. Downloaded archives
+// must match the digest from the repository index, when it has one.
+func (r *SourceReconciler) cacheChart(ctx context.Context, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion) error {
+	if len(cv.URLs) == 0 {
+		return errors.New("chart version has no urls")
+	}
+	key := chartstore.ChartKey(sourceKey(src), chartName, cv.Version)
+	ok, err := r.ChartStore.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		data, err := fetchChartFile(ctx, src, cv.URLs[0])
+		if err != nil {
+			return err
+		}
+		if cv.Digest != "" {
+			sum := sha256.Sum256(data)
+			if digest := hex.EncodeToString(sum[:]); digest != cv.Digest {
+				return errors.Errorf("digest mismatch for %s: expected %s, got %s", cv.URLs[0], cv.Digest, digest)
+			}
+		}
+		if prov, err := fetchChartFile(ctx, src, cv.URLs[0]+".prov"); err == nil {
+			if err := r.ChartStore.Put(ctx, key+".prov", bytes.NewReader(prov)); err != nil {
+				return err
+			}
+		}
+		// the archive is written last, so that its presence means the version is completely cached
+		if err := r.ChartStore.Put(ctx, key, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	prov, err := r.ChartStore.Exists(ctx, key+".prov")
+	if err != nil {
+		return err
+	}
+	cv.Provenance = prov
+	cv.UpstreamURLs = cv.URLs
+	cv.URLs = []string{strings.TrimSuffix(r.ChartStoreURL, "/") + "/" + key}
+	return nil
+}
+
+// uncacheChart restores the upstream URLs of a cached chart version.
+func uncacheChart(cv *marketplacev1alpha3.ChartVersion) {
+	cv.URLs = cv.UpstreamURLs
+	cv.UpstreamURLs = nil
+	cv.Provenance = false
+}
+
+// fetchChartFile downloads u, see openChartFile.
+func fetchChartFile(ctx context.Context, src *marketplacev1alpha2.Source, u string) ([]byte, error) {
+	rc, err := openChartFile(ctx, src, u)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// openChartFile opens u for reading, with the Source's credentials when u is on the Source's own scheme and host.
+// file:// URLs are only read for directory Sources, and must be inside the Source's directory, so that a repository
+// index can't be used to read the manager's files. Objects in the bucket of an s3:// Source are read with signed
+// requests. HTTP responses are streamed; other schemes are read with helm's getters, which buffer the whole file.
+func openChartFile(ctx context.Context, src *marketplacev1alpha2.Source, u string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(src.Spec.URL, "s3://") {
+		store, err := sourceS3(src)
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.TrimPrefix(u, store.URL("")); key != u {
+			return store.Get(ctx, key)
+		}
+	}
+	if parsed.Scheme == "file" {
+		if src.Spec.Directory == "" {
+			return nil, errors.Errorf("%s: file urls are only allowed for directory sources", u)
+		}
+		dir, err := filepath.Abs(src.Spec.Directory)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, filepath.FromSlash(parsed.Path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("%s is outside of %s", u, src.Spec.Directory)
+		}
+		return os.Open(filepath.Join(dir, rel))
+	}
+	if parsed.Scheme == "http" || parsed.Scheme == "https" {
+		return getChartFile(ctx, src, parsed)
+	}
+	g, err := getter.All(&cli.EnvSettings{}).ByScheme(parsed.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	opts := []getter.Option{getter.WithTLSClientConfig("", "", src.Spec.CAFile)}
+	if sameOrigin(src, parsed) {
+		opts = []getter.Option{
+			getter.WithBasicAuth(src.Spec.Username, src.Spec.Password),
+			getter.WithTLSClientConfig(src.Spec.CertFile, src.Spec.KeyFile, src.Spec.CAFile),
+		}
+	}
+	// getters don't take a context, so its deadline bounds the request instead
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, getter.WithTimeout(time.Until(deadline)))
+	}
+	buf, err := g.Get(u, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// getChartFile requests u over HTTP, returning the response body.
+func getChartFile(ctx context.Context, src *marketplacev1alpha2.Source, u *url.URL) (io.ReadCloser, error) {
+	trusted := sameOrigin(src, u)
+	if !trusted {
+		// only the CA is used for other hosts
+		src = src.DeepCopy()
+		src.Spec.CertFile, src.Spec.KeyFile = "", ""
+	}
+	c, err := sourceHTTPClient(src)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if trusted && (src.Spec.Username != "" || src.Spec.Password != "") {
+		req.SetBasicAuth(src.Spec.Username, src.Spec.Password)
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("failed to fetch %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// sameOrigin reports whether u has the scheme and host of the Source's URL. Like helm without --pass-credentials, the
+// Source's credentials are only sent there, so that a repository index can't collect them by listing chart URLs on
+// another host.
+func sameOrigin(src *marketplacev1alpha2.Source, u *url.URL) bool {
+	base, err := url.Parse(src.Spec.URL)
+	if err != nil {
+		return false
+	}
+	return base.Scheme == u.Scheme && strings.EqualFold(base.Host, u.Host)
+}
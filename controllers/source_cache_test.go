@@ -0,0 +1,142 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+var _ = Describe("Chart caching", func() {
+
+	const busyboxDigest = "787e329ad25ac9398d56d85d9fd2085b91d3e752c3a118878a0543b08aa50fee"
+
+	ctx := context.Background()
+
+	var (
+		ts  *httptest.Server
+		dir string
+		r   *SourceReconciler
+		src *marketplacev1alpha2.Source
+	)
+
+	BeforeEach(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/", http.FileServer(http.Dir("testdata/marketplace-source/")))
+		mux.HandleFunc("/busybox-1.0.0.tgz.prov", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("-----BEGIN PGP SIGNED MESSAGE-----"))
+		})
+		ts = httptest.NewServer(mux)
+
+		var err error
+		dir, err = ioutil.TempDir("", "chartstore")
+		Expect(err).ToNot(HaveOccurred())
+		store, err := chartstore.NewDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		r = &SourceReconciler{
+			ChartStore:    store,
+			ChartStoreURL: "http://marketplace/charts/files/",
+		}
+		src = &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable"},
+			Spec:       marketplacev1alpha2.SourceSpec{URL: ts.URL, CacheCharts: true},
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("Should store the archive and provenance and rewrite urls", func() {
+		cv := &marketplacev1alpha3.ChartVersion{
+			Version: "1.0.0",
+			URLs:    []string{ts.URL + "/busybox-1.0.0.tgz"},
+			Digest:  busyboxDigest,
+		}
+		Expect(r.cacheChart(ctx, src, "busybox", cv)).To(Succeed())
+		Expect(cv.URLs).Should(Equal([]string{"http://marketplace/charts/files/stable/busybox-1.0.0.tgz"}))
+		Expect(cv.UpstreamURLs).Should(Equal([]string{ts.URL + "/busybox-1.0.0.tgz"}))
+		Expect(cv.Provenance).Should(BeTrue())
+
+		for _, key := range []string{"stable/busybox-1.0.0.tgz", "stable/busybox-1.0.0.tgz.prov"} {
+			ok, err := r.ChartStore.Exists(ctx, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).Should(BeTrue(), key)
+		}
+
+		uncacheChart(cv)
+		Expect(cv.URLs).Should(Equal([]string{ts.URL + "/busybox-1.0.0.tgz"}))
+		Expect(cv.UpstreamURLs).Should(BeNil())
+		Expect(cv.Provenance).Should(BeFalse())
+	})
+
+	It("Should reject archives that don't match the digest", func() {
+		cv := &marketplacev1alpha3.ChartVersion{
+			Version: "1.3.0",
+			URLs:    []string{ts.URL + "/mysql-1.3.0.tgz"},
+			Digest:  busyboxDigest,
+		}
+		Expect(r.cacheChart(ctx, src, "mysql", cv)).ShouldNot(Succeed())
+		Expect(cv.UpstreamURLs).Should(BeNil())
+		ok, err := r.ChartStore.Exists(ctx, "stable/mysql-1.3.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("Should cache charts without provenance", func() {
+		cv := &marketplacev1alpha3.ChartVersion{
+			Version: "1.3.0",
+			URLs:    []string{ts.URL + "/mysql-1.3.0.tgz"},
+		}
+		Expect(r.cacheChart(ctx, src, "mysql", cv)).To(Succeed())
+		Expect(cv.Provenance).Should(BeFalse())
+		Expect(cv.URLs).Should(Equal([]string{"http://marketplace/charts/files/stable/mysql-1.3.0.tgz"}))
+	})
+
+	It("Should only send credentials to the Source's host", func() {
+		var auth []string
+		foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = append(auth, r.Header.Get("Authorization"))
+			http.ServeFile(w, r, "testdata/marketplace-source/busybox-1.0.0.tgz")
+		}))
+		defer foreign.Close()
+		src.Spec.URL = foreign.URL + "/charts"
+		src.Spec.Username = "user"
+		src.Spec.Password = "secret"
+
+		_, err := fetchChartFile(ctx, src, foreign.URL+"/busybox-1.0.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		src.Spec.URL = ts.URL
+		_, err = fetchChartFile(ctx, src, foreign.URL+"/busybox-1.0.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth).Should(HaveLen(2))
+		Expect(auth[0]).ShouldNot(BeEmpty())
+		Expect(auth[1]).Should(BeEmpty())
+	})
+})
@@ -21,30 +21,49 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/chart"
-	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/repo"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/chartstore"
+	"github.com/criticalstack/marketplace/scan"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
-	defaultCategoriesConfigMapName = "marketplace-app-categories"
+	// sourceFieldManager is the field manager used when applying Applications.
+	sourceFieldManager = "marketplace-source-controller"
+
+	defaultMaxConcurrentWrites = 4
+	maxApplyAttempts           = 3
+	applyRetryBackoff          = 500 * time.Millisecond
+
+	// marketplaceLabelPrefix is the prefix of the labels the source controller sets on Applications.
+	marketplaceLabelPrefix = "marketplace.criticalstack.com/"
 )
 
 // SourceReconciler reconciles a Source object
@@ -53,11 +72,38 @@ type SourceReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
-	recorder record.EventRecorder
-
-	defaultCategories map[string][]string
+	// MaxConcurrentWrites bounds the number of Application writes in flight during a sync.
+	MaxConcurrentWrites int
+
+	// ChartStore holds chart archives of Sources with spec.cacheCharts. Caching is unavailable when it is nil.
+	ChartStore chartstore.Store
+	// ChartStoreURL is the base URL cached charts are served from.
+	ChartStoreURL string
+
+	// Scanner scans the images of Sources with spec.scanImages. Scanning is unavailable when it is nil.
+	Scanner scan.Scanner
+	// ScanInterval is how long a chart version's scan is kept before it is rescanned. Versions are only scanned once
+	// when it is zero.
+	ScanInterval time.Duration
+	// ScanWorkers is the number of chart versions scanned concurrently. Scans run in the background, so that a sync
+	// never waits for the scanner.
+	ScanWorkers int
+	// ScanTimeout bounds the scan of a chart version.
+	ScanTimeout time.Duration
+
+	recorder        record.EventRecorder
+	versions        discovery.ServerVersionInterface
+	apiReader       client.Reader
+	chartMetadata   chartMetadataCache
+	imagesExtracted versionSet
+	scans           *scanQueue
 }
 
+const (
+	defaultScanWorkers = 2
+	defaultScanTimeout = 10 * time.Minute
+)
+
 func parseCategories(s string) (map[string][]string, error) {
 	dec := yaml.NewYAMLOrJSONDecoder(strings.NewReader(s), 128)
 	var byCategory map[string][]string
@@ -75,20 +121,70 @@ func parseCategories(s string) (map[string][]string, error) {
 }
 
 func (r *SourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	err := ctrl.NewControllerManagedBy(mgr).
+	sources := ctrl.NewControllerManagedBy(mgr).
 		For(&marketplacev1alpha2.Source{}).
-		WithEventFilter(predicate.GenerationChangedPredicate{}).
-		Complete(r)
-	if err != nil {
+		WithEventFilter(predicate.GenerationChangedPredicate{})
+	namespaceSources := ctrl.NewControllerManagedBy(mgr).
+		For(&marketplacev1alpha2.NamespaceSource{}).
+		WithEventFilter(predicate.GenerationChangedPredicate{})
+	if r.Scanner != nil {
+		workers, timeout := r.ScanWorkers, r.ScanTimeout
+		if workers <= 0 {
+			workers = defaultScanWorkers
+		}
+		if timeout <= 0 {
+			timeout = defaultScanTimeout
+		}
+		r.scans = newScanQueue(r, workers, timeout)
+		if err := mgr.Add(r.scans); err != nil {
+			return err
+		}
+		// generic events pass the generation predicate, so completed scans sync their Source again
+		sources.Watches(&source.Channel{Source: r.scans.sources}, &handler.EnqueueRequestForObject{})
+		namespaceSources.Watches(&source.Channel{Source: r.scans.namespaceSources}, &handler.EnqueueRequestForObject{})
+	}
+	if err := sources.Complete(r); err != nil {
+		return err
+	}
+	if err := namespaceSources.Complete(&namespaceSourceReconciler{r}); err != nil {
 		return err
 	}
+	var err error
 	r.recorder = mgr.GetEventRecorderFor("source-controller")
-	return nil
+	// Index references are read without the cache so that reading a Secret index doesn't cache every Secret of the
+	// cluster, and because the cache only holds the ConfigMaps of the categories ConfigMap's namespace.
+	r.apiReader = mgr.GetAPIReader()
+	r.versions, err = discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	return err
 }
 
-func copyMaintainers(mm []*chart.Maintainer) (out []*marketplacev1alpha2.Maintainer) {
+// serverKubeVersion returns the cluster version as a plain major.minor.patch semver string, dropping any
+// distribution-specific pre-release or build suffix (e.g. "v1.18.9-eks-d1db3c") so that it can be checked against
+// chart kubeVersion constraints.
+func (r *SourceReconciler) serverKubeVersion() (string, error) {
+	info, err := r.versions.ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	v, err := semver.NewVersion(info.GitVersion)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot parse server version %q", info.GitVersion)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major(), v.Minor(), v.Patch()), nil
+}
+
+// kubeCompatible reports whether a chart's kubeVersion constraint is satisfied by the cluster version. Charts without
+// a constraint are compatible with every cluster.
+func kubeCompatible(constraint, kubeVersion string) bool {
+	if constraint == "" {
+		return true
+	}
+	return chartutil.IsCompatibleRange(constraint, kubeVersion)
+}
+
+func copyMaintainers(mm []*chart.Maintainer) (out []*marketplacev1alpha3.Maintainer) {
 	for _, m := range mm {
-		out = append(out, &marketplacev1alpha2.Maintainer{
+		out = append(out, &marketplacev1alpha3.Maintainer{
 			Name:  m.Name,
 			Email: m.Email,
 			URL:   m.URL,
@@ -97,26 +193,37 @@ func copyMaintainers(mm []*chart.Maintainer) (out []*marketplacev1alpha2.Maintai
 	return
 }
 
-func copyDependencies(dd []*chart.Dependency) (out []*marketplacev1alpha2.Dependency) {
+func copyDependencies(dd []*chart.Dependency) (out []*marketplacev1alpha3.Dependency) {
 	for _, d := range dd {
-		iv := make([]string, 0)
-		for _, v := range d.ImportValues {
-			iv = append(iv, fmt.Sprintf("%v", v))
-		}
-		out = append(out, &marketplacev1alpha2.Dependency{
+		out = append(out, &marketplacev1alpha3.Dependency{
 			Name:         d.Name,
 			Version:      d.Version,
 			Repository:   d.Repository,
 			Condition:    d.Condition,
 			Tags:         d.Tags,
 			Enabled:      d.Enabled,
-			ImportValues: iv,
+			ImportValues: copyImportValues(d.ImportValues),
 			Alias:        d.Alias,
 		})
 	}
 	return
 }
 
+// copyImportValues converts import-values entries, which are either a string or a map with child and parent keys.
+func copyImportValues(ivs []interface{}) (out []marketplacev1alpha3.ImportValue) {
+	for _, iv := range ivs {
+		switch v := iv.(type) {
+		case string:
+			out = append(out, marketplacev1alpha3.ImportValue{Export: v})
+		case map[string]interface{}:
+			child, _ := v["child"].(string)
+			parent, _ := v["parent"].(string)
+			out = append(out, marketplacev1alpha3.ImportValue{Child: child, Parent: parent})
+		}
+	}
+	return
+}
+
 func fixURLs(log logr.Logger, src string, urls []string) []string {
 	parsed, err := url.Parse(src)
 	if err != nil {
@@ -137,6 +244,9 @@ func fixURLs(log logr.Logger, src string, urls []string) []string {
 
 // +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=sources,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=sources/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=namespacesources,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=namespacesources/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=marketplace.criticalstack.com,resources=namespaceapplications,verbs=get;list;watch;create;update;patch;delete
 
 func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -146,22 +256,65 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	var src marketplacev1alpha2.Source
 	if err := r.Get(ctx, client.ObjectKey{Name: req.Name}, &src); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	return r.sync(ctx, log, &clusterSource{src: &src})
+}
+
+// namespaceSourceReconciler reconciles a NamespaceSource object, sharing the sync of SourceReconciler.
+type namespaceSourceReconciler struct {
+	*SourceReconciler
+}
 
+func (r *namespaceSourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("namespacesource", req.NamespacedName)
+
+	log.Info("reconcile namespace source")
+
+	var ns marketplacev1alpha2.NamespaceSource
+	if err := r.Get(ctx, req.NamespacedName, &ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.forget(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	return r.sync(ctx, log, newNamespaceSource(&ns))
+}
+
+// forget drops what is kept between syncs of a deleted Source or NamespaceSource.
+func (r *SourceReconciler) forget(name types.NamespacedName) {
+	key := sourceKey(&marketplacev1alpha2.Source{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}})
+	r.chartMetadata.forget(key)
+	r.imagesExtracted.forget(key)
+	if r.scans != nil {
+		r.scans.forget(key)
+	}
+}
+
+// sync updates the Applications of t from its repository and records the outcome in its status.
+func (r *SourceReconciler) sync(ctx context.Context, log logr.Logger, t syncTarget) (ctrl.Result, error) {
+	src := t.source()
 	if src.Spec.SkipSync {
 		return ctrl.Result{}, nil
 	}
 
+	var defaultCategories map[string][]string
 	var cm corev1.ConfigMap
-	if err := r.Get(context.TODO(), client.ObjectKey{Name: defaultCategoriesConfigMapName, Namespace: "critical-stack"}, &cm); err == nil {
-		for _, d := range cm.Data {
+	if err := r.Get(context.TODO(), client.ObjectKey{Name: catalog.CategoriesConfigMapName, Namespace: catalog.CategoriesConfigMapNamespace}, &cm); err == nil {
+		for k, d := range cm.Data {
+			if k == catalog.VisibilityKey {
+				continue
+			}
 			cats, err := parseCategories(d)
 			if err != nil {
 				r.Log.Error(err, "failed to parse categories in configmap", "name", cm.Name)
 				break
 			}
-			r.defaultCategories = cats
+			defaultCategories = cats
 			break
 		}
 	} else if client.IgnoreNotFound(err) != nil {
@@ -169,7 +322,7 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	}
 
 	if src.Status.State != marketplacev1alpha2.SyncStateUpdating {
-		return ctrl.Result{Requeue: true}, r.setSourceStatus(ctx, src, "Reconcile", marketplacev1alpha2.SourceStatus{
+		return ctrl.Result{Requeue: true}, r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
 			State:  marketplacev1alpha2.SyncStateUpdating,
 			Reason: "object changed",
 		})
@@ -181,7 +334,7 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	if src.Spec.UpdateFrequency != "" {
 		d, err := time.ParseDuration(src.Spec.UpdateFrequency)
 		if err != nil {
-			return ctrl.Result{}, r.setSourceStatus(ctx, src, "Reconcile", marketplacev1alpha2.SourceStatus{
+			return ctrl.Result{}, r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
 				State:  marketplacev1alpha2.SyncStateError,
 				Reason: fmt.Sprintf("spec.updateFrequency is invalid: %v", err),
 			})
@@ -192,78 +345,110 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	settings := &cli.EnvSettings{}
-	entry := &repo.Entry{
-		Name:     src.Name,
-		URL:      src.Spec.URL,
-		Username: src.Spec.Username,
-		Password: src.Spec.Password,
-		CertFile: src.Spec.CertFile,
-		KeyFile:  src.Spec.KeyFile,
-		CAFile:   src.Spec.CAFile,
+	kubeVersion, err := r.serverKubeVersion()
+	if err != nil {
+		log.Error(err, "failed to determine cluster version, skipping kubeVersion checks")
 	}
-	cr, err := repo.NewChartRepository(entry, getter.All(settings))
+
+	filter, err := newChartFilter(src.Spec.Filter)
 	if err != nil {
-		return result(), r.setSourceStatus(ctx, src, "SyncRepo", marketplacev1alpha2.SourceStatus{
+		return result(), r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
+			State:  marketplacev1alpha2.SyncStateError,
+			Reason: fmt.Sprintf("spec.filter is invalid: %v", err),
+		})
+	}
+	if src.Spec.CacheCharts && r.ChartStore == nil {
+		return result(), r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
+			State:  marketplacev1alpha2.SyncStateError,
+			Reason: "spec.cacheCharts is set but no chart store is configured",
+		})
+	}
+	if src.Spec.ScanImages && r.Scanner == nil {
+		return result(), r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
+			State:  marketplacev1alpha2.SyncStateError,
+			Reason: "spec.scanImages is set but no scanner is configured",
+		})
+	}
+	if err := t.validate(); err != nil {
+		return result(), r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
 			State:  marketplacev1alpha2.SyncStateError,
 			Reason: err.Error(),
 		})
 	}
+
 	start := metav1.Now()
-	idx, err := cr.DownloadIndexFile()
+	repoIndex, baseURL, err := r.fetchIndex(ctx, log, src)
 	if err != nil {
-		return result(), r.setSourceStatus(ctx, src, "SyncRepo", marketplacev1alpha2.SourceStatus{
+		return result(), r.setSourceStatus(ctx, t, "SyncRepo", marketplacev1alpha2.SourceStatus{
 			State:      marketplacev1alpha2.SyncStateError,
 			Reason:     err.Error(),
 			LastUpdate: start,
 		})
 	}
 
-	repoIndex, err := repo.LoadIndexFile(idx)
+	existingApps, err := t.listApplications(ctx, r.Client)
 	if err != nil {
-		return result(), r.setSourceStatus(ctx, src, "SyncRepo", marketplacev1alpha2.SourceStatus{
+		return result(), r.setSourceStatus(ctx, t, "ListApps", marketplacev1alpha2.SourceStatus{
 			State:      marketplacev1alpha2.SyncStateError,
 			Reason:     err.Error(),
 			LastUpdate: start,
 		})
 	}
-
-	var existingApps marketplacev1alpha2.ApplicationList
-	if err := r.List(ctx, &existingApps, client.MatchingLabels{"marketplace.criticalstack.com/source.name": src.Name}); err != nil {
-		return result(), r.setSourceStatus(ctx, src, "ListApps", marketplacev1alpha2.SourceStatus{
+	deps, err := r.newDependencyResolver(ctx)
+	if err != nil {
+		return result(), r.setSourceStatus(ctx, t, "ListApps", marketplacev1alpha2.SourceStatus{
 			State:      marketplacev1alpha2.SyncStateError,
 			Reason:     err.Error(),
 			LastUpdate: start,
 		})
 	}
-	have := make(map[string]marketplacev1alpha2.Application)
-	for _, app := range existingApps.Items {
+	have := make(map[string]marketplacev1alpha3.Application)
+	for _, app := range existingApps {
 		have[app.Name] = app
 	}
 
-	for chartName, items := range repoIndex.Entries {
-		needsUpdate := false
+	var pending, filteredApps []marketplacev1alpha3.Application
+	// adopt holds the Applications written by the CreateOrUpdate of earlier versions, which are applied once to take
+	// them over
+	adopt := make(map[string]bool)
+	var filteredCharts, filteredVersions, uncachedVersions int
+	for chartName, upstream := range repoIndex.Entries {
 		name := fmt.Sprintf("%s.%s", src.Name, chartName)
+		var items repo.ChartVersions
+		if filter.includeChart(chartName) {
+			items = filter.filterVersions(chartName, upstream)
+		}
+		filteredVersions += len(upstream) - len(items)
+		if len(items) == 0 {
+			filteredCharts++
+			if app, ok := have[name]; ok {
+				filteredApps = append(filteredApps, app)
+			}
+			continue
+		}
+
+		needsUpdate := false
 		app, ok := have[name]
 		if !ok {
 			// create new app and add versions
-			app.Name = name
-			app.AppName = chartName
-			app.Labels = map[string]string{
-				"marketplace.criticalstack.com/source.name":      src.Name,
-				"marketplace.criticalstack.com/application.name": chartName,
-			}
-			r.recorder.Eventf(&src, corev1.EventTypeNormal, "AppUpdate", "new app: %s", chartName)
+			r.recorder.Eventf(t.owner(), corev1.EventTypeNormal, "AppUpdate", "new app: %s", chartName)
+		}
+		if ok && !appliedBySource(&app) {
+			adopt[name] = true
+			needsUpdate = true
+		}
+		if pruned := pruneVersions(app.Versions, upstream, items); len(pruned) != len(app.Versions) {
+			app.Versions = pruned
+			needsUpdate = true
+		}
+		labels := map[string]string{
+			"marketplace.criticalstack.com/source.name":      src.Name,
+			"marketplace.criticalstack.com/application.name": chartName,
 		}
 
 		// check apiVersion v1 vs v2
-		if cats := r.defaultCategories[app.AppName]; len(cats) > 0 {
-			if app.Labels == nil {
-				app.Labels = make(map[string]string)
-			}
-			for _, c := range cats {
-				app.Labels["marketplace.criticalstack.com/application.category."+c] = ""
-			}
+		for _, c := range defaultCategories[chartName] {
+			labels["marketplace.criticalstack.com/application.category."+c] = ""
 		}
 
 	L:
@@ -274,12 +459,11 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				}
 			}
 			if ok {
-				r.recorder.Eventf(&src, corev1.EventTypeNormal, "AppUpdate", "new version found: %s %s", chartName, cv.Version)
+				r.recorder.Eventf(t.owner(), corev1.EventTypeNormal, "AppUpdate", "new version found: %s %s", chartName, cv.Version)
 			}
 			needsUpdate = true
-			app.AppName = chartName
 
-			app.Versions = append(app.Versions, marketplacev1alpha2.ChartVersion{
+			app.Versions = append(app.Versions, marketplacev1alpha3.ChartVersion{
 				Home:         cv.Home,
 				Sources:      cv.Sources,
 				Version:      cv.Version,
@@ -294,63 +478,275 @@ func (r *SourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				KubeVersion:  cv.KubeVersion,
 				Dependencies: copyDependencies(cv.Dependencies),
 				Type:         cv.Type,
-				URLs:         fixURLs(log, src.Spec.URL, cv.URLs),
+				URLs:         fixURLs(log, baseURL, cv.URLs),
 				Created:      metav1.NewTime(cv.Created),
 				Removed:      &cv.Removed,
 				Digest:       cv.Digest,
 			})
 		}
 
+		for i := range app.Versions {
+			v := &app.Versions[i]
+			switch {
+			case !src.Spec.CacheCharts && len(v.UpstreamURLs) > 0:
+				uncacheChart(v)
+				needsUpdate = true
+			case src.Spec.CacheCharts && len(v.UpstreamURLs) == 0 && (v.Removed == nil || !*v.Removed):
+				if err := r.cacheChart(ctx, src, chartName, v); err != nil {
+					log.Error(err, "failed to cache chart", "chart", chartName, "version", v.Version)
+					uncachedVersions++
+					continue
+				}
+				needsUpdate = true
+			}
+		}
+
+		for i := range app.Versions {
+			v := &app.Versions[i]
+			if !src.Spec.ExtractImages {
+				if v.Images != nil {
+					v.Images = nil
+					needsUpdate = true
+				}
+				continue
+			}
+			changed, err := r.extractImages(ctx, src, chartName, v)
+			if err != nil {
+				log.Error(err, "failed to extract images", "chart", chartName, "version", v.Version)
+			}
+			needsUpdate = needsUpdate || changed
+		}
+
+		for i := range app.Versions {
+			v := &app.Versions[i]
+			switch {
+			case !src.Spec.ScanImages && v.Scan != nil:
+				v.Scan = nil
+				needsUpdate = true
+			case !src.Spec.ScanImages:
+			case r.scans != nil:
+				if scanned := r.scans.take(sourceKey(src), chartName, v.Version); scanned != nil {
+					v.Scan = scanned
+					if v.Scan.Error != "" {
+						log.Info("incomplete scan", "chart", chartName, "version", v.Version, "reason", v.Scan.Error)
+					}
+					needsUpdate = true
+				} else if r.needsScan(v) {
+					r.scans.enqueue(t, chartName, v)
+				}
+			}
+		}
+		if latest := catalog.LatestVersion(&app); src.Spec.ScanImages && latest != nil {
+			if l, ok := vulnerabilityLabel(latest.Scan); ok {
+				labels[vulnerabilitiesLabel] = l
+			}
+		}
+
+		unresolved := false
+		for _, v := range app.Versions {
+			for _, d := range v.Dependencies {
+				if deps.resolve(d) {
+					needsUpdate = true
+				}
+				if l, ok := dependencyLabel(d.Name); ok {
+					labels[l] = ""
+				}
+				unresolved = unresolved || d.Unresolved
+			}
+		}
+		if unresolved {
+			labels["marketplace.criticalstack.com/app.unresolved-dependencies"] = "true"
+		}
+
+		if kubeVersion != "" {
+			compatible := false
+			for i, v := range app.Versions {
+				ok := kubeCompatible(v.KubeVersion, kubeVersion)
+				if v.KubeCompatible == nil || *v.KubeCompatible != ok {
+					app.Versions[i].KubeCompatible = &ok
+					needsUpdate = true
+				}
+				compatible = compatible || ok
+			}
+			labels["marketplace.criticalstack.com/app.kube-compatible"] = strconv.FormatBool(compatible)
+		}
+
 		if needsUpdate {
-			vv := app.Versions
-			for _, v := range vv {
+			for _, v := range app.Versions {
 				if v.Deprecated {
-					app.Labels["marketplace.criticalstack.com/app.deprecated"] = "true"
+					labels["marketplace.criticalstack.com/app.deprecated"] = "true"
 					break
 				}
 			}
-			l := app.Labels
-			_, err := ctrl.CreateOrUpdate(ctx, r.Client, &app, controllerutil.MutateFn(func() error {
-				if err := ctrl.SetControllerReference(&src, &app, r.Scheme); err != nil {
-					return err
-				}
-				app.Versions = vv
-				for k, v := range l {
-					app.Labels[k] = v
+			pending = append(pending, marketplacev1alpha3.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: labels,
+				},
+				AppName:  chartName,
+				Versions: app.Versions,
+			})
+		}
+	}
+
+	for i := range filteredApps {
+		app := &filteredApps[i]
+		if err := r.Delete(ctx, t.application(app)); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "failed to delete filtered application", "app", app.Name)
+			continue
+		}
+		r.recorder.Eventf(t.owner(), corev1.EventTypeNormal, "AppUpdate", "app filtered: %s", app.AppName)
+	}
+
+	if failed := r.applyApplications(ctx, t, pending, adopt); len(failed) > 0 {
+		return result(), r.setSourceStatus(ctx, t, "AppUpdate", marketplacev1alpha2.SourceStatus{
+			State:            marketplacev1alpha2.SyncStateError,
+			Reason:           fmt.Sprintf("failed to update %d of %d applications", len(failed), len(pending)),
+			LastUpdate:       start,
+			FilteredCharts:   filteredCharts,
+			FilteredVersions: filteredVersions,
+			FailedApps:       failed,
+			UncachedVersions: uncachedVersions,
+		})
+	}
+
+	return result(), r.setSourceStatus(ctx, t, "Reconcile", marketplacev1alpha2.SourceStatus{
+		State:            marketplacev1alpha2.SyncStateSuccess,
+		LastUpdate:       start,
+		FilteredCharts:   filteredCharts,
+		FilteredVersions: filteredVersions,
+		UncachedVersions: uncachedVersions,
+	})
+}
+
+// applyApplications writes apps with server-side apply, using at most MaxConcurrentWrites concurrent requests, and
+// adopts those named in adopt. Apps that fail are retried on their own up to maxApplyAttempts times, backing off
+// between attempts, and any that still fail are returned sorted by name.
+func (r *SourceReconciler) applyApplications(ctx context.Context, t syncTarget, apps []marketplacev1alpha3.Application, adopt map[string]bool) []marketplacev1alpha2.ApplicationSyncError {
+	workers := r.MaxConcurrentWrites
+	if workers <= 0 {
+		workers = defaultMaxConcurrentWrites
+	}
+	var errs map[string]error
+	for attempt := 0; attempt < maxApplyAttempts && len(apps) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(applyRetryBackoff << uint(attempt-1)):
+			case <-ctx.Done():
+				return applyErrors(errs)
+			}
+		}
+		errs = make(map[string]error)
+		var (
+			mu  sync.Mutex
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, workers)
+		)
+		for i := range apps {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(app *marketplacev1alpha3.Application) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if err := r.applyApplication(ctx, t, app, adopt[app.Name]); err != nil {
+					mu.Lock()
+					errs[app.Name] = err
+					mu.Unlock()
 				}
-				return nil
-			}))
-			if err != nil {
-				return result(), r.setSourceStatus(ctx, src, "AppUpdate", marketplacev1alpha2.SourceStatus{
-					State:      marketplacev1alpha2.SyncStateError,
-					Reason:     err.Error(),
-					LastUpdate: start,
-				})
+			}(&apps[i])
+		}
+		wg.Wait()
+
+		var retry []marketplacev1alpha3.Application
+		for _, app := range apps {
+			if err, ok := errs[app.Name]; ok {
+				r.Log.Error(err, "failed to apply application", "source", sourceKey(t.source()), "app", app.Name, "attempt", attempt+1)
+				retry = append(retry, app)
 			}
 		}
+		apps = retry
 	}
+	return applyErrors(errs)
+}
 
-	return result(), r.setSourceStatus(ctx, src, "Reconcile", marketplacev1alpha2.SourceStatus{
-		State:      marketplacev1alpha2.SyncStateSuccess,
-		LastUpdate: start,
+// applyErrors returns errs, by Application name, sorted by name.
+func applyErrors(errs map[string]error) []marketplacev1alpha2.ApplicationSyncError {
+	var failed []marketplacev1alpha2.ApplicationSyncError
+	for name, err := range errs {
+		failed = append(failed, marketplacev1alpha2.ApplicationSyncError{
+			Name:   name,
+			Reason: err.Error(),
+		})
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Name < failed[j].Name
 	})
+	return failed
 }
 
-func (r *SourceReconciler) setSourceStatus(ctx context.Context, src marketplacev1alpha2.Source, op string, status marketplacev1alpha2.SourceStatus) error {
-	old := src
-	var all marketplacev1alpha2.ApplicationList
-	if err := r.List(ctx, &all, client.MatchingLabels{"marketplace.criticalstack.com/source.name": src.Name}); err != nil {
+func (r *SourceReconciler) applyApplication(ctx context.Context, t syncTarget, app *marketplacev1alpha3.Application, adopt bool) error {
+	obj := t.application(app)
+	if err := ctrl.SetControllerReference(t.owner(), obj, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Patch(ctx, obj, client.Apply, client.FieldOwner(sourceFieldManager), client.ForceOwnership); err != nil {
+		return err
+	}
+	if !adopt {
+		return nil
+	}
+	return r.Patch(ctx, adoptedApplication(obj, app.Labels), client.MergeFrom(obj))
+}
+
+// appliedBySource reports whether the source controller has applied app. Applications created by earlier versions,
+// which wrote them with updates, aren't.
+func appliedBySource(app *marketplacev1alpha3.Application) bool {
+	for _, m := range app.ManagedFields {
+		if m.Manager == sourceFieldManager && m.Operation == metav1.ManagedFieldsOperationApply {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptedApplication returns a copy of obj, as applied, without what updates of earlier versions left on it: the
+// marketplace labels that aren't in labels any more, and the managed fields of those updates. Applies only prune the
+// fields the source field manager owns alone, so without this, labels like app.deprecated would never be removed.
+func adoptedApplication(obj ownerObject, labels map[string]string) ownerObject {
+	adopted := obj.DeepCopyObject().(ownerObject)
+	var managed []metav1.ManagedFieldsEntry
+	for _, m := range adopted.GetManagedFields() {
+		if m.Operation != metav1.ManagedFieldsOperationUpdate {
+			managed = append(managed, m)
+		}
+	}
+	adopted.SetManagedFields(managed)
+	l := adopted.GetLabels()
+	for k := range l {
+		if _, ok := labels[k]; !ok && strings.HasPrefix(k, marketplaceLabelPrefix) {
+			delete(l, k)
+		}
+	}
+	adopted.SetLabels(l)
+	return adopted
+}
+
+func (r *SourceReconciler) setSourceStatus(ctx context.Context, t syncTarget, op string, status marketplacev1alpha2.SourceStatus) error {
+	apps, err := t.listApplications(ctx, r.Client)
+	if err != nil {
 		return err
 	}
+	owner := t.owner()
 	status.AppCount = 0
-	for _, x := range all.Items {
-		if ref := metav1.GetControllerOf(&x); ref == nil || ref.Name != src.Name {
+	for _, x := range apps {
+		if ref := metav1.GetControllerOf(&x); ref == nil || ref.Name != owner.GetName() {
 			continue
 		}
 		status.AppCount++
 	}
-	src.Status = status
-	if err := r.Status().Patch(ctx, &src, client.MergeFrom(&old)); err != nil {
+	if err := t.patchStatus(ctx, r.Client, status); err != nil {
 		return errors.Wrap(err, "FAILED during status update")
 	}
 	et := corev1.EventTypeNormal
@@ -359,6 +755,6 @@ func (r *SourceReconciler) setSourceStatus(ctx context.Context, src marketplacev
 		et = corev1.EventTypeWarning
 		msg = status.Reason
 	}
-	r.recorder.Event(&src, et, op, msg)
+	r.recorder.Event(owner, et, op, msg)
 	return nil
 }
@@ -10,6 +10,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -139,16 +140,24 @@ var _ = Describe("SourceController", func() {
 						return err == nil && fetchedSrc.Status.State == marketplacev1alpha2.SyncStateSuccess
 					}, timeout, interval).Should(BeTrue())
 
-					appList := &marketplacev1alpha2.ApplicationList{}
+					appList := &marketplacev1alpha3.ApplicationList{}
 					Eventually(func() bool {
 						err := k8sClient.List(ctx, appList)
 						return err == nil && len(appList.Items) > 0
 					}, timeout, interval).Should(BeTrue())
 
+					Expect(fetchedSrc.Status.FailedApps).Should(BeEmpty())
+
 					srcAppNum := 0
 					for _, v := range appList.Items {
 						if v.Labels["marketplace.criticalstack.com/source.name"] == src.Name {
 							srcAppNum += 1
+							Expect(v.ManagedFields).ShouldNot(BeEmpty())
+							Expect(v.ManagedFields[0].Manager).Should(Equal(sourceFieldManager))
+							Expect(v.Labels).Should(HaveKeyWithValue("marketplace.criticalstack.com/app.kube-compatible", "true"))
+							for _, cv := range v.Versions {
+								Expect(cv.KubeCompatible).ShouldNot(BeNil())
+							}
 						}
 					}
 					Expect(srcAppNum).Should(Equal(2))
@@ -183,7 +192,7 @@ var _ = Describe("SourceController", func() {
 					Expect(k8sClient.Update(ctx, fetchedSrc)).Should(Succeed())
 					time.Sleep(time.Second * 1)
 
-					appList := &marketplacev1alpha2.ApplicationList{}
+					appList := &marketplacev1alpha3.ApplicationList{}
 					Eventually(func() bool {
 						err := k8sClient.List(ctx, appList)
 						return err == nil && len(appList.Items) > 0
@@ -215,6 +224,44 @@ var _ = Describe("SourceController", func() {
 	})
 })
 
+var _ = Describe("Application adoption", func() {
+
+	app := func(managed ...metav1.ManagedFieldsEntry) *marketplacev1alpha3.Application {
+		return &marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "stable.mysql",
+				Labels: map[string]string{
+					"marketplace.criticalstack.com/source.name":                   "stable",
+					"marketplace.criticalstack.com/app.deprecated":                "true",
+					"marketplace.criticalstack.com/application.category.database": "",
+					"team": "data",
+				},
+				ManagedFields: managed,
+			},
+		}
+	}
+	update := metav1.ManagedFieldsEntry{Manager: "manager", Operation: metav1.ManagedFieldsOperationUpdate}
+	apply := metav1.ManagedFieldsEntry{Manager: sourceFieldManager, Operation: metav1.ManagedFieldsOperationApply}
+
+	It("Should tell Applications written by earlier versions apart", func() {
+		Expect(appliedBySource(app(update))).To(BeFalse())
+		Expect(appliedBySource(app(metav1.ManagedFieldsEntry{Manager: sourceFieldManager, Operation: metav1.ManagedFieldsOperationUpdate}))).To(BeFalse())
+		Expect(appliedBySource(app(update, apply))).To(BeTrue())
+	})
+
+	It("Should drop the labels and managed fields left by updates", func() {
+		obj := app(update, apply)
+		adopted := adoptedApplication(obj, map[string]string{"marketplace.criticalstack.com/source.name": "stable"})
+		Expect(adopted.GetManagedFields()).To(Equal([]metav1.ManagedFieldsEntry{apply}))
+		Expect(adopted.GetLabels()).To(Equal(map[string]string{
+			"marketplace.criticalstack.com/source.name": "stable",
+			"team": "data",
+		}))
+		Expect(obj.ManagedFields).To(HaveLen(2))
+		Expect(obj.Labels).To(HaveLen(4))
+	})
+})
+
 type serverWithCancel struct {
 	server *http.Server
 	done   chan (error)
@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+const dependencyLabelPrefix = "marketplace.criticalstack.com/dependency."
+
+// dependencyResolver matches chart dependencies against the Applications of every Source in the catalog.
+type dependencyResolver struct {
+	// source names keyed by normalized repository URL
+	sources map[string][]string
+	// chart versions keyed by Application name
+	versions map[string][]string
+}
+
+func normalizeRepoURL(u string) string {
+	return strings.TrimSuffix(strings.TrimSpace(u), "/")
+}
+
+func (r *SourceReconciler) newDependencyResolver(ctx context.Context) (*dependencyResolver, error) {
+	var sources marketplacev1alpha2.SourceList
+	if err := r.List(ctx, &sources); err != nil {
+		return nil, err
+	}
+	var apps marketplacev1alpha3.ApplicationList
+	if err := r.List(ctx, &apps); err != nil {
+		return nil, err
+	}
+	dr := &dependencyResolver{
+		sources:  make(map[string][]string),
+		versions: make(map[string][]string),
+	}
+	for _, src := range sources.Items {
+		u := normalizeRepoURL(src.Spec.URL)
+		dr.sources[u] = append(dr.sources[u], src.Name)
+	}
+	for _, app := range apps.Items {
+		for _, v := range app.Versions {
+			dr.versions[app.Name] = append(dr.versions[app.Name], v.Version)
+		}
+	}
+	return dr, nil
+}
+
+// resolve links d to the first catalog Application that provides a matching chart version, or marks it unresolved.
+// Dependencies vendored into the chart (file:// or no repository) are left alone. It reports whether d changed.
+func (dr *dependencyResolver) resolve(d *marketplacev1alpha3.Dependency) bool {
+	if d.Repository == "" || strings.HasPrefix(d.Repository, "file://") {
+		return false
+	}
+	app := dr.lookup(d)
+	unresolved := app == ""
+	if d.Application == app && d.Unresolved == unresolved {
+		return false
+	}
+	d.Application = app
+	d.Unresolved = unresolved
+	return true
+}
+
+func (dr *dependencyResolver) lookup(d *marketplacev1alpha3.Dependency) string {
+	var constraint *semver.Constraints
+	if d.Version != "" {
+		c, err := semver.NewConstraint(d.Version)
+		if err != nil {
+			return ""
+		}
+		constraint = c
+	}
+	for _, src := range dr.sources[normalizeRepoURL(d.Repository)] {
+		name := fmt.Sprintf("%s.%s", src, d.Name)
+		for _, version := range dr.versions[name] {
+			if constraint == nil {
+				return name
+			}
+			if v, err := semver.NewVersion(version); err == nil && constraint.Check(v) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// dependencyLabel returns the label used to find Applications that depend on the named chart, e.g.
+// marketplace.criticalstack.com/dependency.redis. It returns false when the chart name can't be used in a label key.
+func dependencyLabel(chartName string) (string, bool) {
+	l := dependencyLabelPrefix + chartName
+	return l, len(validation.IsQualifiedName(l)) == 0
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("DependencyResolver", func() {
+
+	var dr *dependencyResolver
+
+	BeforeEach(func() {
+		dr = &dependencyResolver{
+			sources: map[string][]string{
+				"https://charts.example.com": {"example"},
+			},
+			versions: map[string][]string{
+				"example.redis": {"10.5.7", "11.0.0"},
+			},
+		}
+	})
+
+	It("Should link dependencies to a matching Application", func() {
+		d := &marketplacev1alpha3.Dependency{
+			Name:       "redis",
+			Version:    "~10.5.0",
+			Repository: "https://charts.example.com/",
+		}
+		Expect(dr.resolve(d)).Should(BeTrue())
+		Expect(d.Application).Should(Equal("example.redis"))
+		Expect(d.Unresolved).Should(BeFalse())
+		Expect(dr.resolve(d)).Should(BeFalse())
+	})
+
+	It("Should flag dependencies without a matching version", func() {
+		d := &marketplacev1alpha3.Dependency{
+			Name:       "redis",
+			Version:    ">= 12.0.0",
+			Repository: "https://charts.example.com",
+		}
+		Expect(dr.resolve(d)).Should(BeTrue())
+		Expect(d.Application).Should(BeEmpty())
+		Expect(d.Unresolved).Should(BeTrue())
+	})
+
+	It("Should flag dependencies from unknown repositories", func() {
+		d := &marketplacev1alpha3.Dependency{
+			Name:       "redis",
+			Repository: "@stable",
+		}
+		Expect(dr.resolve(d)).Should(BeTrue())
+		Expect(d.Unresolved).Should(BeTrue())
+	})
+
+	It("Should ignore vendored dependencies", func() {
+		d := &marketplacev1alpha3.Dependency{
+			Name:       "common",
+			Repository: "file://../common",
+		}
+		Expect(dr.resolve(d)).Should(BeFalse())
+		Expect(d.Unresolved).Should(BeFalse())
+	})
+})
@@ -0,0 +1,69 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// ChartDownloader downloads chart archives for the catalog API with the credentials of the Application's Source, so
+// that clients can install from private repositories without them. Archives cached by spec.cacheCharts are read from
+// ChartStore.
+type ChartDownloader struct {
+	Client     client.Reader
+	ChartStore chartstore.Store
+}
+
+func (d *ChartDownloader) Download(ctx context.Context, app *marketplacev1alpha3.Application, cv *marketplacev1alpha3.ChartVersion) (io.ReadCloser, error) {
+	name := app.Labels[catalog.SourceLabel]
+	if name == "" {
+		return nil, errors.Errorf("application %s has no source", app.Name)
+	}
+	var src marketplacev1alpha2.Source
+	if err := d.Client.Get(ctx, client.ObjectKey{Name: name}, &src); err != nil {
+		return nil, err
+	}
+	return openChartArchive(ctx, d.ChartStore, &src, app.AppName, cv)
+}
+
+// openChartArchive opens the archive of cv from store when it has been cached, and otherwise from the repository
+// with the Source's credentials.
+func openChartArchive(ctx context.Context, store chartstore.Store, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion) (io.ReadCloser, error) {
+	if len(cv.UpstreamURLs) > 0 && store != nil {
+		rc, err := store.Get(ctx, chartstore.ChartKey(sourceKey(src), chartName, cv.Version))
+		if err == nil {
+			return rc, nil
+		}
+	}
+	urls := cv.URLs
+	if len(cv.UpstreamURLs) > 0 {
+		urls = cv.UpstreamURLs
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("chart version has no urls")
+	}
+	return openChartFile(ctx, src, urls[0])
+}
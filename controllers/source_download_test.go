@@ -0,0 +1,147 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+var _ = Describe("Chart downloads", func() {
+
+	const busyboxDigest = "787e329ad25ac9398d56d85d9fd2085b91d3e752c3a118878a0543b08aa50fee"
+
+	ctx := context.Background()
+
+	var (
+		ts  *httptest.Server
+		dir string
+		d   *ChartDownloader
+		app *marketplacev1alpha3.Application
+	)
+
+	BeforeEach(func() {
+		files := http.FileServer(http.Dir("testdata/marketplace-source/"))
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			files.ServeHTTP(w, r)
+		}))
+
+		var err error
+		dir, err = ioutil.TempDir("", "chartstore")
+		Expect(err).ToNot(HaveOccurred())
+		store, err := chartstore.NewDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+
+		s := runtime.NewScheme()
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		d = &ChartDownloader{
+			Client: fake.NewFakeClientWithScheme(s, &marketplacev1alpha2.Source{
+				ObjectMeta: metav1.ObjectMeta{Name: "private"},
+				Spec:       marketplacev1alpha2.SourceSpec{URL: ts.URL, Username: "admin", Password: "hunter2"},
+			}),
+			ChartStore: store,
+		}
+		app = &marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "private.busybox",
+				Labels: map[string]string{catalog.SourceLabel: "private"},
+			},
+			AppName: "busybox",
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+
+	read := func(rc io.ReadCloser, err error) []byte {
+		Expect(err).ToNot(HaveOccurred())
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+
+	It("Should download with the Source's credentials", func() {
+		data := read(d.Download(ctx, app, &marketplacev1alpha3.ChartVersion{
+			Version: "1.0.0",
+			URLs:    []string{ts.URL + "/busybox-1.0.0.tgz"},
+		}))
+		sum := sha256.Sum256(data)
+		Expect(hex.EncodeToString(sum[:])).To(Equal(busyboxDigest))
+	})
+
+	It("Should read cached archives from the chart store", func() {
+		Expect(d.ChartStore.Put(ctx, "private/busybox-1.0.0.tgz", strings.NewReader("cached"))).To(Succeed())
+		data := read(d.Download(ctx, app, &marketplacev1alpha3.ChartVersion{
+			Version:      "1.0.0",
+			URLs:         []string{"http://marketplace/charts/files/private/busybox-1.0.0.tgz"},
+			UpstreamURLs: []string{ts.URL + "/busybox-1.0.0.tgz"},
+		}))
+		Expect(string(data)).To(Equal("cached"))
+	})
+
+	It("Should fall back to the upstream url of cached versions", func() {
+		data := read(d.Download(ctx, app, &marketplacev1alpha3.ChartVersion{
+			Version:      "1.0.0",
+			URLs:         []string{"http://marketplace/charts/files/private/busybox-1.0.0.tgz"},
+			UpstreamURLs: []string{ts.URL + "/busybox-1.0.0.tgz"},
+		}))
+		sum := sha256.Sum256(data)
+		Expect(hex.EncodeToString(sum[:])).To(Equal(busyboxDigest))
+	})
+
+	It("Should fail when the repository rejects the request", func() {
+		_, err := d.Download(ctx, app, &marketplacev1alpha3.ChartVersion{
+			Version: "1.0.0",
+			URLs:    []string{ts.URL + "/missing-1.0.0.tgz"},
+		})
+		Expect(err).To(MatchError(ContainSubstring("404 Not Found")))
+	})
+
+	It("Should fail for Applications without a Source", func() {
+		app.Labels[catalog.SourceLabel] = "missing"
+		_, err := d.Download(ctx, app, &marketplacev1alpha3.ChartVersion{
+			Version: "1.0.0",
+			URLs:    []string{ts.URL + "/busybox-1.0.0.tgz"},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
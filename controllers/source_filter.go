@@ -0,0 +1,175 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// chartFilter is the compiled form of a SourceFilter. A nil *chartFilter includes everything.
+type chartFilter struct {
+	include     []namePattern
+	exclude     []namePattern
+	constraints map[string]*semver.Constraints
+
+	latest             int
+	excludePrereleases bool
+	excludeDeprecated  bool
+	excludeLibraries   bool
+}
+
+type namePattern func(string) bool
+
+func compileNamePattern(p string) (namePattern, error) {
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		re, err := regexp.Compile(p[1 : len(p)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(p, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid glob %q", p)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(p, name)
+		return ok
+	}, nil
+}
+
+func newChartFilter(f *marketplacev1alpha2.SourceFilter) (*chartFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	cf := &chartFilter{
+		constraints:        make(map[string]*semver.Constraints),
+		latest:             f.LatestVersions,
+		excludePrereleases: f.ExcludePrereleases,
+		excludeDeprecated:  f.ExcludeDeprecated,
+		excludeLibraries:   f.ExcludeLibraries,
+	}
+	for _, p := range f.Include {
+		m, err := compileNamePattern(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "include")
+		}
+		cf.include = append(cf.include, m)
+	}
+	for _, p := range f.Exclude {
+		m, err := compileNamePattern(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "exclude")
+		}
+		cf.exclude = append(cf.exclude, m)
+	}
+	for name, c := range f.VersionConstraints {
+		sc, err := semver.NewConstraint(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "versionConstraints[%s]", name)
+		}
+		cf.constraints[name] = sc
+	}
+	return cf, nil
+}
+
+// includeChart reports whether the chart name passes the include and exclude lists.
+func (f *chartFilter) includeChart(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, m := range f.exclude {
+		if m(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, m := range f.include {
+		if m(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterVersions returns the versions of the named chart that pass the filter, newest first.
+func (f *chartFilter) filterVersions(name string, versions repo.ChartVersions) repo.ChartVersions {
+	if f == nil {
+		return versions
+	}
+	constraint := f.constraints[name]
+	out := make(repo.ChartVersions, 0, len(versions))
+	for _, cv := range versions {
+		if f.excludeDeprecated && cv.Deprecated {
+			continue
+		}
+		if f.excludeLibraries && cv.Type == "library" {
+			continue
+		}
+		if f.excludePrereleases || constraint != nil {
+			v, err := semver.NewVersion(cv.Version)
+			if err != nil {
+				continue
+			}
+			if f.excludePrereleases && v.Prerelease() != "" {
+				continue
+			}
+			if constraint != nil && !constraint.Check(v) {
+				continue
+			}
+		}
+		out = append(out, cv)
+	}
+	if f.latest > 0 && len(out) > f.latest {
+		sort.Sort(sort.Reverse(out))
+		out = out[:f.latest]
+	}
+	return out
+}
+
+// pruneVersions returns versions without those that are in the upstream index but were filtered out of included, so
+// that a filter change also applies to versions synced before it. Versions that left the index are kept.
+func pruneVersions(versions []marketplacev1alpha3.ChartVersion, upstream, included repo.ChartVersions) []marketplacev1alpha3.ChartVersion {
+	if len(upstream) == len(included) {
+		return versions
+	}
+	filtered := make(map[string]bool)
+	for _, cv := range upstream {
+		filtered[cv.Version] = true
+	}
+	for _, cv := range included {
+		delete(filtered, cv.Version)
+	}
+	out := make([]marketplacev1alpha3.ChartVersion, 0, len(versions))
+	for _, v := range versions {
+		if !filtered[v.Version] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("SourceFilter", func() {
+
+	chartVersion := func(version string, deprecated bool, typ string) *repo.ChartVersion {
+		return &repo.ChartVersion{
+			Metadata: &chart.Metadata{
+				Name:       "mysql",
+				Version:    version,
+				Deprecated: deprecated,
+				Type:       typ,
+			},
+		}
+	}
+
+	versionsOf := func(cvs repo.ChartVersions) (out []string) {
+		for _, cv := range cvs {
+			out = append(out, cv.Version)
+		}
+		return
+	}
+
+	It("Should include everything when unset", func() {
+		f, err := newChartFilter(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.includeChart("anything")).Should(BeTrue())
+	})
+
+	It("Should match chart names by glob and regex", func() {
+		f, err := newChartFilter(&marketplacev1alpha2.SourceFilter{
+			Include: []string{"prometheus-*", "/^(my|postgre)sql$/"},
+			Exclude: []string{"prometheus-pushgateway"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.includeChart("prometheus-operator")).Should(BeTrue())
+		Expect(f.includeChart("mysql")).Should(BeTrue())
+		Expect(f.includeChart("postgresql")).Should(BeTrue())
+		Expect(f.includeChart("prometheus-pushgateway")).Should(BeFalse())
+		Expect(f.includeChart("redis")).Should(BeFalse())
+	})
+
+	It("Should reject invalid patterns and constraints", func() {
+		_, err := newChartFilter(&marketplacev1alpha2.SourceFilter{Include: []string{"/(/"}})
+		Expect(err).To(HaveOccurred())
+		_, err = newChartFilter(&marketplacev1alpha2.SourceFilter{Exclude: []string{"[a-"}})
+		Expect(err).To(HaveOccurred())
+		_, err = newChartFilter(&marketplacev1alpha2.SourceFilter{
+			VersionConstraints: map[string]string{"mysql": "not a constraint"},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should filter versions", func() {
+		f, err := newChartFilter(&marketplacev1alpha2.SourceFilter{
+			VersionConstraints: map[string]string{"mysql": ">= 1.0.0"},
+			LatestVersions:     2,
+			ExcludePrereleases: true,
+			ExcludeDeprecated:  true,
+			ExcludeLibraries:   true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		out := f.filterVersions("mysql", repo.ChartVersions{
+			chartVersion("0.9.0", false, ""),
+			chartVersion("1.0.0", false, "application"),
+			chartVersion("1.1.0", false, "application"),
+			chartVersion("1.2.0-rc.1", false, "application"),
+			chartVersion("1.3.0", true, "application"),
+			chartVersion("1.4.0", false, "library"),
+			chartVersion("1.5.0", false, "application"),
+		})
+		Expect(versionsOf(out)).Should(Equal([]string{"1.5.0", "1.1.0"}))
+	})
+
+	It("Should prune synced versions that no longer pass the filter", func() {
+		upstream := repo.ChartVersions{
+			chartVersion("1.0.0", false, ""),
+			chartVersion("1.1.0", false, ""),
+			chartVersion("1.2.0", false, ""),
+		}
+		synced := []marketplacev1alpha3.ChartVersion{{Version: "0.9.0"}, {Version: "1.0.0"}, {Version: "1.1.0"}, {Version: "1.2.0"}}
+		Expect(pruneVersions(synced, upstream, upstream)).Should(Equal(synced))
+		pruned := pruneVersions(synced, upstream, upstream[2:])
+		Expect(pruned).Should(Equal([]marketplacev1alpha3.ChartVersion{{Version: "0.9.0"}, {Version: "1.2.0"}}))
+	})
+})
@@ -0,0 +1,369 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/repo"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	"github.com/criticalstack/marketplace/chartstore"
+)
+
+// chartObject is a packaged chart found by listing a repository.
+type chartObject struct {
+	// Key locates the archive within the listing, e.g. an object key or file path.
+	Key string
+	URL string
+	// Tag identifies the archive's content without downloading it, such as an ETag. When it is empty the archive is
+	// downloaded on every sync and only its parsed metadata is reused.
+	Tag      string
+	Modified time.Time
+}
+
+// chartLister lists and downloads the packaged charts of a repository that has no index.yaml.
+type chartLister interface {
+	list(ctx context.Context) ([]chartObject, error)
+	fetch(ctx context.Context, obj chartObject) ([]byte, error)
+}
+
+// newChartLister returns the lister for a Source with spec.generateIndex, based on the scheme of its URL.
+func newChartLister(src *marketplacev1alpha2.Source) (chartLister, string, error) {
+	u, err := url.Parse(src.Spec.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "s3":
+		store, err := sourceS3(src)
+		if err != nil {
+			return nil, "", err
+		}
+		return &s3Lister{store: store}, strings.TrimSuffix(store.URL(""), "/"), nil
+	case "http", "https":
+		c, err := sourceHTTPClient(src)
+		if err != nil {
+			return nil, "", err
+		}
+		return &httpLister{src: src, client: c}, src.Spec.URL, nil
+	default:
+		return nil, "", errors.Errorf("cannot list charts of %q", src.Spec.URL)
+	}
+}
+
+// sourceS3 returns the bucket of a Source with an s3:// URL. Username and Password are its access key.
+func sourceS3(src *marketplacev1alpha2.Source) (*chartstore.S3, error) {
+	store, err := chartstore.ParseS3URL(src.Spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	store.AccessKeyID = src.Spec.Username
+	store.SecretAccessKey = src.Spec.Password
+	return store, nil
+}
+
+// cachedChart is the metadata read from a packaged chart.
+type cachedChart struct {
+	metadata *chart.Metadata
+	digest   string
+}
+
+// chartMetadataCache remembers the metadata of packaged charts between syncs, so that unchanged archives aren't
+// downloaded again. Entries are kept per Source and dropped once a sync no longer finds them.
+type chartMetadataCache struct {
+	mu      sync.Mutex
+	sources map[string]map[string]*cachedChart
+}
+
+func (c *chartMetadataCache) get(source string) map[string]*cachedChart {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sources[source]
+}
+
+func (c *chartMetadataCache) set(source string, charts map[string]*cachedChart) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sources == nil {
+		c.sources = make(map[string]map[string]*cachedChart)
+	}
+	c.sources[source] = charts
+}
+
+// forget drops the charts of a deleted Source.
+func (c *chartMetadataCache) forget(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sources, source)
+}
+
+// generateIndex builds a repository index by reading Chart.yaml out of every archive l lists. Archives that can't be
+// loaded as charts are logged and skipped.
+func (r *SourceReconciler) generateIndex(ctx context.Context, log logr.Logger, source string, l chartLister) (*repo.IndexFile, error) {
+	objs, err := l.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prev := r.chartMetadata.get(source)
+	next := make(map[string]*cachedChart)
+	idx := repo.NewIndexFile()
+	for _, obj := range objs {
+		key := ""
+		if obj.Tag != "" {
+			key = "tag:" + obj.URL + "@" + obj.Tag
+		}
+		c, ok := prev[key]
+		if !ok {
+			data, err := l.fetch(ctx, obj)
+			if err != nil {
+				log.Error(err, "failed to download chart archive", "url", obj.URL)
+				continue
+			}
+			sum := sha256.Sum256(data)
+			digest := hex.EncodeToString(sum[:])
+			if key == "" {
+				key = "sha256:" + digest
+			}
+			if c, ok = prev[key]; !ok {
+				ch, err := loader.LoadArchive(bytes.NewReader(data))
+				if err != nil {
+					log.Error(err, "failed to load chart archive", "url", obj.URL)
+					continue
+				}
+				c = &cachedChart{metadata: ch.Metadata, digest: digest}
+			}
+		}
+		next[key] = c
+		if idx.Has(c.metadata.Name, c.metadata.Version) {
+			continue
+		}
+		md := *c.metadata
+		created := obj.Modified
+		if created.IsZero() {
+			created = time.Now()
+		}
+		idx.Entries[md.Name] = append(idx.Entries[md.Name], &repo.ChartVersion{
+			Metadata: &md,
+			URLs:     []string{obj.URL},
+			Created:  created,
+			Digest:   c.digest,
+		})
+	}
+	r.chartMetadata.set(source, next)
+	idx.SortEntries()
+	return idx, nil
+}
+
+// dirLister lists the packaged charts in a directory and its immediate subdirectories, like helm repo index. Chart URLs
+// are relative to the directory.
+type dirLister struct {
+	dir string
+}
+
+func (l *dirLister) list(ctx context.Context) ([]chartObject, error) {
+	var paths []string
+	for _, pattern := range []string{"*.tgz", "*/*.tgz"} {
+		m, err := filepath.Glob(filepath.Join(l.dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, m...)
+	}
+	var objs []chartObject
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, chartObject{
+			Key:      p,
+			URL:      filepath.ToSlash(rel),
+			Tag:      fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano()),
+			Modified: fi.ModTime(),
+		})
+	}
+	return objs, nil
+}
+
+func (l *dirLister) fetch(ctx context.Context, obj chartObject) ([]byte, error) {
+	return ioutil.ReadFile(obj.Key)
+}
+
+// s3Lister lists the packaged charts in an S3-compatible bucket. Objects are identified by their ETag.
+type s3Lister struct {
+	store *chartstore.S3
+}
+
+func (l *s3Lister) list(ctx context.Context) ([]chartObject, error) {
+	listed, err := l.store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var objs []chartObject
+	for _, o := range listed {
+		if !strings.HasSuffix(o.Key, ".tgz") {
+			continue
+		}
+		objs = append(objs, chartObject{
+			Key:      o.Key,
+			URL:      l.store.URL(o.Key),
+			Tag:      o.ETag,
+			Modified: o.LastModified,
+		})
+	}
+	return objs, nil
+}
+
+func (l *s3Lister) fetch(ctx context.Context, obj chartObject) ([]byte, error) {
+	rc, err := l.store.Get(ctx, obj.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// hrefPattern matches links to chart archives in an HTML directory listing, as served by nginx, Apache, Go's
+// http.FileServer and most static file servers.
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'?#]+\.tgz)["']`)
+
+// httpLister lists the packaged charts linked from an HTTP directory listing. Only links below the listing's URL are
+// followed. Archives are identified by the ETag or Last-Modified header of a HEAD request.
+type httpLister struct {
+	src    *marketplacev1alpha2.Source
+	client *http.Client
+}
+
+func (l *httpLister) list(ctx context.Context) ([]chartObject, error) {
+	base, err := url.Parse(strings.TrimSuffix(l.src.Spec.URL, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.do(ctx, http.MethodGet, base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to list %s: %s", base, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var objs []chartObject
+	for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		ref, err := url.Parse(m[1])
+		if err != nil {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		if u.Scheme != base.Scheme || u.Host != base.Host || !strings.HasPrefix(u.Path, base.Path) || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		obj := chartObject{Key: u.String(), URL: u.String()}
+		if head, err := l.do(ctx, http.MethodHead, u.String()); err == nil {
+			head.Body.Close()
+			if head.StatusCode == http.StatusOK {
+				obj.Tag = head.Header.Get("ETag")
+				if lm, err := http.ParseTime(head.Header.Get("Last-Modified")); err == nil {
+					obj.Modified = lm
+					if obj.Tag == "" {
+						obj.Tag = fmt.Sprintf("%d-%d", lm.Unix(), head.ContentLength)
+					}
+				}
+			}
+		}
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].URL < objs[j].URL })
+	return objs, nil
+}
+
+func (l *httpLister) fetch(ctx context.Context, obj chartObject) ([]byte, error) {
+	return fetchChartFile(ctx, l.src, obj.URL)
+}
+
+func (l *httpLister) do(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.src.Spec.Username != "" || l.src.Spec.Password != "" {
+		req.SetBasicAuth(l.src.Spec.Username, l.src.Spec.Password)
+	}
+	return l.client.Do(req.WithContext(ctx))
+}
+
+// sourceHTTPClient returns a client using the Source's client certificate and CA, like helm's HTTP getter.
+func sourceHTTPClient(src *marketplacev1alpha2.Source) (*http.Client, error) {
+	if src.Spec.CertFile == "" && src.Spec.KeyFile == "" && src.Spec.CAFile == "" {
+		return http.DefaultClient, nil
+	}
+	cfg := &tls.Config{}
+	if src.Spec.CertFile != "" && src.Spec.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(src.Spec.CertFile, src.Spec.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if src.Spec.CAFile != "" {
+		ca, err := ioutil.ReadFile(src.Spec.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificates in %s", src.Spec.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	return &http.Client{Transport: tr}, nil
+}
@@ -0,0 +1,218 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+// countingHandler counts the archives downloaded with GET.
+type countingHandler struct {
+	http.Handler
+	mu   sync.Mutex
+	gets int
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, ".tgz") {
+		h.mu.Lock()
+		h.gets++
+		h.mu.Unlock()
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func (h *countingHandler) downloads() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.gets
+}
+
+var _ = Describe("Index generation", func() {
+
+	ctx := context.Background()
+	log := logf.NullLogger{}
+
+	var (
+		dir string
+		ts  *httptest.Server
+		h   *countingHandler
+	)
+
+	copyChart := func(name string) {
+		data, err := ioutil.ReadFile(filepath.Join("testdata/marketplace-source", name))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, name), data, 0644)).To(Succeed())
+	}
+
+	newSource := func(spec marketplacev1alpha2.SourceSpec) *marketplacev1alpha2.Source {
+		return &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "bucket"},
+			Spec:       spec,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "charts")
+		Expect(err).ToNot(HaveOccurred())
+		copyChart("mysql-1.3.0.tgz")
+		copyChart("busybox-1.0.0.tgz")
+		Expect(ioutil.WriteFile(filepath.Join(dir, "broken-0.1.0.tgz"), []byte("not a chart"), 0644)).To(Succeed())
+		h = &countingHandler{Handler: http.StripPrefix("/charts", http.FileServer(http.Dir(dir)))}
+		ts = httptest.NewServer(h)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("When the Source is an HTTP directory listing", func() {
+		It("Should index the packaged charts", func() {
+			r := &SourceReconciler{}
+			idx, base, err := r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{
+				URL:           ts.URL + "/charts",
+				GenerateIndex: true,
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(base).To(Equal(ts.URL + "/charts"))
+			Expect(idx.Entries).To(HaveLen(2))
+			Expect(idx.Entries["mysql"]).To(HaveLen(1))
+			mysql := idx.Entries["mysql"][0]
+			Expect(mysql.Version).To(Equal("1.3.0"))
+			Expect(mysql.URLs).To(Equal([]string{ts.URL + "/charts/mysql-1.3.0.tgz"}))
+			Expect(mysql.Digest).To(HaveLen(64))
+			Expect(mysql.Created.IsZero()).To(BeFalse())
+		})
+
+		It("Should only download changed archives", func() {
+			r := &SourceReconciler{}
+			src := newSource(marketplacev1alpha2.SourceSpec{URL: ts.URL + "/charts/", GenerateIndex: true})
+			_, _, err := r.fetchIndex(ctx, log, src)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(h.downloads()).To(Equal(3))
+
+			_, _, err = r.fetchIndex(ctx, log, src)
+			Expect(err).ToNot(HaveOccurred())
+			// the broken archive is retried, since it was never cached
+			Expect(h.downloads()).To(Equal(4))
+
+			Expect(os.Remove(filepath.Join(dir, "broken-0.1.0.tgz"))).To(Succeed())
+			Expect(os.Remove(filepath.Join(dir, "busybox-1.0.0.tgz"))).To(Succeed())
+			idx, _, err := r.fetchIndex(ctx, log, src)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(h.downloads()).To(Equal(4))
+			Expect(idx.Entries).To(HaveLen(1))
+			Expect(r.chartMetadata.get("bucket")).To(HaveLen(1))
+		})
+
+		It("Should drop the charts of deleted Sources", func() {
+			r := &SourceReconciler{}
+			_, _, err := r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{URL: ts.URL + "/charts/", GenerateIndex: true}))
+			Expect(err).ToNot(HaveOccurred())
+			r.chartMetadata.set("other", map[string]*cachedChart{"sha256:abc": {}})
+			Expect(r.chartMetadata.get("bucket")).ToNot(BeEmpty())
+
+			r.forget(types.NamespacedName{Name: "bucket"})
+			Expect(r.chartMetadata.get("bucket")).To(BeNil())
+			Expect(r.chartMetadata.get("other")).To(HaveLen(1))
+		})
+
+		It("Should not follow links outside of the listing", func() {
+			outside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `<a href="%s/charts/mysql-1.3.0.tgz">mysql</a> <a href="/other/busybox-1.0.0.tgz">busybox</a>`, ts.URL)
+			}))
+			defer outside.Close()
+			r := &SourceReconciler{}
+			_, _, err := r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{
+				URL:           outside.URL + "/charts",
+				GenerateIndex: true,
+			}))
+			Expect(err).To(MatchError(ContainSubstring("no packaged charts")))
+			Expect(h.downloads()).To(Equal(0))
+		})
+	})
+
+	Context("When the Source is an S3 bucket", func() {
+		It("Should index and download objects with signed requests", func() {
+			objects := map[string]string{"/charts/stable/mysql-1.3.0.tgz": filepath.Join(dir, "mysql-1.3.0.tgz")}
+			s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if r.URL.Query().Get("list-type") == "2" {
+					if r.URL.Query().Get("prefix") != "stable/" {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					fmt.Fprint(w, `<ListBucketResult><Contents><Key>stable/mysql-1.3.0.tgz</Key><ETag>"abc"</ETag>`+
+						`<LastModified>2020-10-01T00:00:00.000Z</LastModified></Contents>`+
+						`<Contents><Key>stable/README.md</Key></Contents></ListBucketResult>`)
+					return
+				}
+				p, ok := objects[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				http.ServeFile(w, r, p)
+			}))
+			defer s3.Close()
+
+			r := &SourceReconciler{}
+			src := newSource(marketplacev1alpha2.SourceSpec{
+				URL:           "s3://charts/stable?endpoint=" + s3.URL,
+				Username:      "AKID",
+				Password:      "secret",
+				GenerateIndex: true,
+			})
+			idx, base, err := r.fetchIndex(ctx, log, src)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(base).To(Equal(s3.URL + "/charts/stable"))
+			Expect(idx.Entries).To(HaveLen(1))
+			Expect(idx.Entries["mysql"][0].URLs).To(Equal([]string{s3.URL + "/charts/stable/mysql-1.3.0.tgz"}))
+			Expect(idx.Entries["mysql"][0].Created.Year()).To(Equal(2020))
+
+			data, err := fetchChartFile(ctx, src, idx.Entries["mysql"][0].URLs[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).ToNot(BeEmpty())
+		})
+
+		It("Should require generateIndex", func() {
+			_, _, err := (&SourceReconciler{}).fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{URL: "s3://charts"}))
+			Expect(err).To(MatchError(ContainSubstring("generateIndex")))
+		})
+	})
+})
@@ -0,0 +1,96 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/scan"
+)
+
+// chartImages returns the images cv deploys, from its artifacthub.io/images annotation when it has one, and
+// otherwise by rendering the chart with its default values.
+func (r *SourceReconciler) chartImages(ctx context.Context, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion) ([]string, error) {
+	if images, ok, err := scan.AnnotatedImages(cv.Annotations); ok {
+		return images, err
+	}
+	ch, err := r.loadChart(ctx, src, chartName, cv)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load chart")
+	}
+	images, err := scan.Images(ch)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot render chart")
+	}
+	return images, nil
+}
+
+// versionSet remembers chart versions whose images have been extracted without finding any, so that they aren't
+// downloaded and rendered again on every sync. An empty image list can't be told apart from one that was never
+// extracted once it has been stored. Versions that failed aren't remembered, so that transient errors are retried.
+type versionSet struct {
+	mu       sync.Mutex
+	versions map[scanKey]bool
+}
+
+func (s *versionSet) has(source, chartName, version string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versions[scanKey{source: source, chart: chartName, version: version}]
+}
+
+func (s *versionSet) add(source, chartName, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions == nil {
+		s.versions = make(map[scanKey]bool)
+	}
+	s.versions[scanKey{source: source, chart: chartName, version: version}] = true
+}
+
+// forget drops the versions of a deleted Source.
+func (s *versionSet) forget(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.versions {
+		if key.source == source {
+			delete(s.versions, key)
+		}
+	}
+}
+
+// extractImages records the images of cv, reporting whether cv changed.
+func (r *SourceReconciler) extractImages(ctx context.Context, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion) (bool, error) {
+	if len(cv.Images) > 0 || (cv.Removed != nil && *cv.Removed) || r.imagesExtracted.has(sourceKey(src), chartName, cv.Version) {
+		return false, nil
+	}
+	images, err := r.chartImages(ctx, src, chartName, cv)
+	if err != nil {
+		return false, err
+	}
+	if len(images) == 0 {
+		r.imagesExtracted.add(sourceKey(src), chartName, cv.Version)
+		return false, nil
+	}
+	cv.Images = images
+	return true, nil
+}
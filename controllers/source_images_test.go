@@ -0,0 +1,123 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/scan"
+)
+
+var _ = Describe("Image extraction", func() {
+
+	ctx := context.Background()
+
+	var (
+		ts    *httptest.Server
+		r     *SourceReconciler
+		src   *marketplacev1alpha2.Source
+		mu    sync.Mutex
+		fetch int
+	)
+
+	BeforeEach(func() {
+		fetch = 0
+		files := http.FileServer(http.Dir("testdata/marketplace-source/"))
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			fetch++
+			mu.Unlock()
+			files.ServeHTTP(w, req)
+		}))
+		r = &SourceReconciler{}
+		src = &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable"},
+			Spec:       marketplacev1alpha2.SourceSpec{URL: ts.URL, ExtractImages: true},
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should render charts with their default values", func() {
+		cv := &marketplacev1alpha3.ChartVersion{Version: "1.3.0", URLs: []string{ts.URL + "/mysql-1.3.0.tgz"}}
+		changed, err := r.extractImages(ctx, src, "mysql", cv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(cv.Images).To(Equal([]string{"busybox:1.29.3", "dduportal/bats:0.4.0", "mysql:5.7.14"}))
+
+		changed, err = r.extractImages(ctx, src, "mysql", cv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(fetch).To(Equal(1))
+	})
+
+	It("Should prefer the Artifact Hub images annotation", func() {
+		cv := &marketplacev1alpha3.ChartVersion{
+			Version:     "1.3.0",
+			URLs:        []string{ts.URL + "/mysql-1.3.0.tgz"},
+			Annotations: map[string]string{scan.ImagesAnnotation: "- name: mysql\n  image: mysql:8.0.22\n"},
+		}
+		_, err := r.extractImages(ctx, src, "mysql", cv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cv.Images).To(Equal([]string{"mysql:8.0.22"}))
+		Expect(fetch).To(BeZero())
+	})
+
+	It("Should not retry versions without images", func() {
+		cv := &marketplacev1alpha3.ChartVersion{
+			Version:     "1.3.0",
+			URLs:        []string{ts.URL + "/mysql-1.3.0.tgz"},
+			Annotations: map[string]string{scan.ImagesAnnotation: "[]"},
+		}
+		changed, err := r.extractImages(ctx, src, "mysql", cv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(r.imagesExtracted.has("stable", "mysql", "1.3.0")).To(BeTrue())
+
+		r.forget(types.NamespacedName{Name: "stable"})
+		Expect(r.imagesExtracted.has("stable", "mysql", "1.3.0")).To(BeFalse())
+
+		removed := true
+		cv = &marketplacev1alpha3.ChartVersion{Version: "1.3.0", URLs: []string{ts.URL + "/mysql-1.3.0.tgz"}, Removed: &removed}
+		changed, err = r.extractImages(ctx, src, "mysql", cv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(fetch).To(BeZero())
+	})
+
+	It("Should retry versions that failed", func() {
+		cv := &marketplacev1alpha3.ChartVersion{Version: "9.9.9", URLs: []string{ts.URL + "/missing-9.9.9.tgz"}}
+		_, err := r.extractImages(ctx, src, "missing", cv)
+		Expect(err).To(MatchError(ContainSubstring("cannot load chart")))
+		_, err = r.extractImages(ctx, src, "missing", cv)
+		Expect(err).To(MatchError(ContainSubstring("cannot load chart")))
+		Expect(fetch).To(Equal(2))
+		Expect(r.imagesExtracted.has("stable", "missing", "9.9.9")).To(BeFalse())
+	})
+})
@@ -0,0 +1,177 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+const defaultIndexKey = "index.yaml"
+
+// fetchIndex loads the repository index of src from its URL, directory or ConfigMap/Secret, or generates it from the
+// packaged charts at URL. It also returns the URL that relative chart URLs are resolved against.
+func (r *SourceReconciler) fetchIndex(ctx context.Context, log logr.Logger, src *marketplacev1alpha2.Source) (*repo.IndexFile, string, error) {
+	switch {
+	case src.Spec.Directory != "" && src.Spec.IndexFrom != nil:
+		return nil, "", errors.New("spec.directory and spec.indexFrom are mutually exclusive")
+	case src.Spec.GenerateIndex && (src.Spec.Directory != "" || src.Spec.IndexFrom != nil):
+		return nil, "", errors.New("spec.generateIndex requires spec.url, not spec.directory or spec.indexFrom")
+	case src.Spec.Directory != "":
+		dir, err := filepath.Abs(src.Spec.Directory)
+		if err != nil {
+			return nil, "", err
+		}
+		idx, err := r.loadDirectoryIndex(ctx, log, sourceKey(src), dir)
+		return idx, "file://" + filepath.ToSlash(dir), err
+	case src.Spec.IndexFrom != nil:
+		data, err := r.readIndexReference(ctx, src.Spec.IndexFrom)
+		if err != nil {
+			return nil, "", err
+		}
+		idx, err := loadIndexData(data)
+		return idx, src.Spec.URL, err
+	case src.Spec.GenerateIndex:
+		l, baseURL, err := newChartLister(src)
+		if err != nil {
+			return nil, "", err
+		}
+		idx, err := r.generateIndex(ctx, log, sourceKey(src), l)
+		if err == nil && len(idx.Entries) == 0 {
+			err = errors.Errorf("no packaged charts found at %s", src.Spec.URL)
+		}
+		return idx, baseURL, err
+	case strings.HasPrefix(src.Spec.URL, "s3://"):
+		return nil, "", errors.New("s3 urls require spec.generateIndex")
+	case src.Spec.URL != "":
+		entry := &repo.Entry{
+			Name:     src.Name,
+			URL:      src.Spec.URL,
+			Username: src.Spec.Username,
+			Password: src.Spec.Password,
+			CertFile: src.Spec.CertFile,
+			KeyFile:  src.Spec.KeyFile,
+			CAFile:   src.Spec.CAFile,
+		}
+		cr, err := repo.NewChartRepository(entry, getter.All(&cli.EnvSettings{}))
+		if err != nil {
+			return nil, "", err
+		}
+		path, err := cr.DownloadIndexFile()
+		if err != nil {
+			return nil, "", err
+		}
+		idx, err := repo.LoadIndexFile(path)
+		return idx, src.Spec.URL, err
+	default:
+		return nil, "", errors.New("one of spec.url, spec.directory or spec.indexFrom is required")
+	}
+}
+
+// loadDirectoryIndex loads dir/index.yaml, adding any packaged charts in dir that it doesn't list.
+func (r *SourceReconciler) loadDirectoryIndex(ctx context.Context, log logr.Logger, source, dir string) (*repo.IndexFile, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", dir)
+	}
+	idx := repo.NewIndexFile()
+	if _, err := os.Stat(filepath.Join(dir, defaultIndexKey)); err == nil {
+		idx, err = repo.LoadIndexFile(filepath.Join(dir, defaultIndexKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+	packaged, err := r.generateIndex(ctx, log, source, &dirLister{dir: dir})
+	if err != nil {
+		return nil, err
+	}
+	idx.Merge(packaged)
+	idx.SortEntries()
+	if len(idx.Entries) == 0 {
+		return nil, errors.Errorf("%s contains no index.yaml or packaged charts", dir)
+	}
+	return idx, nil
+}
+
+func (r *SourceReconciler) readIndexReference(ctx context.Context, ref *marketplacev1alpha2.IndexReference) ([]byte, error) {
+	key := ref.Key
+	if key == "" {
+		key = defaultIndexKey
+	}
+	nn := client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}
+	var reader client.Reader = r.Client
+	if r.apiReader != nil {
+		reader = r.apiReader
+	}
+	switch ref.Kind {
+	case "ConfigMap":
+		var cm corev1.ConfigMap
+		if err := reader.Get(ctx, nn, &cm); err != nil {
+			return nil, err
+		}
+		if s, ok := cm.Data[key]; ok {
+			return []byte(s), nil
+		}
+		if b, ok := cm.BinaryData[key]; ok {
+			return b, nil
+		}
+	case "Secret":
+		var s corev1.Secret
+		if err := reader.Get(ctx, nn, &s); err != nil {
+			return nil, err
+		}
+		if b, ok := s.Data[key]; ok {
+			return b, nil
+		}
+	default:
+		return nil, errors.Errorf("unsupported spec.indexFrom.kind %q", ref.Kind)
+	}
+	return nil, errors.Errorf("%s %s has no key %q", ref.Kind, nn, key)
+}
+
+// loadIndexData parses an index with repo.LoadIndexFile, which only reads from disk.
+func loadIndexData(data []byte) (*repo.IndexFile, error) {
+	f, err := ioutil.TempFile("", "index-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return repo.LoadIndexFile(f.Name())
+}
@@ -0,0 +1,139 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+)
+
+var _ = Describe("Source index", func() {
+
+	ctx := context.Background()
+	log := logf.NullLogger{}
+
+	var index []byte
+
+	BeforeEach(func() {
+		var err error
+		index, err = ioutil.ReadFile("testdata/marketplace-source/index.yaml")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	newSource := func(spec marketplacev1alpha2.SourceSpec) *marketplacev1alpha2.Source {
+		return &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "local"},
+			Spec:       spec,
+		}
+	}
+
+	Context("When the Source is a directory", func() {
+		It("Should merge index.yaml with packaged charts", func() {
+			r := &SourceReconciler{}
+			idx, base, err := r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{Directory: "testdata/marketplace-source/"}))
+			Expect(err).ToNot(HaveOccurred())
+			abs, _ := filepath.Abs("testdata/marketplace-source")
+			Expect(base).Should(Equal("file://" + abs))
+			Expect(idx.Entries).Should(HaveKey("busybox"))
+			Expect(idx.Entries).Should(HaveKey("otherthing"))
+			Expect(idx.Entries).Should(HaveKey("mysql"))
+			Expect(idx.Entries["mysql"][0].Digest).ShouldNot(BeEmpty())
+		})
+
+		It("Should index directories without index.yaml", func() {
+			dir, err := ioutil.TempDir("", "charts")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			data, err := ioutil.ReadFile("testdata/marketplace-source/mysql-1.3.0.tgz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "mysql-1.3.0.tgz"), data, 0644)).To(Succeed())
+
+			r := &SourceReconciler{}
+			idx, err := r.loadDirectoryIndex(ctx, log, "local", dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Entries).Should(HaveLen(1))
+			Expect(idx.Entries["mysql"][0].URLs).Should(Equal([]string{"mysql-1.3.0.tgz"}))
+
+			_, err = r.loadDirectoryIndex(ctx, log, "local", filepath.Join(dir, "missing"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should only read chart files inside the directory", func() {
+			abs, err := filepath.Abs("testdata")
+			Expect(err).ToNot(HaveOccurred())
+			src := newSource(marketplacev1alpha2.SourceSpec{Directory: "testdata/marketplace-source"})
+			_, err = fetchChartFile(ctx, src, "file://"+abs+"/marketplace-source/mysql-1.3.0.tgz")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = fetchChartFile(ctx, src, "file://"+abs+"/marketplace-source/../marketplace-updated-source/index.yaml")
+			Expect(err).To(HaveOccurred())
+			_, err = fetchChartFile(ctx, newSource(marketplacev1alpha2.SourceSpec{URL: "http://charts"}), "file:///etc/passwd")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When the index is read from a ConfigMap or Secret", func() {
+		It("Should load the index", func() {
+			r := &SourceReconciler{
+				Client: fake.NewFakeClientWithScheme(scheme.Scheme,
+					&corev1.ConfigMap{
+						ObjectMeta: metav1.ObjectMeta{Name: "charts", Namespace: "default"},
+						Data:       map[string]string{"index.yaml": string(index)},
+					},
+					&corev1.Secret{
+						ObjectMeta: metav1.ObjectMeta{Name: "charts", Namespace: "default"},
+						Data:       map[string][]byte{"repo": index},
+					},
+				),
+			}
+			idx, base, err := r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{
+				URL:       "https://charts.example.com",
+				IndexFrom: &marketplacev1alpha2.IndexReference{Kind: "ConfigMap", Namespace: "default", Name: "charts"},
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(base).Should(Equal("https://charts.example.com"))
+			Expect(idx.Entries).Should(HaveLen(2))
+
+			idx, _, err = r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{
+				IndexFrom: &marketplacev1alpha2.IndexReference{Kind: "Secret", Namespace: "default", Name: "charts", Key: "repo"},
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Entries).Should(HaveKey("busybox"))
+
+			_, _, err = r.fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{
+				IndexFrom: &marketplacev1alpha2.IndexReference{Kind: "Secret", Namespace: "default", Name: "charts"},
+			}))
+			Expect(err).Should(MatchError(ContainSubstring(`has no key "index.yaml"`)))
+		})
+	})
+
+	It("Should require an index location", func() {
+		_, _, err := (&SourceReconciler{}).fetchIndex(ctx, log, newSource(marketplacev1alpha2.SourceSpec{}))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,290 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/scan"
+)
+
+const vulnerabilitiesLabel = "marketplace.criticalstack.com/app.vulnerabilities"
+
+// needsScan reports whether cv hasn't been scanned yet, or was last scanned more than ScanInterval ago. Removed
+// versions aren't scanned.
+func (r *SourceReconciler) needsScan(cv *marketplacev1alpha3.ChartVersion) bool {
+	if cv.Removed != nil && *cv.Removed {
+		return false
+	}
+	if cv.Scan == nil {
+		return true
+	}
+	return r.ScanInterval > 0 && time.Since(cv.Scan.ScannedAt.Time) >= r.ScanInterval
+}
+
+// scanVersion scans the images cv deploys and records the summary on cv. Reports are shared through reports, since
+// versions of a chart often deploy the same images.
+func (r *SourceReconciler) scanVersion(ctx context.Context, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion, reports *scanReports) {
+	summary := &marketplacev1alpha3.ScanSummary{ScannedAt: metav1.Now()}
+	cv.Scan = summary
+	images := cv.Images
+	if len(images) == 0 {
+		var err error
+		if images, err = r.chartImages(ctx, src, chartName, cv); err != nil {
+			summary.Error = err.Error()
+			return
+		}
+	}
+	var errs []string
+	for _, image := range images {
+		report, ok := reports.get(image)
+		if !ok {
+			var err error
+			report, err = r.Scanner.Scan(ctx, image)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", image, err))
+				continue
+			}
+			reports.add(image, report)
+		}
+		summary.Images++
+		summary.Critical += report.Critical
+		summary.High += report.High
+	}
+	summary.Error = strings.Join(errs, "; ")
+}
+
+// scanReports are the reports of images scanned for a Source, shared by the versions being scanned concurrently.
+type scanReports struct {
+	mu      sync.Mutex
+	reports map[string]*scan.Report
+}
+
+func (s *scanReports) get(image string) (*scan.Report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reports[image]
+	return r, ok
+}
+
+func (s *scanReports) add(image string, r *scan.Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports == nil {
+		s.reports = make(map[string]*scan.Report)
+	}
+	s.reports[image] = r
+}
+
+type scanKey struct {
+	source, chart, version string
+}
+
+type scanRequest struct {
+	src   *marketplacev1alpha2.Source
+	owner ownerObject
+	cv    marketplacev1alpha3.ChartVersion
+}
+
+// scanQueue scans chart versions in the background with a bounded number of workers, so that a sync only queues the
+// versions that need a scan and picks up the results of earlier ones instead of waiting for the scanner. Once the
+// last queued version of a Source has been scanned, the Source is synced again through events.
+type scanQueue struct {
+	r       *SourceReconciler
+	workers int
+	timeout time.Duration
+	queue   workqueue.Interface
+
+	// sources and namespaceSources receive the Sources and NamespaceSources whose scans have completed.
+	sources          chan event.GenericEvent
+	namespaceSources chan event.GenericEvent
+
+	mu       sync.Mutex
+	requests map[scanKey]*scanRequest
+	results  map[scanKey]*marketplacev1alpha3.ScanSummary
+	pending  map[string]int
+	reports  map[string]*scanReports
+}
+
+func newScanQueue(r *SourceReconciler, workers int, timeout time.Duration) *scanQueue {
+	return &scanQueue{
+		r:                r,
+		workers:          workers,
+		timeout:          timeout,
+		queue:            workqueue.New(),
+		sources:          make(chan event.GenericEvent),
+		namespaceSources: make(chan event.GenericEvent),
+		requests:         make(map[scanKey]*scanRequest),
+		results:          make(map[scanKey]*marketplacev1alpha3.ScanSummary),
+		pending:          make(map[string]int),
+		reports:          make(map[string]*scanReports),
+	}
+}
+
+// NeedLeaderElection runs scans on the leader only, like the syncs that queue them.
+func (q *scanQueue) NeedLeaderElection() bool {
+	return true
+}
+
+// Start runs the workers until stop is closed.
+func (q *scanQueue) Start(stop <-chan struct{}) error {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q.process() {
+			}
+		}()
+	}
+	<-stop
+	q.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
+
+// enqueue queues cv of the Source synced by t for a scan, unless it is already queued.
+func (q *scanQueue) enqueue(t syncTarget, chartName string, cv *marketplacev1alpha3.ChartVersion) {
+	src := t.source()
+	key := scanKey{source: sourceKey(src), chart: chartName, version: cv.Version}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.requests[key]; ok {
+		return
+	}
+	q.requests[key] = &scanRequest{
+		src:   src.DeepCopy(),
+		owner: t.owner().DeepCopyObject().(ownerObject),
+		cv:    *cv.DeepCopy(),
+	}
+	q.pending[key.source]++
+	if q.reports[key.source] == nil {
+		q.reports[key.source] = &scanReports{}
+	}
+	q.queue.Add(key)
+}
+
+// take returns and forgets the completed scan of a chart version, or nil if there is none.
+func (q *scanQueue) take(source, chartName, version string) *marketplacev1alpha3.ScanSummary {
+	key := scanKey{source: source, chart: chartName, version: version}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.results[key]
+	delete(q.results, key)
+	return s
+}
+
+// forget drops the queued scans and the results of a deleted Source.
+func (q *scanQueue) forget(source string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key := range q.requests {
+		if key.source == source {
+			delete(q.requests, key)
+		}
+	}
+	for key := range q.results {
+		if key.source == source {
+			delete(q.results, key)
+		}
+	}
+	delete(q.pending, source)
+	delete(q.reports, source)
+}
+
+func (q *scanQueue) process() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(scanKey)
+
+	q.mu.Lock()
+	req, ok := q.requests[key]
+	reports := q.reports[key.source]
+	q.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+	cv := req.cv
+	q.r.scanVersion(ctx, req.src, key.chart, &cv, reports)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.requests[key] != req {
+		// the Source was deleted during the scan
+		return true
+	}
+	delete(q.requests, key)
+	q.results[key] = cv.Scan
+	if q.pending[key.source]--; q.pending[key.source] > 0 {
+		return true
+	}
+	delete(q.pending, key.source)
+	delete(q.reports, key.source)
+	ch := q.sources
+	if req.src.Namespace != "" {
+		ch = q.namespaceSources
+	}
+	go func() {
+		ch <- event.GenericEvent{Meta: req.owner, Object: req.owner}
+	}()
+	return true
+}
+
+// loadChart loads the archive of cv, reading it from the chart store when it has been cached.
+func (r *SourceReconciler) loadChart(ctx context.Context, src *marketplacev1alpha2.Source, chartName string, cv *marketplacev1alpha3.ChartVersion) (*chart.Chart, error) {
+	rc, err := openChartArchive(ctx, r.ChartStore, src, chartName, cv)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return loader.LoadArchive(rc)
+}
+
+// vulnerabilityLabel returns the value of the vulnerabilities label for the scan of an Application's latest version:
+// critical or high when it has vulnerabilities of that severity, or none when a complete scan found neither.
+func vulnerabilityLabel(s *marketplacev1alpha3.ScanSummary) (string, bool) {
+	switch {
+	case s == nil:
+		return "", false
+	case s.Critical > 0:
+		return "critical", true
+	case s.High > 0:
+		return "high", true
+	case s.Error == "":
+		return "none", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,190 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/scan"
+)
+
+// fakeScanner returns canned reports, failing for images it doesn't know.
+type fakeScanner struct {
+	mu      sync.Mutex
+	reports map[string]scan.Report
+	scanned []string
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, image string) (*scan.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scanned = append(s.scanned, image)
+	r, ok := s.reports[image]
+	if !ok {
+		return nil, errors.Errorf("unknown image %s", image)
+	}
+	return &r, nil
+}
+
+var _ = Describe("Image scanning", func() {
+
+	ctx := context.Background()
+
+	var (
+		ts      *httptest.Server
+		scanner *fakeScanner
+		r       *SourceReconciler
+		src     *marketplacev1alpha2.Source
+	)
+
+	BeforeEach(func() {
+		ts = httptest.NewServer(http.FileServer(http.Dir("testdata/marketplace-source/")))
+		scanner = &fakeScanner{reports: map[string]scan.Report{
+			"mysql:5.7.14":   {Critical: 2, High: 5, Low: 7},
+			"busybox:1.29.3": {High: 1},
+		}}
+		r = &SourceReconciler{Scanner: scanner, ScanInterval: time.Hour}
+		src = &marketplacev1alpha2.Source{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable"},
+			Spec:       marketplacev1alpha2.SourceSpec{URL: ts.URL, ScanImages: true},
+		}
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should summarize the vulnerabilities of a version's images", func() {
+		cv := &marketplacev1alpha3.ChartVersion{Version: "1.3.0", URLs: []string{ts.URL + "/mysql-1.3.0.tgz"}}
+		Expect(r.needsScan(cv)).To(BeTrue())
+		r.scanVersion(ctx, src, "mysql", cv, &scanReports{})
+		Expect(cv.Scan).ToNot(BeNil())
+		Expect(cv.Scan.Images).To(Equal(2))
+		Expect(cv.Scan.Critical).To(Equal(2))
+		Expect(cv.Scan.High).To(Equal(6))
+		Expect(cv.Scan.ScannedAt.IsZero()).To(BeFalse())
+		// the chart's test pod image is unknown to the scanner
+		Expect(cv.Scan.Error).To(ContainSubstring("dduportal/bats:0.4.0"))
+		Expect(scanner.scanned).To(ConsistOf("busybox:1.29.3", "dduportal/bats:0.4.0", "mysql:5.7.14"))
+		l, ok := vulnerabilityLabel(cv.Scan)
+		Expect(ok).To(BeTrue())
+		Expect(l).To(Equal("critical"))
+		Expect(r.needsScan(cv)).To(BeFalse())
+
+		cv.Scan.ScannedAt = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+		Expect(r.needsScan(cv)).To(BeTrue())
+	})
+
+	It("Should scan extracted images without rendering the chart", func() {
+		cv := &marketplacev1alpha3.ChartVersion{Version: "1.3.0", URLs: []string{ts.URL + "/missing.tgz"}, Images: []string{"busybox:1.29.3"}}
+		r.scanVersion(ctx, src, "mysql", cv, &scanReports{})
+		Expect(cv.Scan.Error).To(BeEmpty())
+		Expect(cv.Scan.Images).To(Equal(1))
+		Expect(cv.Scan.High).To(Equal(1))
+	})
+
+	It("Should reuse reports of images scanned for the Source", func() {
+		reports := &scanReports{reports: map[string]*scan.Report{"mysql:5.7.14": {Critical: 1}}}
+		cv := &marketplacev1alpha3.ChartVersion{Version: "1.3.0", URLs: []string{ts.URL + "/mysql-1.3.0.tgz"}}
+		r.scanVersion(ctx, src, "mysql", cv, reports)
+		Expect(scanner.scanned).ToNot(ContainElement("mysql:5.7.14"))
+		Expect(cv.Scan.Critical).To(Equal(1))
+	})
+
+	It("Should record charts that can't be scanned", func() {
+		cv := &marketplacev1alpha3.ChartVersion{Version: "9.9.9", URLs: []string{ts.URL + "/missing-9.9.9.tgz"}}
+		r.scanVersion(ctx, src, "missing", cv, &scanReports{})
+		Expect(cv.Scan.Error).To(ContainSubstring("cannot load chart"))
+		Expect(cv.Scan.Images).To(BeZero())
+		_, ok := vulnerabilityLabel(cv.Scan)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Should skip removed versions", func() {
+		removed := true
+		Expect(r.needsScan(&marketplacev1alpha3.ChartVersion{Removed: &removed})).To(BeFalse())
+	})
+
+	It("Should scan queued versions in the background and sync their Source once done", func() {
+		q := newScanQueue(r, 1, time.Minute)
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() { done <- q.Start(stop) }()
+		defer func() {
+			close(stop)
+			Expect(<-done).To(Succeed())
+		}()
+
+		t := &clusterSource{src: src}
+		for _, v := range []string{"1.3.0", "1.2.0"} {
+			q.enqueue(t, "mysql", &marketplacev1alpha3.ChartVersion{Version: v, URLs: []string{ts.URL + "/mysql-1.3.0.tgz"}})
+		}
+		Expect(q.take("stable", "mysql", "1.3.0")).To(BeNil())
+
+		var e event.GenericEvent
+		Eventually(q.sources).Should(Receive(&e))
+		Expect(e.Meta.GetName()).To(Equal("stable"))
+		for _, v := range []string{"1.3.0", "1.2.0"} {
+			scanned := q.take("stable", "mysql", v)
+			Expect(scanned).ToNot(BeNil())
+			Expect(scanned.Critical).To(Equal(2))
+			Expect(q.take("stable", "mysql", v)).To(BeNil())
+		}
+		// reports are shared by the versions of the Source, and only failed scans are retried
+		Expect(scanner.scanned).To(ConsistOf("busybox:1.29.3", "dduportal/bats:0.4.0", "mysql:5.7.14", "dduportal/bats:0.4.0"))
+	})
+
+	It("Should drop the queued scans of deleted Sources", func() {
+		q := newScanQueue(r, 1, time.Minute)
+		q.enqueue(&clusterSource{src: src}, "mysql", &marketplacev1alpha3.ChartVersion{Version: "1.3.0"})
+		q.forget("stable")
+		Expect(q.requests).To(BeEmpty())
+		Expect(q.pending).To(BeEmpty())
+		Expect(q.reports).To(BeEmpty())
+	})
+
+	It("Should label applications by the severity of their latest scan", func() {
+		for _, tc := range []struct {
+			scan  marketplacev1alpha3.ScanSummary
+			label string
+		}{
+			{marketplacev1alpha3.ScanSummary{Critical: 1, High: 3}, "critical"},
+			{marketplacev1alpha3.ScanSummary{High: 3, Error: "busybox: timeout"}, "high"},
+			{marketplacev1alpha3.ScanSummary{}, "none"},
+		} {
+			l, ok := vulnerabilityLabel(&tc.scan)
+			Expect(ok).To(BeTrue())
+			Expect(l).To(Equal(tc.label))
+		}
+		_, ok := vulnerabilityLabel(&marketplacev1alpha3.ScanSummary{Error: "busybox: timeout"})
+		Expect(ok).To(BeFalse())
+		_, ok = vulnerabilityLabel(nil)
+		Expect(ok).To(BeFalse())
+	})
+})
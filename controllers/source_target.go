@@ -0,0 +1,173 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+// syncTarget is the resource a sync reads its spec from and writes its Applications and status to. A Source syncs
+// cluster-scoped Applications, and a NamespaceSource syncs NamespaceApplications in its own namespace.
+type syncTarget interface {
+	// source returns the spec and status being synced as a Source.
+	source() *marketplacev1alpha2.Source
+	// owner is the synced resource, which owns its Applications and is the subject of sync events.
+	owner() ownerObject
+	// validate rejects specs the target doesn't support.
+	validate() error
+	listApplications(ctx context.Context, c client.Client) ([]marketplacev1alpha3.Application, error)
+	// application returns the object app is applied as.
+	application(app *marketplacev1alpha3.Application) ownerObject
+	patchStatus(ctx context.Context, c client.Client, status marketplacev1alpha2.SourceStatus) error
+}
+
+type ownerObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// sourceKey identifies a Source in the chart store and the caches kept between syncs. NamespaceSources are kept
+// under namespaces/{namespace}/{name}, so that they can't collide with each other or with a Source.
+func sourceKey(src *marketplacev1alpha2.Source) string {
+	if src.Namespace == "" {
+		return src.Name
+	}
+	return path.Join("namespaces", src.Namespace, src.Name)
+}
+
+type clusterSource struct {
+	src *marketplacev1alpha2.Source
+}
+
+func (s *clusterSource) source() *marketplacev1alpha2.Source { return s.src }
+func (s *clusterSource) owner() ownerObject                  { return s.src }
+func (s *clusterSource) validate() error                     { return nil }
+
+func (s *clusterSource) listApplications(ctx context.Context, c client.Client) ([]marketplacev1alpha3.Application, error) {
+	var apps marketplacev1alpha3.ApplicationList
+	if err := c.List(ctx, &apps, client.MatchingLabels{"marketplace.criticalstack.com/source.name": s.src.Name}); err != nil {
+		return nil, err
+	}
+	return apps.Items, nil
+}
+
+func (s *clusterSource) application(app *marketplacev1alpha3.Application) ownerObject {
+	return &marketplacev1alpha3.Application{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: marketplacev1alpha3.GroupVersion.String(),
+			Kind:       "Application",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   app.Name,
+			Labels: app.Labels,
+		},
+		AppName:  app.AppName,
+		Versions: app.Versions,
+	}
+}
+
+func (s *clusterSource) patchStatus(ctx context.Context, c client.Client, status marketplacev1alpha2.SourceStatus) error {
+	old := s.src.DeepCopy()
+	s.src.Status = status
+	return c.Status().Patch(ctx, s.src, client.MergeFrom(old))
+}
+
+type namespaceSource struct {
+	ns  *marketplacev1alpha2.NamespaceSource
+	src *marketplacev1alpha2.Source
+}
+
+func newNamespaceSource(ns *marketplacev1alpha2.NamespaceSource) *namespaceSource {
+	src := &marketplacev1alpha2.Source{
+		ObjectMeta: *ns.ObjectMeta.DeepCopy(),
+		Spec:       *ns.Spec.DeepCopy(),
+		Status:     *ns.Status.DeepCopy(),
+	}
+	if ref := src.Spec.IndexFrom; ref != nil && ref.Namespace == "" {
+		ref.Namespace = ns.Namespace
+	}
+	return &namespaceSource{ns: ns, src: src}
+}
+
+func (s *namespaceSource) source() *marketplacev1alpha2.Source { return s.src }
+func (s *namespaceSource) owner() ownerObject                  { return s.ns }
+
+// validate rejects settings that would let a tenant read files of the manager, or ConfigMaps and Secrets outside of
+// their namespace.
+func (s *namespaceSource) validate() error {
+	spec := &s.src.Spec
+	switch {
+	case spec.Directory != "":
+		return errors.New("spec.directory is not supported by NamespaceSources")
+	case spec.CertFile != "" || spec.KeyFile != "" || spec.CAFile != "":
+		return errors.New("spec.certFile, spec.keyFile and spec.caFile are not supported by NamespaceSources")
+	case spec.IndexFrom != nil && spec.IndexFrom.Namespace != s.ns.Namespace:
+		return errors.Errorf("spec.indexFrom must be in namespace %q", s.ns.Namespace)
+	case spec.CacheCharts || spec.GenerateIndex || spec.ExtractImages || spec.ScanImages:
+		// these download and render every chart with the manager's resources and credentials
+		return errors.New("spec.cacheCharts, spec.generateIndex, spec.extractImages and spec.scanImages are not supported by NamespaceSources")
+	}
+	return nil
+}
+
+func (s *namespaceSource) listApplications(ctx context.Context, c client.Client) ([]marketplacev1alpha3.Application, error) {
+	var list marketplacev1alpha3.NamespaceApplicationList
+	if err := c.List(ctx, &list, client.InNamespace(s.ns.Namespace), client.MatchingLabels{"marketplace.criticalstack.com/source.name": s.ns.Name}); err != nil {
+		return nil, err
+	}
+	apps := make([]marketplacev1alpha3.Application, 0, len(list.Items))
+	for _, x := range list.Items {
+		apps = append(apps, marketplacev1alpha3.Application{
+			ObjectMeta: x.ObjectMeta,
+			AppName:    x.AppName,
+			Versions:   x.Versions,
+		})
+	}
+	return apps, nil
+}
+
+func (s *namespaceSource) application(app *marketplacev1alpha3.Application) ownerObject {
+	return &marketplacev1alpha3.NamespaceApplication{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: marketplacev1alpha3.GroupVersion.String(),
+			Kind:       "NamespaceApplication",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: s.ns.Namespace,
+			Name:      app.Name,
+			Labels:    app.Labels,
+		},
+		AppName:  app.AppName,
+		Versions: app.Versions,
+	}
+}
+
+func (s *namespaceSource) patchStatus(ctx context.Context, c client.Client, status marketplacev1alpha2.SourceStatus) error {
+	old := s.ns.DeepCopy()
+	s.ns.Status = status
+	s.src.Status = status
+	return c.Status().Patch(ctx, s.ns, client.MergeFrom(old))
+}
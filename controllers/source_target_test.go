@@ -0,0 +1,151 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+)
+
+var _ = Describe("NamespaceSource sync", func() {
+
+	ctx := context.Background()
+
+	var (
+		s  *runtime.Scheme
+		ns *marketplacev1alpha2.NamespaceSource
+	)
+
+	nsApp := func(namespace, name string, owner metav1.Object) *marketplacev1alpha3.NamespaceApplication {
+		app := &marketplacev1alpha3.NamespaceApplication{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+				Labels:    map[string]string{"marketplace.criticalstack.com/source.name": "stable"},
+			},
+			AppName:  "mysql",
+			Versions: []marketplacev1alpha3.ChartVersion{{Version: "1.6.6"}},
+		}
+		if owner != nil {
+			Expect(ctrl.SetControllerReference(owner, app, s)).To(Succeed())
+		}
+		return app
+	}
+
+	BeforeEach(func() {
+		s = runtime.NewScheme()
+		Expect(marketplacev1alpha2.AddToScheme(s)).To(Succeed())
+		Expect(marketplacev1alpha3.AddToScheme(s)).To(Succeed())
+		ns = &marketplacev1alpha2.NamespaceSource{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "stable", UID: "ns-uid"},
+			Spec:       marketplacev1alpha2.SourceSpec{URL: "https://charts.example.com"},
+		}
+	})
+
+	It("Should key NamespaceSources by namespace", func() {
+		Expect(sourceKey(newNamespaceSource(ns).source())).To(Equal("namespaces/team-a/stable"))
+		Expect(sourceKey(&marketplacev1alpha2.Source{ObjectMeta: metav1.ObjectMeta{Name: "stable"}})).To(Equal("stable"))
+	})
+
+	It("Should read indexFrom from its own namespace by default", func() {
+		ns.Spec.URL = ""
+		ns.Spec.IndexFrom = &marketplacev1alpha2.IndexReference{Kind: "ConfigMap", Name: "index"}
+		t := newNamespaceSource(ns)
+		Expect(t.validate()).To(Succeed())
+		Expect(t.source().Spec.IndexFrom.Namespace).To(Equal("team-a"))
+		Expect(ns.Spec.IndexFrom.Namespace).To(BeEmpty())
+	})
+
+	It("Should reject settings that reach outside of the namespace", func() {
+		for _, spec := range []marketplacev1alpha2.SourceSpec{
+			{Directory: "/var/run/secrets"},
+			{URL: "https://charts.example.com", CAFile: "/etc/ssl/private/ca.pem"},
+			{IndexFrom: &marketplacev1alpha2.IndexReference{Kind: "Secret", Namespace: "team-b", Name: "index"}},
+			{URL: "https://charts.example.com", CacheCharts: true},
+			{URL: "s3://charts/stable", GenerateIndex: true},
+			{URL: "https://charts.example.com", ExtractImages: true},
+			{URL: "https://charts.example.com", ScanImages: true},
+		} {
+			ns.Spec = spec
+			Expect(newNamespaceSource(ns).validate()).NotTo(Succeed())
+		}
+	})
+
+	It("Should only list NamespaceApplications of its namespace", func() {
+		c := fake.NewFakeClientWithScheme(s,
+			nsApp("team-a", "stable.mysql", ns),
+			nsApp("team-b", "stable.mysql", nil),
+			&marketplacev1alpha3.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "stable.mysql",
+					Labels: map[string]string{"marketplace.criticalstack.com/source.name": "stable"},
+				},
+			},
+		)
+		apps, err := newNamespaceSource(ns).listApplications(ctx, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apps).To(HaveLen(1))
+		Expect(apps[0].Namespace).To(Equal("team-a"))
+		Expect(apps[0].AppName).To(Equal("mysql"))
+		Expect(apps[0].Versions).To(HaveLen(1))
+	})
+
+	It("Should write NamespaceApplications owned by the NamespaceSource", func() {
+		t := newNamespaceSource(ns)
+		obj := t.application(&marketplacev1alpha3.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "stable.mysql", Labels: map[string]string{"a": "b"}},
+			AppName:    "mysql",
+		})
+		Expect(ctrl.SetControllerReference(t.owner(), obj, s)).To(Succeed())
+		app := obj.(*marketplacev1alpha3.NamespaceApplication)
+		Expect(app.Kind).To(Equal("NamespaceApplication"))
+		Expect(app.Namespace).To(Equal("team-a"))
+		Expect(app.Labels).To(HaveKeyWithValue("a", "b"))
+		ref := metav1.GetControllerOf(app)
+		Expect(ref).NotTo(BeNil())
+		Expect(ref.Kind).To(Equal("NamespaceSource"))
+		Expect(ref.Name).To(Equal("stable"))
+	})
+
+	It("Should record the sync status on the NamespaceSource", func() {
+		c := fake.NewFakeClientWithScheme(s, ns,
+			nsApp("team-a", "stable.mysql", ns),
+			nsApp("team-a", "stable.redis", nil),
+		)
+		var obj marketplacev1alpha2.NamespaceSource
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "team-a", Name: "stable"}, &obj)).To(Succeed())
+		r := &SourceReconciler{Client: c, recorder: record.NewFakeRecorder(10)}
+		Expect(r.setSourceStatus(ctx, newNamespaceSource(&obj), "Reconcile", marketplacev1alpha2.SourceStatus{
+			State: marketplacev1alpha2.SyncStateSuccess,
+		})).To(Succeed())
+
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "team-a", Name: "stable"}, &obj)).To(Succeed())
+		Expect(obj.Status.State).To(Equal(marketplacev1alpha2.SyncStateSuccess))
+		Expect(obj.Status.AppCount).To(Equal(1))
+	})
+})
@@ -0,0 +1,14 @@
+#!/bin/sh
+# controller-gen doesn't generate the conversion section of a CRD, so patch it into the CRDs of resources served by
+# the manager's conversion webhook. The CA bundle is injected by cert-manager.
+set -e
+
+for crd in "$@"; do
+	grep -q '^  conversion:' "$crd" && continue
+	sed -i.bak \
+		-e '/^    controller-gen.kubebuilder.io\/version:/a\
+    cert-manager.io/inject-ca-from: marketplace-system/marketplace-serving-cert' \
+		-e '/^  group: marketplace.criticalstack.com$/r hack/crd-conversion.yaml' \
+		"$crd"
+	rm "$crd.bak"
+done
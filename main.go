@@ -17,17 +17,33 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"database/sql"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	marketplacev1alpha2 "github.com/criticalstack/marketplace/api/v1alpha2"
+	marketplacev1alpha3 "github.com/criticalstack/marketplace/api/v1alpha3"
+	"github.com/criticalstack/marketplace/bundle"
+	"github.com/criticalstack/marketplace/catalog"
+	"github.com/criticalstack/marketplace/catalog/apiserver"
+	"github.com/criticalstack/marketplace/chartstore"
 	"github.com/criticalstack/marketplace/controllers"
+	"github.com/criticalstack/marketplace/scan"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -40,53 +56,332 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = marketplacev1alpha2.AddToScheme(scheme)
+	_ = marketplacev1alpha3.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		if err := runBundleCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
+	var catalogAddr string
+	var searchAPIAddr string
 	var enableLeaderElection bool
+	var enableWebhooks bool
+	var sourceWriteConcurrency int
+	var chartStoreURL string
+	var chartStoreServeURL string
+	var scannerURL string
+	var scanInterval time.Duration
+	var scanWorkers int
+	var scanTimeout time.Duration
+	var releaseSQLPollInterval time.Duration
+	var releaseRetention time.Duration
+	var releaseMirrorLevel string
+	var releaseCompressManifests bool
+	var releaseManifestURL string
+	var releaseRedactValues string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&catalogAddr, "catalog-addr", ":8082", "The address the catalog API binds to. Set to empty to disable.")
+	flag.StringVar(&searchAPIAddr, "search-api-addr", ":9444",
+		"The address the aggregated search API binds to. Set to empty to disable. "+
+			"Serving certificates are shared with the webhook server.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", true,
+		"Enable the webhook server, which serves Application conversion and enforces MarketplacePolicies. "+
+			"Serving certificates are read from /tmp/k8s-webhook-server/serving-certs.")
+	flag.IntVar(&sourceWriteConcurrency, "source-write-concurrency", 4,
+		"The maximum number of concurrent Application writes during a Source sync.")
+	flag.StringVar(&chartStoreURL, "chart-store", "",
+		"Where Sources with spec.cacheCharts store chart archives, either a directory or an s3://bucket/prefix URL. "+
+			"S3 credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
+	flag.StringVar(&chartStoreServeURL, "chart-store-url", "http://marketplace-catalog.marketplace-system.svc/charts/files",
+		"The URL clients download cached charts from, served by the catalog API.")
+	flag.StringVar(&scannerURL, "scanner-url", "",
+		"The scanning service that Sources with spec.scanImages send images to. It must respond with Trivy JSON "+
+			"reports. A bearer token is read from the SCANNER_TOKEN environment variable.")
+	flag.DurationVar(&scanInterval, "scan-interval", 24*time.Hour,
+		"How often chart versions are rescanned for vulnerabilities. Set to 0 to only scan new versions.")
+	flag.IntVar(&scanWorkers, "scan-workers", 2,
+		"The maximum number of chart versions scanned concurrently.")
+	flag.DurationVar(&scanTimeout, "scan-timeout", 10*time.Minute,
+		"How long the scan of a chart version may take before it is recorded as incomplete.")
+	flag.DurationVar(&releaseSQLPollInterval, "release-sql-poll-interval", time.Minute,
+		"How often releases stored by helm's sql driver are polled. The Postgres connection string is read from the "+
+			"HELM_DRIVER_SQL_CONNECTION_STRING environment variable; releases aren't polled when it is unset.")
+	flag.DurationVar(&releaseRetention, "release-retention", 24*time.Hour,
+		"How long Releases of releases uninstalled with --keep-history are kept after they were uninstalled.")
+	flag.StringVar(&releaseMirrorLevel, "release-mirror-level", string(marketplacev1alpha2.ReleaseMirrorFull),
+		"How much of each helm release is mirrored into its Release: metadata, values (metadata and values) or full. "+
+			"The manifests of releases that aren't mirrored in full are served by the catalog API. The data of Secrets is "+
+			"redacted from mirrored manifests, hooks and notes.")
+	flag.BoolVar(&releaseCompressManifests, "release-compress-manifests", false,
+		"Store the manifests of releases mirrored in full gzipped, in spec.compressedManifest.")
+	flag.StringVar(&releaseManifestURL, "release-manifest-url", "http://marketplace-catalog.marketplace-system.svc/api/v1/releases",
+		"The URL clients read the manifests of releases from, served by the catalog API.")
+	flag.StringVar(&releaseRedactValues, "release-redact-values", "",
+		"A comma separated list of value names or dotted paths, such as auth.rootPassword, that are redacted from "+
+			"mirrored release values. Values the chart's values.schema.json marks writeOnly or with format password, "+
+			"and strings named like passwords, secrets, tokens or keys, are always redacted.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	switch level := marketplacev1alpha2.ReleaseMirrorLevel(releaseMirrorLevel); level {
+	case marketplacev1alpha2.ReleaseMirrorMetadata, marketplacev1alpha2.ReleaseMirrorValues, marketplacev1alpha2.ReleaseMirrorFull:
+	default:
+		setupLog.Error(errors.Errorf("unknown release mirror level %q", level), "invalid --release-mirror-level")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
 		LeaderElection:     enableLeaderElection,
 		LeaderElectionID:   "3695568d.criticalstack.com",
+		NewCache:           controllers.NewCache,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	var store chartstore.Store
+	if chartStoreURL != "" {
+		store, err = chartstore.New(chartStoreURL)
+		if err != nil {
+			setupLog.Error(err, "unable to create chart store")
+			os.Exit(1)
+		}
+	}
+
+	var scanner scan.Scanner
+	if scannerURL != "" {
+		scanner = &scan.HTTP{URL: scannerURL, Token: os.Getenv("SCANNER_TOKEN")}
+	}
+
 	if err = (&controllers.SourceReconciler{
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Source"),
 		Scheme: mgr.GetScheme(),
+
+		MaxConcurrentWrites: sourceWriteConcurrency,
+		ChartStore:          store,
+		ChartStoreURL:       chartStoreServeURL,
+		Scanner:             scanner,
+		ScanInterval:        scanInterval,
+		ScanWorkers:         scanWorkers,
+		ScanTimeout:         scanTimeout,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Source")
 		os.Exit(1)
 	}
+	var releaseDB *sql.DB
+	if dsn := os.Getenv("HELM_DRIVER_SQL_CONNECTION_STRING"); dsn != "" {
+		releaseDB, err = sql.Open("postgres", dsn)
+		if err != nil {
+			setupLog.Error(err, "unable to open release database")
+			os.Exit(1)
+		}
+	}
+
+	var redactValues []string
+	if releaseRedactValues != "" {
+		redactValues = strings.Split(releaseRedactValues, ",")
+	}
 	if err = (&controllers.ReleaseReconciler{
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Release"),
 		Scheme: mgr.GetScheme(),
+
+		SQL:             releaseDB,
+		SQLPollInterval: releaseSQLPollInterval,
+		Retention:       releaseRetention,
+
+		MirrorLevel:       marketplacev1alpha2.ReleaseMirrorLevel(releaseMirrorLevel),
+		CompressManifests: releaseCompressManifests,
+		ManifestURL:       releaseManifestURL,
+		RedactValues:      redactValues,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Release")
 		os.Exit(1)
 	}
+	if err = (&controllers.CatalogViewReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("CatalogView"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CatalogView")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		if err = ctrl.NewWebhookManagedBy(mgr).
+			For(&marketplacev1alpha3.Application{}).
+			Complete(); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Application")
+			os.Exit(1)
+		}
+		if err = (&controllers.ReleasePolicyWebhook{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("ReleasePolicy"),
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ReleasePolicy")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	var index *catalog.Index
+	if catalogAddr != "" || searchAPIAddr != "" {
+		index = catalog.NewIndex()
+		if err := index.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create catalog search index")
+			os.Exit(1)
+		}
+	}
+	if catalogAddr != "" {
+		if err := mgr.Add(&catalog.Server{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("catalog"),
+			Index:  index,
+			Store:  store,
+			Addr:   catalogAddr,
+
+			Authenticator: &catalog.TokenReviewAuthenticator{Client: mgr.GetClient()},
+			Authorizer:    &catalog.SubjectAccessReviewAuthorizer{Client: mgr.GetClient()},
+			Downloader:    &controllers.ChartDownloader{Client: mgr.GetClient(), ChartStore: store},
+			Manifests:     &controllers.ReleaseManifests{Client: mgr.GetAPIReader(), SQL: releaseDB},
+		}); err != nil {
+			setupLog.Error(err, "unable to add catalog server")
+			os.Exit(1)
+		}
+	}
+	if searchAPIAddr != "" {
+		if err := mgr.Add(&apiserver.Server{
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Log:       ctrl.Log.WithName("search-api"),
+			Index:     index,
+			Addr:      searchAPIAddr,
+			CertDir:   filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		}); err != nil {
+			setupLog.Error(err, "unable to add search API server")
+			os.Exit(1)
+		}
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// runBundleCommand runs the export and import subcommands, which move a catalog to a cluster without access to its
+// chart repositories:
+//
+//   manager export --signing-key bundle.key --chart-store /data/charts --output catalog.tgz
+//   manager import --verify-key bundle.pub --chart-store /data/charts catalog.tgz
+func runBundleCommand(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	if f := flag.Lookup("kubeconfig"); f != nil {
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	var chartStoreURL, chartStoreServeURL, keyFile, output, source string
+	var insecureSkipVerify bool
+	fs.StringVar(&chartStoreURL, "chart-store", "",
+		"The chart store cached chart archives are read from on export and written to on import. "+
+			"Chart archives are left out when empty.")
+	switch cmd {
+	case "export":
+		fs.StringVar(&keyFile, "signing-key", "", "PEM encoded ed25519 private key the bundle is signed with.")
+		fs.StringVar(&output, "output", "-", "The file the bundle is written to, - for stdout.")
+		fs.StringVar(&source, "source", "", "Comma separated names of the Sources to export. All Sources are exported when empty.")
+	case "import":
+		fs.StringVar(&keyFile, "verify-key", "", "PEM encoded ed25519 public key the bundle signature is verified with.")
+		fs.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Import the bundle without verifying its signature.")
+		fs.StringVar(&chartStoreServeURL, "chart-store-url", "http://marketplace-catalog.marketplace-system.svc/charts/files",
+			"The URL clients download imported charts from, served by the catalog API.")
+	}
+	fs.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	log := ctrl.Log.WithName(cmd)
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	var store chartstore.Store
+	if chartStoreURL != "" {
+		if store, err = chartstore.New(chartStoreURL); err != nil {
+			return err
+		}
+	}
+	ctx := context.Background()
+
+	switch cmd {
+	case "export":
+		if keyFile == "" {
+			return errors.New("--signing-key is required")
+		}
+		key, err := bundle.LoadPrivateKey(keyFile)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		opts := bundle.ExportOptions{Charts: store, Key: key, Log: log}
+		if source != "" {
+			opts.Sources = strings.Split(source, ",")
+		}
+		m, err := bundle.Export(ctx, c, w, opts)
+		if err != nil {
+			return err
+		}
+		log.Info("exported bundle", "sources", m.Sources, "files", len(m.Files))
+	case "import":
+		if fs.NArg() != 1 {
+			return errors.New("usage: manager import [flags] BUNDLE")
+		}
+		opts := bundle.ImportOptions{
+			InsecureSkipVerify: insecureSkipVerify,
+			Location:           fs.Arg(0),
+			Charts:             store,
+			ChartsURL:          chartStoreServeURL,
+			Scheme:             scheme,
+			Log:                log,
+		}
+		if keyFile != "" {
+			if opts.Key, err = bundle.LoadPublicKey(keyFile); err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		m, err := bundle.Import(ctx, c, f, opts)
+		if err != nil {
+			return err
+		}
+		log.Info("imported bundle", "sources", m.Sources, "files", len(m.Files))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTP is a Scanner that delegates to a scanning service. Each image is POSTed to URL as {"image": "<reference>"},
+// and the service responds with a report in Trivy's JSON format (trivy image --format json), either the current
+// {"Results": [...]} form or the bare list of results written by older Trivy releases. This makes a thin wrapper
+// around Trivy, or any scanner that can emit the same format, enough to back the marketplace.
+type HTTP struct {
+	URL string
+	// Token is sent as a bearer token when set.
+	Token string
+
+	// Client defaults to a client with DefaultTimeout.
+	Client *http.Client
+}
+
+// DefaultTimeout bounds the requests of an HTTP Scanner without a Client. Scanning an image that isn't in the
+// scanner's cache means pulling it, which takes a while for large images.
+const DefaultTimeout = 5 * time.Minute
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+type trivyResult struct {
+	Target          string `json:"Target"`
+	Vulnerabilities []struct {
+		VulnerabilityID string `json:"VulnerabilityID"`
+		Severity        string `json:"Severity"`
+	} `json:"Vulnerabilities"`
+}
+
+type trivyReport struct {
+	Results []trivyResult `json:"Results"`
+}
+
+func (s *HTTP) Scan(ctx context.Context, image string) (*Report, error) {
+	body, err := json.Marshal(map[string]string{"image": image})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	c := s.Client
+	if c == nil {
+		c = defaultClient
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("scanning %s: %s: %s", image, resp.Status, bytes.TrimSpace(data))
+	}
+	return parseTrivyReport(data)
+}
+
+// parseTrivyReport counts the vulnerabilities of a Trivy JSON report. A vulnerability found in several targets of
+// the image, e.g. in two language packages, is counted once.
+func parseTrivyReport(data []byte) (*Report, error) {
+	var results []trivyResult
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &results); err != nil {
+			return nil, errors.Wrap(err, "cannot decode scan report")
+		}
+	} else {
+		var report trivyReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, errors.Wrap(err, "cannot decode scan report")
+		}
+		results = report.Results
+	}
+	r := &Report{}
+	seen := make(map[string]bool)
+	for _, res := range results {
+		for _, v := range res.Vulnerabilities {
+			if v.VulnerabilityID != "" {
+				if seen[v.VulnerabilityID] {
+					continue
+				}
+				seen[v.VulnerabilityID] = true
+			}
+			r.Add(v.Severity)
+		}
+	}
+	return r, nil
+}
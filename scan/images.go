@@ -0,0 +1,132 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// ImagesAnnotation lists the images a chart uses in its Chart.yaml annotations, as defined by Artifact Hub:
+//
+//   artifacthub.io/images: |
+//     - name: app
+//       image: example.com/app:1.0.0
+const ImagesAnnotation = "artifacthub.io/images"
+
+// AnnotatedImages returns the sorted, deduplicated images listed in the ImagesAnnotation of a chart, and whether the
+// chart has the annotation.
+func AnnotatedImages(annotations map[string]string) ([]string, bool, error) {
+	v, ok := annotations[ImagesAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+	var entries []struct {
+		Name  string `json:"name"`
+		Image string `json:"image"`
+	}
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(v), 4096).Decode(&entries); err != nil {
+		return nil, true, errors.Wrapf(err, "cannot parse %s annotation", ImagesAnnotation)
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if e.Image != "" {
+			seen[e.Image] = true
+		}
+	}
+	return sortedImages(seen), true, nil
+}
+
+// containerFields hold the container lists of pod specs.
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// Images renders ch with its default values and returns the images of every container in the rendered manifests,
+// sorted and deduplicated. Images that depend on user-supplied values can't be found this way.
+func Images(ch *chart.Chart) ([]string, error) {
+	vals := map[string]interface{}{}
+	if err := chartutil.ProcessDependencies(ch, vals); err != nil {
+		return nil, err
+	}
+	opts := chartutil.ReleaseOptions{Name: "scan", Namespace: "default", IsInstall: true}
+	rvals, err := chartutil.ToRenderValues(ch, vals, opts, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	files, err := engine.Render(ch, rvals)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for name, content := range files {
+		if !strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml") {
+			continue
+		}
+		dec := yaml.NewYAMLOrJSONDecoder(strings.NewReader(content), 4096)
+		for {
+			var doc interface{}
+			if err := dec.Decode(&doc); err != nil {
+				// the rest of a file that isn't valid YAML is skipped, as helm would fail to install it anyway
+				break
+			}
+			findImages(doc, seen)
+		}
+	}
+	return sortedImages(seen), nil
+}
+
+func sortedImages(seen map[string]bool) []string {
+	images := make([]string, 0, len(seen))
+	for image := range seen {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// findImages walks a decoded manifest, collecting the images of container lists wherever they are nested, e.g. in
+// the pod template of a CronJob's job template.
+func findImages(v interface{}, seen map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, f := range containerFields {
+			containers, ok := v[f].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, c := range containers {
+				if c, ok := c.(map[string]interface{}); ok {
+					if image, ok := c["image"].(string); ok && image != "" {
+						seen[image] = true
+					}
+				}
+			}
+		}
+		for _, child := range v {
+			findImages(child, seen)
+		}
+	case []interface{}:
+		for _, child := range v {
+			findImages(child, seen)
+		}
+	}
+}
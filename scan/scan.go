@@ -0,0 +1,61 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scan finds the container images a chart deploys and scans them for known vulnerabilities.
+package scan
+
+import (
+	"context"
+)
+
+// Severities used by scanners, as in CVSS v3 ratings.
+const (
+	SeverityCritical = "CRITICAL"
+	SeverityHigh     = "HIGH"
+	SeverityMedium   = "MEDIUM"
+	SeverityLow      = "LOW"
+	SeverityUnknown  = "UNKNOWN"
+)
+
+// Scanner scans a container image for known vulnerabilities.
+type Scanner interface {
+	Scan(ctx context.Context, image string) (*Report, error)
+}
+
+// Report counts an image's vulnerabilities by severity.
+type Report struct {
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+}
+
+// Add counts a vulnerability of the given severity.
+func (r *Report) Add(severity string) {
+	switch severity {
+	case SeverityCritical:
+		r.Critical++
+	case SeverityHigh:
+		r.High++
+	case SeverityMedium:
+		r.Medium++
+	case SeverityLow:
+		r.Low++
+	default:
+		r.Unknown++
+	}
+}
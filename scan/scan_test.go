@@ -0,0 +1,161 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+const cronJob = `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  schedule: "* * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          initContainers:
+          - name: init
+            image: {{ .Values.init.image }}
+          containers:
+          - name: job
+            image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+`
+
+var _ = Describe("Images", func() {
+	It("Should find the images of rendered pod specs", func() {
+		ch := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "job", Version: "0.1.0"},
+			Templates: []*chart.File{
+				{Name: "templates/cronjob.yaml", Data: []byte(cronJob)},
+				{Name: "templates/second.yaml", Data: []byte("---\n" + cronJob + "---\n# empty\n")},
+				{Name: "templates/NOTES.txt", Data: []byte("image: ignored")},
+			},
+			Values: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "nginx", "tag": "1.19"},
+				"init":  map[string]interface{}{"image": "busybox:1.32"},
+			},
+		}
+		Expect(Images(ch)).To(Equal([]string{"busybox:1.32", "nginx:1.19"}))
+	})
+
+	It("Should render packaged charts with their default values", func() {
+		ch, err := loader.Load("../controllers/testdata/marketplace-source/mysql-1.3.0.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(Images(ch)).To(ContainElement("mysql:5.7.14"))
+	})
+
+	It("Should fail when the chart requires values", func() {
+		ch := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "required", Version: "0.1.0"},
+			Templates: []*chart.File{{
+				Name: "templates/pod.yaml",
+				Data: []byte(`image: {{ required "image is required" .Values.image }}`),
+			}},
+		}
+		_, err := Images(ch)
+		Expect(err).To(MatchError(ContainSubstring("image is required")))
+	})
+})
+
+var _ = Describe("AnnotatedImages", func() {
+	It("Should read the Artifact Hub images annotation", func() {
+		images, ok, err := AnnotatedImages(map[string]string{
+			ImagesAnnotation: "- name: app\n  image: example.com/app:1.0.0\n" +
+				"- name: sidecar\n  image: example.com/proxy:2.1\n  whitelisted: true\n" +
+				"- name: app-again\n  image: example.com/app:1.0.0\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(images).To(Equal([]string{"example.com/app:1.0.0", "example.com/proxy:2.1"}))
+	})
+
+	It("Should report charts without the annotation", func() {
+		_, ok, err := AnnotatedImages(map[string]string{"category": "database"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+		_, ok, err = AnnotatedImages(map[string]string{ImagesAnnotation: "image: [unterminated"})
+		Expect(err).To(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	})
+})
+
+var _ = Describe("HTTP", func() {
+	var (
+		ts     *httptest.Server
+		report string
+	)
+
+	BeforeEach(func() {
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct{ Image string }
+			if r.Header.Get("Authorization") != "Bearer token" || json.NewDecoder(r.Body).Decode(&req) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.Image != "nginx:1.19" {
+				http.Error(w, "image not found", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(report))
+		}))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("Should count vulnerabilities by severity", func() {
+		report = `{"SchemaVersion": 2, "ArtifactName": "nginx:1.19", "Results": [
+			{"Target": "nginx:1.19 (debian 10.6)", "Vulnerabilities": [
+				{"VulnerabilityID": "CVE-2020-0001", "Severity": "CRITICAL"},
+				{"VulnerabilityID": "CVE-2020-0002", "Severity": "HIGH"},
+				{"VulnerabilityID": "CVE-2020-0003", "Severity": "LOW"}]},
+			{"Target": "app/go.sum", "Vulnerabilities": [
+				{"VulnerabilityID": "CVE-2020-0002", "Severity": "HIGH"},
+				{"VulnerabilityID": "CVE-2020-0004", "Severity": "HIGH"}]}]}`
+		s := &HTTP{URL: ts.URL, Token: "token"}
+		r, err := s.Scan(context.Background(), "nginx:1.19")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*r).To(Equal(Report{Critical: 1, High: 2, Low: 1}))
+	})
+
+	It("Should read reports of older Trivy releases", func() {
+		report = `[{"Target": "nginx:1.19", "Vulnerabilities": [{"VulnerabilityID": "CVE-2020-0001", "Severity": "MEDIUM"}]},
+			{"Target": "node-pkg", "Vulnerabilities": null}]`
+		r, err := (&HTTP{URL: ts.URL, Token: "token"}).Scan(context.Background(), "nginx:1.19")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*r).To(Equal(Report{Medium: 1}))
+	})
+
+	It("Should return scanner errors", func() {
+		_, err := (&HTTP{URL: ts.URL, Token: "token"}).Scan(context.Background(), "missing:latest")
+		Expect(err).To(MatchError(ContainSubstring("image not found")))
+		_, err = (&HTTP{URL: ts.URL}).Scan(context.Background(), "nginx:1.19")
+		Expect(err).To(MatchError(ContainSubstring("401")))
+	})
+})